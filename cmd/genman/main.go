@@ -40,8 +40,9 @@ Fixed upstream delay (user → child).
 Fixed downstream delay (child → user).
 .TP
 .BR \-j ", " \-\-jitter " \fIduration\fR"
-Jitter applied to both directions. Adds uniform random variation in the range
-[\-jitter, +jitter] to each data transfer.
+Jitter applied to both directions. Adds random variation to the delay of
+each data transfer; with the default uniform distribution, in the range
+[\-jitter, +jitter].
 .TP
 .B \-\-up\-jitter \fIduration\fR
 Upstream jitter only.
@@ -49,6 +50,74 @@ Upstream jitter only.
 .B \-\-down\-jitter \fIduration\fR
 Downstream jitter only.
 .TP
+.B \-\-jitter\-dist \fIname\fR
+Shape of the jitter: \fBuniform\fR (default), \fBnormal\fR (standard
+deviation \fIjitter\fR), or the long-tailed \fBlognormal\fR, \fBpareto\fR
+and \fBexponential\fR. All average out to the base delay; the tailed ones
+keep most data slightly early and make a little very late, never taking more
+than \fIjitter\fR off the delay.
+.TP
+.B \-\-jitter\-shape \fIn\fR
+Shape parameter for the tailed distributions: sigma for \fBlognormal\fR
+(default 1) and the tail index alpha for \fBpareto\fR (default 2, must be
+above 1). A larger sigma or a smaller alpha gives a longer tail.
+.TP
+.B \-\-jitter\-correlation \fIr\fR
+Correlation of each chunk's jitter with the previous chunk's, from 0
+(independent, the default) to below 1. High values such as 0.9 make the
+delay drift up and down like a real queue instead of changing at random
+from chunk to chunk; the distribution of delays is unchanged. Also applies
+to \fB\-\-latency\-from\fR.
+.TP
+.B \-\-latency\-from \fIfile\fR
+Sample each chunk's delay from measured round-trip times instead of
+\fB\-\-rtt\fR and \fB\-\-jitter\fR, halved for each direction. The file can
+be \fBping\fR output, \fBmtr \-\-raw\fR or \fBmtr \-\-report\fR output (last
+hop), a list or CSV of RTTs in milliseconds, or a histogram: a CSV with a
+\fIcount\fR column. Cannot be combined with the delay and jitter flags.
+.TP
+.B \-\-loss \fIrate\fR
+Packet loss for both directions, as a percentage (\fB1%\fR) or fraction
+(\fB0.01\fR). No data is lost: as on a TCP stream, a lost segment holds
+itself and everything behind it back until retransmitted, for one round
+trip (fast retransmit) or the retransmission timeout, doubled for each lost
+retransmission.
+.TP
+.B \-\-up\-loss \fIrate\fR
+Upstream packet loss only.
+.TP
+.B \-\-down\-loss \fIrate\fR
+Downstream packet loss only.
+.TP
+.B \-\-loss\-burst \fIn\fR
+Mean number of segments lost in a row. Above 1, losses come in bursts
+(Gilbert-Elliott model) at the same overall rate, which can be at most
+\fIn\fR/(\fIn\fR+1).
+.TP
+.B \-\-slow\-start
+Model TCP slow start: each direction starts with \fB\-\-init\-cwnd\fR
+segments in flight and doubles its window every round trip while data is
+waiting, dropping back after the stream has been idle for a retransmission
+timeout.
+.TP
+.B \-\-init\-cwnd \fIsegments\fR
+Initial congestion window for \fB\-\-slow\-start\fR. Default: 10.
+.TP
+.B \-\-rwnd \fIsize\fR
+Maximum data in flight per direction, as a receive window or SSH channel
+window does. \fBssh\fR stands for OpenSSH's 2MB channel window.
+Example: \fB\-\-rwnd 64KB\fR
+.TP
+.B \-\-nagle
+Model Nagle's algorithm against the peer's delayed ACKs: while data is
+unacknowledged, a write smaller than a segment waits for the ACK, which
+comes a round trip plus the delayed-ACK timer later. Keystrokes typed in
+quick succession arrive in bunches.
+.TP
+.B \-\-delayed\-ack \fIduration\fR
+The peer's delayed-ACK timer. Default: 40ms with \fB\-\-nagle\fR, otherwise
+none. Example: \fB\-\-delayed\-ack 200ms\fR
+.TP
 .BR \-u ", " \-\-up " \fIbandwidth\fR"
 Upstream bandwidth limit. Example: \fB\-\-up 56kbit\fR
 .TP
@@ -58,9 +127,135 @@ Downstream bandwidth limit. Example: \fB\-\-down 1mbit\fR
 .BR \-c ", " \-\-chunk " \fIbytes\fR"
 Maximum bytes per write (0 = unlimited). Splits data into smaller pieces.
 .TP
+.B \-\-overhead \fIformat\fR
+Split data into packets and charge each packet's protocol framing against
+the bandwidth or serial line time: \fBtcp\fR (52 bytes per 1500-byte
+packet), \fBssh\fR (88 bytes per 1500) or \fBmosh\fR (80 bytes per 500),
+or a number of bytes per 1500-byte packet. Write sizes still follow
+\fB\-\-chunk\fR.
+.TP
+.B \-\-mtu \fIbytes\fR
+Packet size for \fB\-\-overhead\fR and \fB\-\-trace\fR, headers included.
+TCP segments for \fB\-\-nagle\fR, delayed ACKs and \fB\-\-init\-cwnd\fR
+carry the packet less its overhead.
+.TP
+.B \-\-trace \fIfile\fR
+Replace the bandwidth limit in both directions with a Mahimahi packet
+delivery trace: one millisecond timestamp per line, each an opportunity to
+deliver one \fB\-\-mtu\fR of queued data. Unused opportunities are lost,
+and the trace repeats once it runs out. Cannot be combined with
+\fB\-\-up\fR, \fB\-\-down\fR, \fB\-\-serial\fR or
+\fB\-\-half\-duplex\fR.
+.TP
+.B \-\-up\-trace \fIfile\fR
+Delivery trace for the upstream only (overrides \fB\-\-trace\fR).
+.TP
+.B \-\-down\-trace \fIfile\fR
+Delivery trace for the downstream only (overrides \fB\-\-trace\fR).
+.TP
+.B \-\-vary \fIpattern\fR
+Vary the bandwidth in both directions over time, as a percentage or
+fraction of \fB\-\-up\fR and \fB\-\-down\fR:
+\fBwalk:\fIlow\fB:\fIhigh\fR[\fB:\fIevery\fR] for a random walk
+stepping every \fIevery\fR (default 1s),
+\fBsine:\fIlow\fB:\fIhigh\fB:\fIperiod\fR for a smooth swing,
+\fBsquare:\fIlow\fB:\fIhigh\fB:\fIperiod\fR for alternating halves, or
+\fBsteps:\fIscale\fB@\fIat\fR,... for step changes. Needs a bandwidth
+limit. Example: \fB\-\-vary walk:20%:100%\fR
+.TP
+.B \-\-up\-vary \fIpattern\fR
+Vary the upstream bandwidth only (overrides \fB\-\-vary\fR).
+.TP
+.B \-\-down\-vary \fIpattern\fR
+Vary the downstream bandwidth only (overrides \fB\-\-vary\fR).
+.TP
+.B \-\-cross \fItraffic\fR
+Add background traffic to both directions, sharing the bandwidth and
+queueing ahead of terminal data: a rate such as \fB2mbit\fR for constant
+traffic, \fBbulk\fR for a download that keeps the bottleneck buffer full,
+\fBonoff:\fIrate\fB:\fIon\fB:\fIoff\fR for bursts of mean length
+\fIon\fR separated by mean silences \fIoff\fR (\fIrate\fR may be
+\fBbulk\fR), or \fBtrace:\fIfile\fR to replay a file of
+\fItime bytes\fR lines on a loop. Needs a bandwidth limit.
+.TP
+.B \-\-up\-cross \fItraffic\fR
+Background traffic upstream only (overrides \fB\-\-cross\fR).
+.TP
+.B \-\-down\-cross \fItraffic\fR
+Background traffic downstream only (overrides \fB\-\-cross\fR).
+.TP
+.B \-\-cross\-buffer \fIduration\fR
+Bottleneck buffer for background traffic, as time at the bandwidth
+(default 200ms). Traffic beyond it is dropped, so it bounds the queueing
+delay added to terminal data.
+.TP
+.B \-\-ack\-load
+Charge the TCP ACKs for each direction's data, 52 bytes for every two
+full segments, against the other direction's bandwidth, so heavy output
+slows typing on an asymmetric link.
+.TP
+.B \-\-half\-duplex
+Make the link half-duplex: both directions share one token bucket, or one
+wire with \fB\-\-serial\fR, and only one sends at a time. \fB\-\-up\fR
+and \fB\-\-down\fR must match if both are given.
+.TP
+.B \-\-turnaround \fIduration\fR
+Time the line takes to change direction with \fB\-\-half\-duplex\fR
+(default 10ms).
+.TP
+.B \-\-hop \fIprofile\fR
+Add a profile's link after the one set by the other flags, so the path
+crosses several links, each with its own delay, jitter, bandwidth, loss
+and queue. Repeatable; upstream crosses the links in order and downstream
+in reverse. Example: \fB\-\-hop wifi\-poor \-\-hop intercontinental\fR
+.TP
+.B \-\-outage \fIoutages\fR
+Take the link down in both directions: \fIat\fB+\fIduration\fR for an
+outage \fIat\fR after startup, or \fBrandom:\fIevery\fB:\fIlength\fR
+for outages of mean length \fIlength\fR with a mean of \fIevery\fR
+between them. Separate several with commas. Data sent during an outage
+waits and goes on when the link is back. Example:
+\fB\-\-outage 30s+5s,random:10m:8s\fR
+.TP
+.B \-\-up\-outage \fIoutages\fR
+Outages upstream only (overrides \fB\-\-outage\fR).
+.TP
+.B \-\-down\-outage \fIoutages\fR
+Outages downstream only (overrides \fB\-\-outage\fR).
+.TP
+.B \-\-hangup\-after \fIduration\fR
+Drop the connection once data has waited this long in an outage, as ssh
+does when its keepalives go unanswered. Needs an outage flag.
+.TP
+.B \-\-idle\-timeout \fIduration\fR
+Drop the connection when data is sent after this long with no traffic in
+either direction, as a NAT that has forgotten the mapping resets it.
+.TP
+.B \-\-hangup\-message \fItext\fR
+Message printed when the connection drops (default "Connection closed.";
+empty for none). On a drop \fBttylag\fR sends SIGHUP to the child's
+process group, discards output still in flight and exits with status 255.
+.TP
 .B \-\-frame \fIduration\fR
 Coalesce output into periodic bursts. Example: \fB\-\-frame 40ms\fR
 .TP
+.B \-\-queue \fIsize\fR|\fIduration\fR
+Bound the data each direction holds in flight (default: unbounded). A size
+such as \fB64KB\fR limits bytes; a duration such as \fB200ms\fR allows that
+much queueing at the configured bandwidth on top of what the delay keeps in
+flight.
+.TP
+.B \-\-queue\-policy \fIpolicy\fR
+What to do when the queue is full: \fBblock\fR (default) stops reading, so
+the writer stalls as behind a full TCP window; \fBdrop\fR discards data that
+does not fit; \fBcodel\fR drops at the limit and also applies CoDel active
+queue management to data waiting for bandwidth.
+.TP
+.B \-\-spill \fIsize\fR
+Keep at most \fIsize\fR of delayed data in memory per direction and page the
+rest to a temporary file in \fB$TMPDIR\fR, read back in order as it comes
+due. Meant for the deep-space profiles. Example: \fB\-\-spill 16MB\fR
+.TP
 .BR \-s ", " \-\-serial " \fIbps\fR"
 Serial port speed in bits per second. Convenience flag that sets bandwidth
 limits based on baud rate. Example: \fB\-\-serial 9600\fR
@@ -79,6 +274,12 @@ Show help message.
 .TP
 .BR \-v ", " \-\-version
 Show version information.
+.TP
+.B \-\-stats
+On exit, print a table to stderr of what each direction did: bytes read,
+written and dropped, time spent waiting for bandwidth, frames flushed, and
+the 50th, 90th and 99th percentile and maximum latency from read to write.
+Percentiles are upper bounds from a power-of-two histogram.
 .SH BANDWIDTH FORMATS
 Bandwidth values use SI units (k=1000, not 1024):
 .TP
@@ -109,16 +310,16 @@ Preset connection profiles are available:
 .SS Mobile
 .TP
 .B edge
-2G/EDGE mobile (500ms RTT, 100ms jitter, 200kbit down, 100kbit up)
+2G/EDGE mobile (500ms RTT, 100ms lognormal jitter, 200kbit down, 100kbit up)
 .TP
 .B 3g
-3G mobile (200ms RTT, 50ms jitter, 1mbit down, 384kbit up)
+3G mobile (200ms RTT, 50ms lognormal jitter, 1mbit down, 384kbit up)
 .TP
 .B lte
 Good LTE (50ms RTT, 15ms jitter, 20mbit down, 5mbit up)
 .TP
 .B lte\-poor
-Poor LTE signal (150ms RTT, 50ms jitter, 2mbit down, 500kbit up)
+Poor LTE signal (150ms RTT, 50ms lognormal jitter, 2mbit down, 500kbit up)
 .SS Wired
 .TP
 .B dsl
@@ -136,10 +337,10 @@ Traditional geostationary VSAT (700ms RTT, 100ms jitter, 10mbit down, 2mbit up)
 .SS WiFi
 .TP
 .B wifi\-poor
-Poor WiFi (80ms RTT, 40ms jitter, 2mbit down, 1mbit up)
+Poor WiFi (80ms RTT, 40ms Pareto jitter, 2mbit down, 1mbit up)
 .TP
 .B wifi\-bad
-Very bad WiFi (200ms RTT, 100ms jitter, 500kbit down, 250kbit up)
+Very bad WiFi (200ms RTT, 100ms Pareto jitter with alpha 1.5, 500kbit down, 250kbit up)
 .SS Other
 .TP
 .B intercontinental
@@ -0,0 +1,66 @@
+// serial_accuracy measures how closely serial mode holds its configured
+// rate, in real time, across common baud rates.
+// Usage: go run ./cmd/serial_accuracy [-seconds 2]
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cbrunnkvist/ttylag/shape"
+)
+
+// Common serial speeds, 300 baud to 921600 baud
+var bauds = []int{300, 1200, 2400, 9600, 19200, 38400, 57600, 115200, 230400, 460800, 921600}
+
+// writeCounter counts writes and remembers when the last one happened.
+type writeCounter struct {
+	mu     sync.Mutex
+	writes int
+	bytes  int
+	last   time.Time
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes++
+	w.bytes += len(p)
+	w.last = time.Now()
+	return len(p), nil
+}
+
+func main() {
+	seconds := flag.Float64("seconds", 2, "Target transfer time per baud rate")
+	bitsPerByte := flag.Int("bits-per-byte", 10, "Bits per byte (10 for 8N1)")
+	flag.Parse()
+
+	fmt.Printf("%8s %8s %10s %10s %12s %8s %8s %10s\n",
+		"BAUD", "BYTES", "EXPECTED", "ELAPSED", "RATE (B/s)", "ERROR", "WRITES", "BYTES/WR")
+	for _, baud := range bauds {
+		rate := int64(baud / *bitsPerByte)
+		n := int(float64(rate) * *seconds)
+		expected := time.Duration(int64(n) * int64(time.Second) / rate)
+
+		dst := &writeCounter{}
+		start := time.Now()
+		err := shape.Copy(context.Background(), dst, bytes.NewReader(make([]byte, n)),
+			shape.ShaperConfig{Rate: rate, SerialMode: true})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%d baud: %v\n", baud, err)
+			os.Exit(1)
+		}
+		elapsed := dst.last.Sub(start)
+
+		achieved := float64(dst.bytes) / elapsed.Seconds()
+		errPct := (achieved - float64(rate)) / float64(rate) * 100
+		fmt.Printf("%8d %8d %10v %10v %12.1f %+7.2f%% %8d %10.1f\n",
+			baud, n, expected.Round(time.Millisecond), elapsed.Round(time.Millisecond),
+			achieved, errPct, dst.writes, float64(dst.bytes)/float64(dst.writes))
+	}
+}
@@ -1,6 +1,6 @@
 //go:build ignore
 
-// verify_shaper tests the Shaper directly without requiring a TTY.
+// verify_shaper tests the shape package directly without requiring a TTY.
 // This replicates the verification tests from a competing implementation.
 //
 // Usage: go run cmd/verify_shaper/main.go
@@ -13,67 +13,9 @@ import (
 	"io"
 	"time"
 
-	"golang.org/x/time/rate"
+	"github.com/cbrunnkvist/ttylag/shape"
 )
 
-// ShaperConfig matches the config in shaper.go
-type ShaperConfig struct {
-	Delay     time.Duration
-	Jitter    time.Duration
-	Rate      int64
-	ChunkSize int
-	FrameTime time.Duration
-	Seed      int64
-}
-
-// Minimal shaper for bandwidth testing only
-type testShaper struct {
-	limiter *rate.Limiter
-}
-
-func newTestShaper(bytesPerSec int64) *testShaper {
-	if bytesPerSec <= 0 {
-		return &testShaper{}
-	}
-	return &testShaper{
-		limiter: rate.NewLimiter(rate.Limit(bytesPerSec), int(bytesPerSec)),
-	}
-}
-
-func (s *testShaper) Copy(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
-	buf := make([]byte, 1024)
-	var total int64
-
-	for {
-		select {
-		case <-ctx.Done():
-			return total, ctx.Err()
-		default:
-		}
-
-		n, err := src.Read(buf)
-		if n > 0 {
-			// Rate limit
-			if s.limiter != nil {
-				if err := s.limiter.WaitN(ctx, n); err != nil {
-					return total, err
-				}
-			}
-			written, werr := dst.Write(buf[:n])
-			total += int64(written)
-			if werr != nil {
-				return total, werr
-			}
-		}
-		if err == io.EOF {
-			return total, nil
-		}
-		if err != nil {
-			return total, err
-		}
-	}
-}
-
 func main() {
 	fmt.Println("=== ttylag Shaper Verification Tests ===")
 	fmt.Println()
@@ -95,12 +37,14 @@ func testBandwidth() {
 	dst := io.Discard
 
 	// 10 kbit/s = 1250 bytes/sec
-	shaper := newTestShaper(1250)
+	cfg := shape.ShaperConfig{Rate: 1250}
+	counter := &countingWriter{w: dst}
 
 	ctx := context.Background()
 	start := time.Now()
-	n, err := shaper.Copy(ctx, dst, src)
+	err := shape.Copy(ctx, counter, src, cfg)
 	duration := time.Since(start)
+	n := counter.n
 
 	if err != nil {
 		fmt.Printf("   ERROR: %v\n", err)
@@ -121,6 +65,18 @@ func testBandwidth() {
 	}
 }
 
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
 func testJitterInfo() {
 	fmt.Println("2. Jitter Tests (require TTY - informational)")
 	fmt.Println()
@@ -10,13 +10,12 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/cbrunnkvist/ttylag/shape"
 	"github.com/creack/pty"
 	flag "github.com/spf13/pflag"
 	"golang.org/x/sys/unix"
@@ -36,6 +35,15 @@ const (
 	drainTimeout       = 30 * time.Second       // Max time to wait for downstream to drain
 	goroutineExitWait  = 500 * time.Millisecond // Max time to wait for goroutines to exit
 	defaultBitsPerByte = 10                     // 8N1 serial: 1 start + 8 data + 1 stop
+	sshChannelWindow   = 2 * 1024 * 1024        // OpenSSH's session channel window (CHAN_SES_WINDOW_DEFAULT)
+	defaultDelayedACK  = 40 * time.Millisecond  // Linux's minimum delayed-ACK timer, used with --nagle
+	defaultTurnaround  = 10 * time.Millisecond  // Line turnaround for --half-duplex
+)
+
+// Dropped connections
+const (
+	defaultHangupMessage = "Connection closed."
+	hangupExitCode       = 255 // What ssh exits with when the connection is lost
 )
 
 // Config holds all command-line configuration
@@ -46,9 +54,28 @@ type Config struct {
 	DownDelay time.Duration
 
 	// Jitter
-	Jitter     time.Duration
-	UpJitter   time.Duration
-	DownJitter time.Duration
+	Jitter      time.Duration
+	UpJitter    time.Duration
+	DownJitter  time.Duration
+	JitterDist  shape.JitterDistribution
+	JitterShape float64
+	JitterCorr  float64
+
+	// Packet loss, as TCP retransmission stalls
+	Loss      float64
+	UpLoss    float64
+	DownLoss  float64
+	LossBurst float64
+
+	// TCP window model
+	SlowStart     bool
+	InitialWindow int
+	ReceiveWindow int
+	Nagle         bool
+	DelayedACK    time.Duration
+
+	// Measured one-way latency, replacing delays and jitter (--latency-from)
+	Latency *shape.LatencyDistribution
 
 	// Bandwidth (bytes per second)
 	UpRate   int64
@@ -58,6 +85,52 @@ type Config struct {
 	ChunkSize int
 	FrameTime time.Duration
 
+	// Per-packet protocol overhead charged against bandwidth
+	PacketOverhead int
+	MTU            int
+
+	// Mahimahi delivery traces, replacing the bandwidth limit
+	Trace     *shape.DeliveryTrace
+	UpTrace   *shape.DeliveryTrace
+	DownTrace *shape.DeliveryTrace
+
+	// Bandwidth varying over time
+	Vary     *shape.RateVariation
+	UpVary   *shape.RateVariation
+	DownVary *shape.RateVariation
+
+	// Background traffic sharing the bandwidth
+	Cross       *shape.CrossTraffic
+	UpCross     *shape.CrossTraffic
+	DownCross   *shape.CrossTraffic
+	CrossBuffer time.Duration
+	ACKLoad     bool // Charge each direction's ACKs against the other's bandwidth
+
+	// Scheduled and random link outages
+	Outages     *shape.OutageSchedule
+	UpOutages   *shape.OutageSchedule
+	DownOutages *shape.OutageSchedule
+
+	// Rules for declaring the connection dead, and what to say when it is
+	HangupAfter   time.Duration // Data stuck in an outage this long
+	IdleTimeout   time.Duration // Data sent after this long idle both ways
+	HangupMessage string
+
+	// Further links after the one set by the flags (--hop)
+	Hops []shape.Profile
+
+	// Half-duplex link: both directions share one channel
+	HalfDuplex bool
+	Turnaround time.Duration
+
+	// Queue limit per direction (bytes or time at the configured rate)
+	QueueLimit  int
+	QueueTime   time.Duration
+	QueuePolicy shape.OverflowPolicy
+
+	// Delayed data kept in RAM per direction before spilling to disk
+	SpillAfter int
+
 	// Serial mode
 	Serial      int
 	BitsPerByte int
@@ -69,6 +142,7 @@ type Config struct {
 	Help         bool
 	Version      bool
 	ListProfiles bool
+	Stats        bool // Print per-direction statistics on exit
 
 	// Command to run
 	Command []string
@@ -132,17 +206,56 @@ func parseFlags() (*Config, error) {
 	jitter := fs.StringP("jitter", "j", "", "Jitter for both directions")
 	upJitter := fs.String("up-jitter", "", "Upstream jitter")
 	downJitter := fs.String("down-jitter", "", "Downstream jitter")
+	jitterDist := fs.String("jitter-dist", "", "Jitter distribution: uniform, normal, lognormal, pareto or exponential")
+	jitterShape := fs.Float64("jitter-shape", 0, "Shape for lognormal (sigma, default 1) or pareto (alpha, default 2) jitter")
+	jitterCorr := fs.Float64("jitter-correlation", 0, "Correlation of successive jitter samples, 0 to 1 (e.g., 0.9 for drifting delay)")
+	latencyFrom := fs.String("latency-from", "", "Sample delays from measured RTTs: ping or mtr output, a CSV or a histogram")
+	loss := fs.String("loss", "", "Packet loss for both directions, as TCP retransmission stalls (e.g., 1%)")
+	upLoss := fs.String("up-loss", "", "Upstream packet loss")
+	downLoss := fs.String("down-loss", "", "Downstream packet loss")
+	lossBurst := fs.Float64("loss-burst", 0, "Mean length of loss bursts in segments (above 1 for Gilbert-Elliott burst loss)")
+	fs.BoolVar(&cfg.SlowStart, "slow-start", false, "Model TCP slow start: grow the window from --init-cwnd every RTT, restart after idle")
+	initCwnd := fs.Int("init-cwnd", 0, "Initial congestion window in segments for --slow-start (default 10)")
+	rwnd := fs.String("rwnd", "", "Max data in flight per direction, e.g. 64KB, or ssh for OpenSSH's 2MB channel window")
+	fs.BoolVar(&cfg.Nagle, "nagle", false, "Model Nagle's algorithm: hold small writes until unacknowledged data is ACKed")
+	delayedACK := fs.String("delayed-ack", "", "Peer's delayed-ACK timer (default 40ms with --nagle; e.g., 200ms for Windows)")
 	upRate := fs.StringP("up", "u", "", "Upstream bandwidth limit (e.g., 56kbit)")
 	downRate := fs.StringP("down", "d", "", "Downstream bandwidth limit")
 	chunkSize := fs.IntP("chunk", "c", 0, "Max bytes per write (0=unlimited)")
+	overhead := fs.String("overhead", "", "Per-packet overhead charged against bandwidth: tcp, ssh, mosh or bytes")
+	mtu := fs.Int("mtu", 0, "Packet size for --overhead, --trace and TCP segments, headers included (default 1500, mosh 500)")
+	trace := fs.String("trace", "", "Mahimahi delivery trace for both directions, replacing the bandwidth limit")
+	upTrace := fs.String("up-trace", "", "Upstream delivery trace (e.g., an LTE uplink trace)")
+	downTrace := fs.String("down-trace", "", "Downstream delivery trace")
+	vary := fs.String("vary", "", "Vary the bandwidth in both directions: walk:LOW:HIGH[:EVERY], sine:LOW:HIGH:PERIOD, square:LOW:HIGH:PERIOD or steps:SCALE@AT,...")
+	upVary := fs.String("up-vary", "", "Vary the upstream bandwidth")
+	downVary := fs.String("down-vary", "", "Vary the downstream bandwidth")
+	cross := fs.String("cross", "", "Background traffic in both directions: a rate, bulk, onoff:RATE:ON:OFF or trace:FILE")
+	upCross := fs.String("up-cross", "", "Upstream background traffic")
+	downCross := fs.String("down-cross", "", "Downstream background traffic")
+	crossBuffer := fs.String("cross-buffer", "", "Bottleneck buffer for background traffic, in time at the rate (default 200ms)")
+	fs.BoolVar(&cfg.ACKLoad, "ack-load", false, "Charge the ACKs for each direction's data against the other direction's bandwidth")
+	fs.BoolVar(&cfg.HalfDuplex, "half-duplex", false, "Share one channel between the directions, as on a radio modem")
+	turnaround := fs.String("turnaround", "", "Time to change direction with --half-duplex (default 10ms)")
+	outage := fs.String("outage", "", "Link outages in both directions: AT+DURATION (e.g., 30s+5s) or random:EVERY:LENGTH, comma-separated")
+	upOutage := fs.String("up-outage", "", "Upstream-only link outages")
+	downOutage := fs.String("down-outage", "", "Downstream-only link outages")
+	hangupAfter := fs.String("hangup-after", "", "Drop the connection once data has waited this long in an outage, as ssh's keepalives give up")
+	idleTimeout := fs.String("idle-timeout", "", "Drop the connection when data is sent after this long idle both ways, as a NAT forgets the mapping")
+	fs.StringVar(&cfg.HangupMessage, "hangup-message", defaultHangupMessage, "Message printed when the connection drops")
 	frameTime := fs.String("frame", "", "Coalesce output interval (e.g., 40ms)")
+	queue := fs.String("queue", "", "Queue limit per direction, in bytes (64KB) or time at the rate (200ms)")
+	queuePolicy := fs.String("queue-policy", "block", "When the queue is full: block, drop or codel")
+	spill := fs.String("spill", "", "Spill delayed data beyond this size to a temp file (e.g., 16MB)")
 	serial := fs.IntP("serial", "s", 0, "Serial port speed in bps (e.g., 9600)")
 	bitsPerByte := fs.Int("bits-per-byte", defaultBitsPerByte, "Bits per byte for serial (default 10 for 8N1)")
 	seed := fs.Int64("seed", 0, "Random seed for jitter (0=random)")
 	profile := fs.StringP("profile", "p", "", "Connection profile (see below)")
+	hops := fs.StringArray("hop", nil, "Add a profile's link after the one set by the other flags (repeatable)")
 	fs.BoolVarP(&cfg.Help, "help", "h", false, "Show help")
 	fs.BoolVarP(&cfg.Version, "version", "v", false, "Show version")
 	fs.BoolVarP(&cfg.ListProfiles, "list-profiles", "L", false, "List available profiles")
+	fs.BoolVar(&cfg.Stats, "stats", false, "Print traffic and latency statistics on exit")
 
 	// Custom usage
 	fs.Usage = func() {
@@ -189,17 +302,29 @@ func parseFlags() (*Config, error) {
 
 	// Apply profile first (can be overridden by explicit flags)
 	if *profile != "" {
-		p, ok := profiles[*profile]
+		p, ok := shape.Profiles[*profile]
 		if !ok {
 			return nil, fmt.Errorf("unknown profile: %s", *profile)
 		}
 		cfg.RTT = p.RTT
 		cfg.Jitter = p.Jitter
+		cfg.JitterDist = p.JitterDist
+		cfg.JitterShape = p.JitterShape
+		cfg.Loss = p.Loss
+		cfg.LossBurst = p.LossBurst
 		cfg.UpRate = p.UpRate
 		cfg.DownRate = p.DownRate
 		cfg.SerialMode = p.SerialMode
 	}
 
+	for _, name := range *hops {
+		p, ok := shape.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown --hop profile: %s", name)
+		}
+		cfg.Hops = append(cfg.Hops, p)
+	}
+
 	// Parse duration flags
 	for _, d := range []struct {
 		value    string
@@ -213,28 +338,136 @@ func parseFlags() (*Config, error) {
 		{*upJitter, "up-jitter", &cfg.UpJitter},
 		{*downJitter, "down-jitter", &cfg.DownJitter},
 		{*frameTime, "frame", &cfg.FrameTime},
+		{*delayedACK, "delayed-ack", &cfg.DelayedACK},
 	} {
 		if err := parseDuration(d.value, d.flagName, d.dst); err != nil {
 			return nil, err
 		}
 	}
 
+	if *jitterDist != "" {
+		dist, err := shape.ParseJitterDistribution(*jitterDist)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --jitter-dist: %w", err)
+		}
+		// A profile's shape parameter belongs to its own distribution
+		if dist != cfg.JitterDist {
+			cfg.JitterShape = 0
+		}
+		cfg.JitterDist = dist
+	}
+	if fs.Changed("jitter-shape") {
+		if *jitterShape <= 0 || (cfg.JitterDist == shape.JitterPareto && *jitterShape <= 1) {
+			return nil, fmt.Errorf("invalid --jitter-shape: %v (must be above 0, or above 1 for pareto)", *jitterShape)
+		}
+		cfg.JitterShape = *jitterShape
+	}
+	if *jitterCorr < 0 || *jitterCorr >= 1 {
+		return nil, fmt.Errorf("invalid --jitter-correlation: %v (must be at least 0 and below 1)", *jitterCorr)
+	}
+	cfg.JitterCorr = *jitterCorr
+
+	if *latencyFrom != "" {
+		for _, name := range []string{"rtt", "up-delay", "down-delay", "jitter", "up-jitter", "down-jitter"} {
+			if fs.Changed(name) {
+				return nil, fmt.Errorf("--latency-from cannot be combined with --%s", name)
+			}
+		}
+		latency, err := loadLatency(*latencyFrom)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --latency-from: %w", err)
+		}
+		cfg.Latency = latency
+	}
+
+	// Parse loss flags
+	for _, l := range []struct {
+		value    string
+		flagName string
+		dst      *float64
+	}{
+		{*loss, "loss", &cfg.Loss},
+		{*upLoss, "up-loss", &cfg.UpLoss},
+		{*downLoss, "down-loss", &cfg.DownLoss},
+	} {
+		if l.value == "" {
+			continue
+		}
+		rate, err := shape.ParseLoss(l.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s: %w", l.flagName, err)
+		}
+		*l.dst = rate
+	}
+	if fs.Changed("loss-burst") {
+		if *lossBurst < 1 {
+			return nil, fmt.Errorf("invalid --loss-burst: %v (must be at least 1)", *lossBurst)
+		}
+		cfg.LossBurst = *lossBurst
+	}
+	for _, l := range []struct {
+		flagName string
+		rate     float64
+	}{
+		{"loss", cfg.Loss},
+		{"up-loss", cfg.UpLoss},
+		{"down-loss", cfg.DownLoss},
+	} {
+		if err := shape.CheckLossBurst(l.rate, cfg.LossBurst); err != nil {
+			return nil, fmt.Errorf("invalid --%s with --loss-burst %v: %w", l.flagName, cfg.LossBurst, err)
+		}
+	}
+
 	// Parse bandwidth flags
 	if *upRate != "" {
-		rate, err := parseBandwidth(*upRate)
+		rate, err := shape.ParseBandwidth(*upRate)
 		if err != nil {
 			return nil, fmt.Errorf("invalid --up: %w", err)
 		}
 		cfg.UpRate = rate
 	}
 	if *downRate != "" {
-		rate, err := parseBandwidth(*downRate)
+		rate, err := shape.ParseBandwidth(*downRate)
 		if err != nil {
 			return nil, fmt.Errorf("invalid --down: %w", err)
 		}
 		cfg.DownRate = rate
 	}
 
+	// Parse queue limit: a duration is queueing time, anything else a size
+	if *queue != "" {
+		if d, err := time.ParseDuration(*queue); err == nil {
+			cfg.QueueTime = d
+		} else if n, err := shape.ParseSize(*queue); err == nil {
+			cfg.QueueLimit = n
+		} else {
+			return nil, fmt.Errorf("invalid --queue: %s is neither a size nor a duration", *queue)
+		}
+	}
+	policy, err := shape.ParseOverflowPolicy(*queuePolicy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --queue-policy: %w", err)
+	}
+	cfg.QueuePolicy = policy
+
+	if cfg.SpillAfter, err = shape.ParseSize(*spill); err != nil {
+		return nil, fmt.Errorf("invalid --spill: %w", err)
+	}
+
+	// Parse window flags
+	if *initCwnd < 0 {
+		return nil, fmt.Errorf("invalid --init-cwnd: %d", *initCwnd)
+	}
+	cfg.InitialWindow = *initCwnd
+	if *rwnd == "ssh" {
+		cfg.ReceiveWindow = sshChannelWindow
+	} else if cfg.ReceiveWindow, err = shape.ParseSize(*rwnd); err != nil {
+		return nil, fmt.Errorf("invalid --rwnd: %w", err)
+	}
+	if cfg.Nagle && *delayedACK == "" {
+		cfg.DelayedACK = defaultDelayedACK
+	}
+
 	// Handle serial mode
 	cfg.Serial = *serial
 	cfg.BitsPerByte = *bitsPerByte
@@ -251,6 +484,144 @@ func parseFlags() (*Config, error) {
 		cfg.SerialMode = true
 	}
 
+	// Parse packet flags
+	if *overhead != "" {
+		format, err := shape.ParsePacketFormat(*overhead)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --overhead: %w", err)
+		}
+		cfg.PacketOverhead, cfg.MTU = format.Overhead, format.MTU
+	}
+	if fs.Changed("mtu") {
+		if cfg.PacketOverhead == 0 && *trace == "" && *upTrace == "" && *downTrace == "" && !cfg.Nagle && !cfg.SlowStart {
+			return nil, fmt.Errorf("--mtu needs --overhead, a trace, --nagle or --slow-start")
+		}
+		if *mtu <= cfg.PacketOverhead {
+			return nil, fmt.Errorf("invalid --mtu: %d (must be larger than the %d-byte overhead)", *mtu, cfg.PacketOverhead)
+		}
+		cfg.MTU = *mtu
+	}
+
+	// Parse trace flags
+	for _, tr := range []struct {
+		value    string
+		flagName string
+		dst      **shape.DeliveryTrace
+	}{
+		{*trace, "trace", &cfg.Trace},
+		{*upTrace, "up-trace", &cfg.UpTrace},
+		{*downTrace, "down-trace", &cfg.DownTrace},
+	} {
+		if tr.value == "" {
+			continue
+		}
+		dt, err := loadTrace(tr.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s: %w", tr.flagName, err)
+		}
+		*tr.dst = dt
+	}
+
+	// Parse rate variation flags
+	for _, v := range []struct {
+		value    string
+		flagName string
+		dst      **shape.RateVariation
+	}{
+		{*vary, "vary", &cfg.Vary},
+		{*upVary, "up-vary", &cfg.UpVary},
+		{*downVary, "down-vary", &cfg.DownVary},
+	} {
+		if v.value == "" {
+			continue
+		}
+		variation, err := shape.ParseRateVariation(v.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s: %w", v.flagName, err)
+		}
+		*v.dst = variation
+	}
+
+	// Parse cross traffic flags
+	for _, c := range []struct {
+		value    string
+		flagName string
+		dst      **shape.CrossTraffic
+	}{
+		{*cross, "cross", &cfg.Cross},
+		{*upCross, "up-cross", &cfg.UpCross},
+		{*downCross, "down-cross", &cfg.DownCross},
+	} {
+		if c.value == "" {
+			continue
+		}
+		traffic, err := loadCross(c.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s: %w", c.flagName, err)
+		}
+		*c.dst = traffic
+	}
+	if *crossBuffer != "" {
+		d, err := time.ParseDuration(*crossBuffer)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid --cross-buffer: %s", *crossBuffer)
+		}
+		cfg.CrossBuffer = d
+	}
+
+	// Parse outage flags
+	for _, o := range []struct {
+		value    string
+		flagName string
+		dst      **shape.OutageSchedule
+	}{
+		{*outage, "outage", &cfg.Outages},
+		{*upOutage, "up-outage", &cfg.UpOutages},
+		{*downOutage, "down-outage", &cfg.DownOutages},
+	} {
+		if o.value == "" {
+			continue
+		}
+		sched, err := shape.ParseOutages(o.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s: %w", o.flagName, err)
+		}
+		*o.dst = sched
+	}
+
+	// Parse hangup flags
+	for _, h := range []struct {
+		value    string
+		flagName string
+		dst      *time.Duration
+	}{
+		{*hangupAfter, "hangup-after", &cfg.HangupAfter},
+		{*idleTimeout, "idle-timeout", &cfg.IdleTimeout},
+	} {
+		if h.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(h.value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid --%s: %s", h.flagName, h.value)
+		}
+		*h.dst = d
+	}
+
+	// Parse half-duplex flags
+	if *turnaround != "" {
+		if !cfg.HalfDuplex {
+			return nil, fmt.Errorf("--turnaround needs --half-duplex")
+		}
+		d, err := time.ParseDuration(*turnaround)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid --turnaround: %s", *turnaround)
+		}
+		cfg.Turnaround = d
+	} else if cfg.HalfDuplex {
+		cfg.Turnaround = defaultTurnaround
+	}
+
 	// Other values
 	cfg.ChunkSize = *chunkSize
 	cfg.Seed = *seed
@@ -276,9 +647,172 @@ func parseFlags() (*Config, error) {
 		}
 	}
 
+	// Apply global loss if per-direction loss not set
+	if cfg.Loss > 0 {
+		if cfg.UpLoss == 0 {
+			cfg.UpLoss = cfg.Loss
+		}
+		if cfg.DownLoss == 0 {
+			cfg.DownLoss = cfg.Loss
+		}
+	}
+
+	// Apply the global trace if per-direction traces not set. A trace
+	// replaces the direction's bandwidth limit, a profile's included.
+	if cfg.Trace != nil {
+		if cfg.UpTrace == nil {
+			cfg.UpTrace = cfg.Trace
+		}
+		if cfg.DownTrace == nil {
+			cfg.DownTrace = cfg.Trace
+		}
+	}
+	for _, tr := range []struct {
+		trace    *shape.DeliveryTrace
+		rateFlag string
+		rate     *int64
+	}{
+		{cfg.UpTrace, "up", &cfg.UpRate},
+		{cfg.DownTrace, "down", &cfg.DownRate},
+	} {
+		switch {
+		case tr.trace == nil:
+			continue
+		case fs.Changed(tr.rateFlag) || cfg.Serial > 0:
+			return nil, fmt.Errorf("a trace cannot be combined with --%s or --serial", tr.rateFlag)
+		case cfg.HalfDuplex:
+			return nil, fmt.Errorf("a trace cannot be combined with --half-duplex")
+		}
+		*tr.rate = 0
+	}
+
+	// A half-duplex channel has one bandwidth; one direction's applies to
+	// both
+	if cfg.HalfDuplex {
+		switch {
+		case cfg.UpRate == 0 && cfg.DownRate == 0:
+			return nil, fmt.Errorf("--half-duplex needs a bandwidth limit (--up, --down or --serial)")
+		case cfg.UpRate == 0:
+			cfg.UpRate = cfg.DownRate
+		case cfg.DownRate == 0:
+			cfg.DownRate = cfg.UpRate
+		case cfg.UpRate != cfg.DownRate:
+			return nil, fmt.Errorf("--half-duplex needs the same bandwidth both ways")
+		}
+	}
+
+	// Apply global rate variation if per-direction variation not set; it
+	// needs a limited link to vary
+	switch {
+	case cfg.Vary != nil && cfg.UpRate == 0 && cfg.DownRate == 0:
+		return nil, fmt.Errorf("--vary needs a bandwidth limit (--up, --down or --serial)")
+	case cfg.UpVary != nil && cfg.UpRate == 0:
+		return nil, fmt.Errorf("--up-vary needs --up or --serial")
+	case cfg.DownVary != nil && cfg.DownRate == 0:
+		return nil, fmt.Errorf("--down-vary needs --down or --serial")
+	}
+	if cfg.Vary != nil {
+		if cfg.UpVary == nil {
+			cfg.UpVary = cfg.Vary
+		}
+		if cfg.DownVary == nil {
+			cfg.DownVary = cfg.Vary
+		}
+	}
+
+	// Apply global cross traffic if per-direction traffic not set; it
+	// needs a limited link to share
+	switch {
+	case cfg.Cross != nil && cfg.UpRate == 0 && cfg.DownRate == 0:
+		return nil, fmt.Errorf("--cross needs a bandwidth limit (--up, --down or --serial)")
+	case cfg.UpCross != nil && cfg.UpRate == 0:
+		return nil, fmt.Errorf("--up-cross needs --up or --serial")
+	case cfg.DownCross != nil && cfg.DownRate == 0:
+		return nil, fmt.Errorf("--down-cross needs --down or --serial")
+	}
+	if cfg.Cross != nil {
+		if cfg.UpCross == nil {
+			cfg.UpCross = cfg.Cross
+		}
+		if cfg.DownCross == nil {
+			cfg.DownCross = cfg.Cross
+		}
+	}
+	for _, c := range []*shape.CrossTraffic{cfg.UpCross, cfg.DownCross} {
+		if c != nil {
+			c.Buffer = cfg.CrossBuffer
+		}
+	}
+
+	// Apply global outages if per-direction ones not set. Random outages
+	// on the shared schedule take both directions down together.
+	if cfg.Outages != nil {
+		if cfg.UpOutages == nil {
+			cfg.UpOutages = cfg.Outages
+		}
+		if cfg.DownOutages == nil {
+			cfg.DownOutages = cfg.Outages
+		}
+	}
+	if cfg.HangupAfter > 0 && cfg.UpOutages == nil && cfg.DownOutages == nil {
+		return nil, fmt.Errorf("--hangup-after needs --outage, --up-outage or --down-outage")
+	}
+	outageSeed := cfg.Seed
+	if outageSeed == 0 {
+		outageSeed = time.Now().UnixNano()
+	}
+	for i, o := range []*shape.OutageSchedule{cfg.UpOutages, cfg.DownOutages} {
+		if o != nil && o.Seed == 0 {
+			o.Seed = outageSeed + int64(i)
+		}
+	}
+
 	return cfg, nil
 }
 
+// loadCross parses a cross traffic flag, reading the trace for trace:FILE.
+func loadCross(value string) (*shape.CrossTraffic, error) {
+	path, ok := strings.CutPrefix(value, "trace:")
+	if !ok {
+		return shape.ParseCrossTraffic(value)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return shape.ReadCrossTrace(f)
+}
+
+// loadTrace reads the Mahimahi delivery trace in path.
+func loadTrace(path string) (*shape.DeliveryTrace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	trace, err := shape.ReadDeliveryTrace(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return trace, nil
+}
+
+// loadLatency reads the round-trip times in path and returns them as
+// one-way delays, split evenly between the directions like --rtt.
+func loadLatency(path string) (*shape.LatencyDistribution, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rtt, err := shape.ReadLatencyDistribution(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rtt.Scale(0.5), nil
+}
+
 // parseDuration parses a duration flag value into dst if non-empty.
 // Returns an error with the flag name if parsing fails.
 func parseDuration(s string, flagName string, dst *time.Duration) error {
@@ -293,59 +827,6 @@ func parseDuration(s string, flagName string, dst *time.Duration) error {
 	return nil
 }
 
-// parseBandwidth parses bandwidth strings like "56kbit", "1mbit", "100KB"
-// Returns bytes per second. Uses SI units (k=1000).
-func parseBandwidth(s string) (int64, error) {
-	s = strings.TrimSpace(strings.ToLower(s))
-	if s == "" {
-		return 0, nil
-	}
-
-	// Regex to parse: number + optional unit
-	re := regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([a-z/]*)$`)
-	matches := re.FindStringSubmatch(s)
-	if matches == nil {
-		return 0, fmt.Errorf("invalid bandwidth format: %s", s)
-	}
-
-	value, err := strconv.ParseFloat(matches[1], 64)
-	if err != nil {
-		return 0, err
-	}
-
-	unit := matches[2]
-	var multiplier float64 = 1
-	isBytes := false
-
-	switch unit {
-	case "", "bps", "bit", "bits":
-		multiplier = 1
-	case "k", "kbit", "kbps":
-		multiplier = 1000
-	case "m", "mbit", "mbps":
-		multiplier = 1000000
-	case "g", "gbit", "gbps":
-		multiplier = 1000000000
-	case "b", "bps/s", "byte", "bytes":
-		multiplier = 1
-		isBytes = true
-	case "kb", "kb/s", "kbps/s":
-		multiplier = 1000
-		isBytes = true
-	case "mb", "mb/s", "mbps/s":
-		multiplier = 1000000
-		isBytes = true
-	default:
-		return 0, fmt.Errorf("unknown bandwidth unit: %s", unit)
-	}
-
-	bits := value * multiplier
-	if isBytes {
-		return int64(bits), nil // Already in bytes
-	}
-	return int64(bits / 8), nil // Convert bits to bytes
-}
-
 // getTerminalSize returns the terminal dimensions, or defaults if unavailable.
 func getTerminalSize() (width, height int) {
 	if term.IsTerminal(int(os.Stdin.Fd())) {
@@ -359,8 +840,14 @@ func getTerminalSize() (width, height int) {
 }
 
 // makeShaperConfigs creates upstream and downstream shaper configurations from CLI config.
-func makeShaperConfigs(cfg *Config) (up, down ShaperConfig) {
-	up = ShaperConfig{
+func makeShaperConfigs(cfg *Config) (up, down shape.ShaperConfig) {
+	// Loss recovery takes a round trip; with --latency-from the shapers
+	// use twice its mean
+	rtt := cfg.UpDelay + cfg.DownDelay
+	if cfg.Latency != nil {
+		rtt = 0
+	}
+	up = shape.ShaperConfig{
 		Delay:      cfg.UpDelay,
 		Jitter:     cfg.UpJitter,
 		Rate:       cfg.UpRate,
@@ -368,8 +855,35 @@ func makeShaperConfigs(cfg *Config) (up, down ShaperConfig) {
 		FrameTime:  cfg.FrameTime,
 		Seed:       cfg.Seed,
 		SerialMode: cfg.SerialMode,
+
+		PacketOverhead: cfg.PacketOverhead,
+		MTU:            cfg.MTU,
+		DeliveryTrace:  cfg.UpTrace,
+		RateVariation:  cfg.UpVary,
+		Cross:          cfg.UpCross,
+		Outages:        cfg.UpOutages,
+
+		JitterDist:        cfg.JitterDist,
+		JitterShape:       cfg.JitterShape,
+		JitterCorrelation: cfg.JitterCorr,
+		Latency:           cfg.Latency,
+
+		Loss:      cfg.UpLoss,
+		LossBurst: cfg.LossBurst,
+		RTT:       rtt,
+
+		SlowStart:     cfg.SlowStart,
+		InitialWindow: cfg.InitialWindow,
+		ReceiveWindow: cfg.ReceiveWindow,
+		Nagle:         cfg.Nagle,
+		DelayedACK:    cfg.DelayedACK,
+
+		QueueLimit:  cfg.QueueLimit,
+		QueueTime:   cfg.QueueTime,
+		QueuePolicy: cfg.QueuePolicy,
+		DelayMemory: cfg.SpillAfter,
 	}
-	down = ShaperConfig{
+	down = shape.ShaperConfig{
 		Delay:      cfg.DownDelay,
 		Jitter:     cfg.DownJitter,
 		Rate:       cfg.DownRate,
@@ -377,10 +891,120 @@ func makeShaperConfigs(cfg *Config) (up, down ShaperConfig) {
 		FrameTime:  cfg.FrameTime,
 		Seed:       cfg.Seed + 1, // Different seed for each direction
 		SerialMode: cfg.SerialMode,
+
+		PacketOverhead: cfg.PacketOverhead,
+		MTU:            cfg.MTU,
+		DeliveryTrace:  cfg.DownTrace,
+		RateVariation:  cfg.DownVary,
+		Cross:          cfg.DownCross,
+		Outages:        cfg.DownOutages,
+
+		JitterDist:        cfg.JitterDist,
+		JitterShape:       cfg.JitterShape,
+		JitterCorrelation: cfg.JitterCorr,
+		Latency:           cfg.Latency,
+
+		Loss:      cfg.DownLoss,
+		LossBurst: cfg.LossBurst,
+		RTT:       rtt,
+
+		SlowStart:     cfg.SlowStart,
+		InitialWindow: cfg.InitialWindow,
+		ReceiveWindow: cfg.ReceiveWindow,
+		Nagle:         cfg.Nagle,
+		DelayedACK:    cfg.DelayedACK,
+
+		QueueLimit:  cfg.QueueLimit,
+		QueueTime:   cfg.QueueTime,
+		QueuePolicy: cfg.QueuePolicy,
+		DelayMemory: cfg.SpillAfter,
+	}
+
+	if cfg.HalfDuplex {
+		medium := shape.NewMedium(cfg.Turnaround)
+		up.Medium, down.Medium = medium, medium
+	}
+
+	if cfg.HangupAfter > 0 || cfg.IdleTimeout > 0 {
+		hangup := shape.NewHangup(cfg.HangupAfter, cfg.IdleTimeout)
+		up.Hangup, down.Hangup = hangup, hangup
+	}
+
+	// Each direction's ACKs travel on the other
+	if cfg.ACKLoad {
+		upACKs, downACKs := shape.NewACKPath(), shape.NewACKPath()
+		up.SendACKs, down.CarryACKs = upACKs, upACKs
+		down.SendACKs, up.CarryACKs = downACKs, downACKs
 	}
 	return up, down
 }
 
+// makeShaperPaths returns the links data crosses in each direction: the
+// one set by the flags, as the user's own, then each --hop in turn
+// upstream, and the same in reverse downstream. Each hop keeps its
+// profile's delay, jitter, bandwidth and loss, and gets the queue, spill
+// and packet settings of its own; the TCP sender's window and Nagle go on
+// the first link of each path and its receiver's ACKs leave from the last.
+func makeShaperPaths(cfg *Config) (up, down []shape.ShaperConfig) {
+	first, last := makeShaperConfigs(cfg)
+	up, down = []shape.ShaperConfig{first}, []shape.ShaperConfig{last}
+	if len(cfg.Hops) == 0 {
+		return up, down
+	}
+
+	// Loss recovery and the window model see the whole path's round trip
+	rtt := linkRTT(first, last)
+	for _, p := range cfg.Hops {
+		rtt += linkRTT(p.Up(), p.Down())
+	}
+	up[0].RTT, down[0].RTT = rtt, rtt
+	for i, p := range cfg.Hops {
+		u, d := p.Up(), p.Down()
+		for j, c := range []*shape.ShaperConfig{&u, &d} {
+			c.RTT = rtt
+			if cfg.Seed != 0 {
+				c.Seed = cfg.Seed + int64(2*(i+1)+j)
+			}
+			c.PacketOverhead, c.MTU = cfg.PacketOverhead, cfg.MTU
+			c.QueueLimit, c.QueueTime, c.QueuePolicy = cfg.QueueLimit, cfg.QueueTime, cfg.QueuePolicy
+			c.DelayMemory = cfg.SpillAfter
+		}
+		up = append(up, u)
+		down = append([]shape.ShaperConfig{d}, down...)
+	}
+
+	// Downstream, the sender is at the far end of the path
+	sender, receiver := &down[0], &down[len(down)-1]
+	sender.SlowStart, receiver.SlowStart = receiver.SlowStart, false
+	sender.InitialWindow, receiver.InitialWindow = receiver.InitialWindow, 0
+	sender.ReceiveWindow, receiver.ReceiveWindow = receiver.ReceiveWindow, 0
+	sender.Nagle, receiver.Nagle = receiver.Nagle, false
+	sender.DelayedACK, receiver.DelayedACK = receiver.DelayedACK, 0
+
+	// Upstream, the receiver is
+	up[len(up)-1].SendACKs, up[0].SendACKs = up[0].SendACKs, nil
+	return up, down
+}
+
+// linkRTT returns the round trip across one link with shapers up and down:
+// its RTT, or else the sum of the two one-way delays, as the shapers
+// themselves assume without one.
+func linkRTT(up, down shape.ShaperConfig) time.Duration {
+	if up.RTT > 0 {
+		return up.RTT
+	}
+	return oneWayDelay(up) + oneWayDelay(down)
+}
+
+// oneWayDelay returns a shaper's base delay: Delay, or the mean of its
+// measured Latency.
+func oneWayDelay(c shape.ShaperConfig) time.Duration {
+	if c.Latency != nil {
+		return c.Latency.Mean()
+	}
+	return c.Delay
+}
+
 // waitWithTimeout waits for a WaitGroup with a timeout.
 // Returns true if all goroutines finished, false if timeout.
 func waitWithTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
@@ -461,25 +1085,36 @@ func run(cfg *Config) int {
 	// WaitGroup for goroutines
 	var wg sync.WaitGroup
 
-	// Shaper configs
-	upConfig, downConfig := makeShaperConfigs(cfg)
+	// Shapers, one per link in each direction
+	upConfigs, downConfigs := makeShaperPaths(cfg)
+	upPath := shape.NewChain(upConfigs...)
+	downPath := shape.NewChain(downConfigs...)
 
-	// Upstream: stdin -> shaper -> PTY
+	// Either direction can find the connection dead
+	hangupCh := make(chan struct{}, 1)
+	hungUp := func(err error) {
+		if errors.Is(err, shape.ErrHangup) {
+			select {
+			case hangupCh <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	// Upstream: stdin -> shapers -> PTY
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		upShaper := NewShaper(upConfig)
-		upShaper.Run(upCtx, os.Stdin, ptmx)
+		hungUp(upPath.Run(upCtx, os.Stdin, ptmx))
 	}()
 
-	// Downstream: PTY -> shaper -> stdout
+	// Downstream: PTY -> shapers -> stdout
 	downDone := make(chan struct{})
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		defer close(downDone)
-		downShaper := NewShaper(downConfig)
-		downShaper.Run(downCtx, ptmx, os.Stdout)
+		hungUp(downPath.Run(downCtx, ptmx, os.Stdout))
 	}()
 
 	// Signal handler goroutine
@@ -511,8 +1146,22 @@ func run(cfg *Config) int {
 		}
 	}()
 
-	// Wait for child process
-	waitErr := cmd.Wait()
+	// Wait for child process, or for the connection to drop. A dropped
+	// connection hangs up on the child, as sshd or the tty driver does on
+	// losing its peer, and discards the output still on its way.
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- cmd.Wait()
+	}()
+	var waitErr error
+	dropped := false
+	select {
+	case waitErr = <-waitCh:
+	case <-hangupCh:
+		dropped = true
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGHUP)
+		downCancel()
+	}
 
 	// Cancel upstream context to stop upstream shaper (which may be blocked on stdin)
 	upCancel()
@@ -536,7 +1185,17 @@ func run(cfg *Config) int {
 	// Restore terminal before exiting
 	restoreTerminal()
 
+	if dropped && cfg.HangupMessage != "" {
+		fmt.Fprintln(os.Stderr, cfg.HangupMessage)
+	}
+	if cfg.Stats {
+		printStats(os.Stderr, upPath.Stats(), downPath.Stats())
+	}
+
 	// Determine exit code
+	if dropped {
+		return hangupExitCode
+	}
 	if waitErr != nil {
 		var exitErr *exec.ExitError
 		if errors.As(waitErr, &exitErr) {
@@ -7,6 +7,9 @@ import (
 	"bytes"
 	"os/exec"
 	"testing"
+	"time"
+
+	"github.com/cbrunnkvist/ttylag/shape"
 )
 
 func TestPipedOutputNoCRLF(t *testing.T) {
@@ -32,3 +35,30 @@ func TestPipedOutputNoCRLF(t *testing.T) {
 		t.Errorf("output missing LF; got: %q", output)
 	}
 }
+
+// TestHopRTTWithoutRTT checks that with --hop every link sees the whole
+// path's round trip even when the first link has no --rtt, from its
+// delays or from --latency-from.
+func TestHopRTTWithoutRTT(t *testing.T) {
+	hop := shape.Profiles["satellite"]
+	latency, err := shape.NewLatencyDistribution([]time.Duration{40 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		cfg  Config
+		want time.Duration
+	}{
+		{"delays", Config{UpDelay: 30 * time.Millisecond, DownDelay: 70 * time.Millisecond}, 100*time.Millisecond + hop.RTT},
+		{"latency-from", Config{Latency: latency}, 80*time.Millisecond + hop.RTT},
+	} {
+		tt.cfg.Hops = []shape.Profile{hop}
+		up, down := makeShaperPaths(&tt.cfg)
+		for i, c := range append(up, down...) {
+			if c.RTT != tt.want {
+				t.Errorf("%s: link %d has RTT %v, want %v", tt.name, i, c.RTT, tt.want)
+			}
+		}
+	}
+}
@@ -7,126 +7,9 @@ import (
 	"fmt"
 	"sort"
 	"time"
-)
-
-// profiles defines preset configurations for common connection types.
-var profiles = map[string]Config{
-	// Serial connections (use wire serialization for authentic feel)
-	"9600": {
-		UpRate:     960, // 9600 baud / 10 bits per byte
-		DownRate:   960,
-		SerialMode: true,
-	},
-	"2400": {
-		UpRate:     240, // 2400 baud / 10 bits per byte
-		DownRate:   240,
-		SerialMode: true,
-	},
-
-	// Dial-up modems
-	"dialup": {
-		RTT:      150 * time.Millisecond,
-		Jitter:   30 * time.Millisecond,
-		DownRate: 56000 / 8, // 56kbit -> bytes
-		UpRate:   33600 / 8, // 33.6kbit -> bytes
-	},
-
-	// Mobile networks
-	"edge": {
-		RTT:      500 * time.Millisecond,
-		Jitter:   100 * time.Millisecond,
-		DownRate: 200000 / 8, // 200kbit
-		UpRate:   100000 / 8, // 100kbit
-	},
-	"3g": {
-		RTT:      200 * time.Millisecond,
-		Jitter:   50 * time.Millisecond,
-		DownRate: 1000000 / 8, // 1mbit
-		UpRate:   384000 / 8,  // 384kbit
-	},
-	"lte": {
-		RTT:      50 * time.Millisecond,
-		Jitter:   15 * time.Millisecond,
-		DownRate: 20000000 / 8, // 20mbit
-		UpRate:   5000000 / 8,  // 5mbit
-	},
-	"lte-poor": {
-		RTT:      150 * time.Millisecond,
-		Jitter:   50 * time.Millisecond,
-		DownRate: 2000000 / 8, // 2mbit
-		UpRate:   500000 / 8,  // 500kbit
-	},
-
-	// Wired connections
-	"dsl": {
-		RTT:      50 * time.Millisecond,
-		Jitter:   10 * time.Millisecond,
-		DownRate: 8000000 / 8, // 8mbit
-		UpRate:   1000000 / 8, // 1mbit
-	},
-	"cable": {
-		RTT:      30 * time.Millisecond,
-		Jitter:   5 * time.Millisecond,
-		DownRate: 50000000 / 8, // 50mbit
-		UpRate:   5000000 / 8,  // 5mbit
-	},
-
-	// Satellite
-	"satellite": {
-		RTT:      600 * time.Millisecond, // Geostationary orbit
-		Jitter:   50 * time.Millisecond,
-		DownRate: 25000000 / 8, // 25mbit (Starlink-ish)
-		UpRate:   5000000 / 8,  // 5mbit
-	},
-	"satellite-geo": {
-		RTT:      700 * time.Millisecond, // High geostationary latency
-		Jitter:   100 * time.Millisecond,
-		DownRate: 10000000 / 8, // 10mbit (traditional VSAT)
-		UpRate:   2000000 / 8,  // 2mbit
-	},
-
-	// WiFi scenarios
-	"wifi-poor": {
-		RTT:      80 * time.Millisecond,
-		Jitter:   40 * time.Millisecond,
-		DownRate: 2000000 / 8, // 2mbit
-		UpRate:   1000000 / 8, // 1mbit
-	},
-	"wifi-bad": {
-		RTT:      200 * time.Millisecond,
-		Jitter:   100 * time.Millisecond,
-		DownRate: 500000 / 8, // 500kbit
-		UpRate:   250000 / 8, // 250kbit
-	},
-
-	// International/long-distance
-	"intercontinental": {
-		RTT:      250 * time.Millisecond, // e.g., US to Asia
-		Jitter:   30 * time.Millisecond,
-		DownRate: 10000000 / 8, // 10mbit (typical VPN)
-		UpRate:   5000000 / 8,  // 5mbit
-	},
 
-	// Deep space
-	"lunar": {
-		RTT:      2560 * time.Millisecond, // Earth-Moon ~1.28s one-way (384,400km / c)
-		Jitter:   50 * time.Millisecond,   // Space links are stable once locked
-		DownRate: 128000 / 8,              // 128kbit S-band downlink
-		UpRate:   16000 / 8,               // 16kbit uplink (commands)
-	},
-	"mars-close": {
-		RTT:      6 * time.Minute, // Mars at closest approach (~54.6M km)
-		Jitter:   time.Second,     // DSN tracking variations
-		DownRate: 2000000 / 8,     // 2mbit DSN downlink
-		UpRate:   16000 / 8,       // 16kbit uplink
-	},
-	"mars-far": {
-		RTT:      44 * time.Minute, // Mars at opposition (~401M km)
-		Jitter:   2 * time.Second,  // Longer path = more variation
-		DownRate: 500000 / 8,       // 500kbit (signal degrades with distance)
-		UpRate:   8000 / 8,         // 8kbit uplink
-	},
-}
+	"github.com/cbrunnkvist/ttylag/shape"
+)
 
 // formatRate formats a bytes-per-second rate as a human-readable string.
 func formatRate(bytesPerSec int64) string {
@@ -152,11 +35,23 @@ func formatDuration(d time.Duration) string {
 	return d.String()
 }
 
+// formatLoss formats a loss rate as a percentage, with the mean burst
+// length for burst loss, or "-" if zero.
+func formatLoss(loss, burst float64) string {
+	switch {
+	case loss == 0:
+		return "-"
+	case burst > 1:
+		return fmt.Sprintf("%g%% (%g)", loss*100, burst)
+	}
+	return fmt.Sprintf("%g%%", loss*100)
+}
+
 // printProfiles prints a table of all available profiles.
 func printProfiles() {
 	// Get sorted profile names
-	names := make([]string, 0, len(profiles))
-	for name := range profiles {
+	names := make([]string, 0, len(shape.Profiles))
+	for name := range shape.Profiles {
 		names = append(names, name)
 	}
 	sort.Strings(names)
@@ -164,24 +59,33 @@ func printProfiles() {
 	// Print header
 	fmt.Println("Available profiles:")
 	fmt.Println()
-	fmt.Printf("%-16s  %8s  %8s  %10s  %10s  %s\n",
-		"NAME", "RTT", "JITTER", "DOWN", "UP", "MODE")
-	fmt.Printf("%-16s  %8s  %8s  %10s  %10s  %s\n",
-		"----", "---", "------", "----", "--", "----")
+	fmt.Printf("%-16s  %8s  %8s  %-11s  %10s  %10s  %-9s  %s\n",
+		"NAME", "RTT", "JITTER", "DIST", "DOWN", "UP", "LOSS", "MODE")
+	fmt.Printf("%-16s  %8s  %8s  %-11s  %10s  %10s  %-9s  %s\n",
+		"----", "---", "------", "----", "----", "--", "----", "----")
 
 	// Print each profile
 	for _, name := range names {
-		p := profiles[name]
+		p := shape.Profiles[name]
 		mode := "packet"
 		if p.SerialMode {
 			mode = "serial"
 		}
-		fmt.Printf("%-16s  %8s  %8s  %10s  %10s  %s\n",
+		dist := "-"
+		if p.Jitter > 0 {
+			dist = p.JitterDist.String()
+			if p.JitterShape > 0 {
+				dist += fmt.Sprintf("(%g)", p.JitterShape)
+			}
+		}
+		fmt.Printf("%-16s  %8s  %8s  %-11s  %10s  %10s  %-9s  %s\n",
 			name,
 			formatDuration(p.RTT),
 			formatDuration(p.Jitter),
+			dist,
 			formatRate(p.DownRate),
 			formatRate(p.UpRate),
+			formatLoss(p.Loss, p.LossBurst),
 			mode,
 		)
 	}
@@ -0,0 +1,76 @@
+package shape
+
+import (
+	"sync"
+	"time"
+)
+
+// ACK path parameters
+const (
+	ackSize        = 52                    // Bytes per pure ACK: IPv4 + TCP with timestamps
+	ackCoalesce    = 10 * time.Millisecond // ACKs this close together are charged as one burst
+	maxPendingACKs = 1024                  // Bursts held for the carrying shaper
+)
+
+// ACKPath carries the TCP ACKs for the data one Shaper writes onto the
+// link of the Shaper for the opposite direction, as a receiver's ACKs share
+// the reverse path with whatever it sends itself. On an asymmetric link
+// heavy output then eats into the narrow upstream and keystrokes slow down.
+//
+// Set the same ACKPath as SendACKs on the Shaper whose data is acknowledged
+// and as CarryACKs on the one that carries the ACKs. The receiver sends one
+// ACK for every two full segments it gets, as delayed ACKs do.
+type ACKPath struct {
+	mu      sync.Mutex
+	unacked int            // Bytes received since the last ACK
+	pending ring[ackBurst] // ACKs not yet charged, oldest first
+}
+
+// ackBurst is ACKs sent together.
+type ackBurst struct {
+	at time.Time
+	n  int
+}
+
+// NewACKPath returns an ACKPath for pairing two Shapers.
+func NewACKPath() *ACKPath {
+	return &ACKPath{}
+}
+
+// received records n bytes reaching the receiver at now, and the ACKs it
+// sends for them.
+func (a *ACKPath) received(now time.Time, n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.unacked += n
+	acks := a.unacked / (2 * segmentSize)
+	if acks == 0 {
+		return
+	}
+	a.unacked -= acks * 2 * segmentSize
+	if a.pending.len() > 0 {
+		if last := a.pending.at(a.pending.len() - 1); now.Sub(last.at) < ackCoalesce {
+			last.n += acks * ackSize
+			return
+		}
+	}
+	// While the carrying direction is idle nothing collects the ACKs. Only
+	// the most recent can still be queued when it wakes, so the oldest go.
+	if a.pending.len() == maxPendingACKs {
+		a.pending.pop()
+	}
+	a.pending.push(ackBurst{at: now, n: acks * ackSize})
+}
+
+// take reports the ACKs sent up to now through send, oldest first.
+func (a *ACKPath) take(now time.Time, send func(at time.Time, n int)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.pending.len() > 0 {
+		if a.pending.front().at.After(now) {
+			return
+		}
+		b := a.pending.pop()
+		send(b.at, b.n)
+	}
+}
@@ -0,0 +1,77 @@
+package shape
+
+import (
+	"testing"
+	"time"
+)
+
+// TestACKPath checks that the receiver ACKs every second full segment and
+// that ACKs sent close together are charged as one burst.
+func TestACKPath(t *testing.T) {
+	a := NewACKPath()
+	a.received(virtualEpoch, 3*2*segmentSize+100)
+	a.received(virtualEpoch.Add(5*time.Millisecond), 2*segmentSize)
+	a.received(virtualEpoch.Add(20*time.Millisecond), 2*segmentSize-100)
+
+	var got []ackBurst
+	collect := func(at time.Time, n int) { got = append(got, ackBurst{at, n}) }
+	a.take(virtualEpoch.Add(10*time.Millisecond), collect)
+	if len(got) != 1 || got[0].n != 4*ackSize || !got[0].at.Equal(virtualEpoch) {
+		t.Fatalf("took %v, want four ACKs at the start", got)
+	}
+	a.take(virtualEpoch.Add(time.Second), collect)
+	if len(got) != 2 || got[1].n != ackSize {
+		t.Errorf("took %v, want one more ACK once the leftovers make two segments", got)
+	}
+}
+
+// TestACKPathIdle checks that ACKs pile up to a bound while nothing
+// collects them, keeping the most recent.
+func TestACKPathIdle(t *testing.T) {
+	a := NewACKPath()
+	for i := range maxPendingACKs + 10 {
+		a.received(virtualEpoch.Add(time.Duration(i)*time.Second), 2*segmentSize)
+	}
+	var first time.Time
+	n := 0
+	a.take(virtualEpoch.Add(time.Hour), func(at time.Time, _ int) {
+		if n == 0 {
+			first = at
+		}
+		n++
+	})
+	if n != maxPendingACKs || first.Sub(virtualEpoch) != 10*time.Second {
+		t.Errorf("took %d ACKs from %v, want the latest %d", n, first.Sub(virtualEpoch), maxPendingACKs)
+	}
+}
+
+// TestRateStageCarryACKs checks that ACKs for the other direction take
+// their share of the link ahead of a keystroke.
+func TestRateStageCarryACKs(t *testing.T) {
+	a := NewACKPath()
+	r := newRateStage(ShaperConfig{Rate: 1000, CarryACKs: a}, nil, nil)
+
+	// 40 segments of output are acknowledged with 20 ACKs: 1040 bytes
+	// against a 100-byte burst
+	a.received(virtualEpoch, 40*segmentSize)
+	sent := false
+	emit := func(p []byte) error {
+		sent = true
+		return nil
+	}
+	if err := r.Push(virtualEpoch, []byte("x"), emit); err != nil {
+		t.Fatal(err)
+	}
+	if sent {
+		t.Fatal("keystroke went straight through")
+	}
+	next, _ := r.Next()
+	if want := virtualEpoch.Add(941 * time.Millisecond); !next.Equal(want) {
+		t.Errorf("keystroke due after %v, want %v", next.Sub(virtualEpoch), want.Sub(virtualEpoch))
+	}
+	var st Stats
+	r.addStats(virtualEpoch, &st)
+	if st.ACKBytes != 20*ackSize {
+		t.Errorf("carried %d bytes of ACKs, want %d", st.ACKBytes, 20*ackSize)
+	}
+}
@@ -0,0 +1,96 @@
+package shape
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ParseBandwidth parses bandwidth strings like "56kbit", "1mbit", "100KB"
+// Returns bytes per second. Uses SI units (k=1000).
+func ParseBandwidth(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "" {
+		return 0, nil
+	}
+
+	// Regex to parse: number + optional unit
+	re := regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([a-z/]*)$`)
+	matches := re.FindStringSubmatch(s)
+	if matches == nil {
+		return 0, fmt.Errorf("invalid bandwidth format: %s", s)
+	}
+
+	value, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	unit := matches[2]
+	var multiplier float64 = 1
+	isBytes := false
+
+	switch unit {
+	case "", "bps", "bit", "bits":
+		multiplier = 1
+	case "k", "kbit", "kbps":
+		multiplier = 1000
+	case "m", "mbit", "mbps":
+		multiplier = 1000000
+	case "g", "gbit", "gbps":
+		multiplier = 1000000000
+	case "b", "bps/s", "byte", "bytes":
+		multiplier = 1
+		isBytes = true
+	case "kb", "kb/s", "kbps/s":
+		multiplier = 1000
+		isBytes = true
+	case "mb", "mb/s", "mbps/s":
+		multiplier = 1000000
+		isBytes = true
+	default:
+		return 0, fmt.Errorf("unknown bandwidth unit: %s", unit)
+	}
+
+	bits := value * multiplier
+	if isBytes {
+		return int64(bits), nil // Already in bytes
+	}
+	return int64(bits / 8), nil // Convert bits to bytes
+}
+
+// ParseSize parses byte counts like "4096", "64KB", "1.5m". Units are
+// bytes with SI multipliers (k=1000).
+func ParseSize(s string) (int, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "" {
+		return 0, nil
+	}
+
+	re := regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([a-z]*)$`)
+	matches := re.FindStringSubmatch(s)
+	if matches == nil {
+		return 0, fmt.Errorf("invalid size format: %s", s)
+	}
+
+	value, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	var multiplier float64
+	switch matches[2] {
+	case "", "b", "byte", "bytes":
+		multiplier = 1
+	case "k", "kb":
+		multiplier = 1000
+	case "m", "mb":
+		multiplier = 1000000
+	case "g", "gb":
+		multiplier = 1000000000
+	default:
+		return 0, fmt.Errorf("unknown size unit: %s", matches[2])
+	}
+	return int(value * multiplier), nil
+}
@@ -0,0 +1,67 @@
+package shape
+
+import "testing"
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"", 0},
+		{"9600", 1200},
+		{"9600bps", 1200},
+		{"56kbit", 7000},
+		{"56k", 7000},
+		{"1mbit", 125000},
+		{"1.5m", 187500},
+		{"100KB", 100000},
+		{"2mb", 2000000},
+		{" 10 kbit ", 1250},
+	}
+	for _, tt := range tests {
+		got, err := ParseBandwidth(tt.in)
+		if err != nil {
+			t.Errorf("ParseBandwidth(%q) error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseBandwidth(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"fast", "10 furlongs", "-5k"} {
+		if _, err := ParseBandwidth(bad); err == nil {
+			t.Errorf("ParseBandwidth(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"4096", 4096},
+		{"64KB", 64000},
+		{"64k", 64000},
+		{"1.5m", 1500000},
+		{" 10 bytes ", 10},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if err != nil {
+			t.Errorf("ParseSize(%q) error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"lots", "10kbit", "-5"} {
+		if _, err := ParseSize(bad); err == nil {
+			t.Errorf("ParseSize(%q) succeeded, want an error", bad)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package shape
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// zeroReader yields an endless stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// BenchmarkPipeline pushes 4KB blocks through the stage pipeline in
+// virtual time, as fast as each profile's link drains them, so queues reach
+// a steady state. It measures the cost of the stages themselves.
+func BenchmarkPipeline(b *testing.B) {
+	cases := []struct {
+		name string
+		cfg  ShaperConfig
+	}{
+		{"passthrough", ShaperConfig{}},
+		{"lte", Profiles["lte"].Down()},
+		{"cable", Profiles["cable"].Down()},
+		{"cable-chunked", ShaperConfig{Delay: 15 * time.Millisecond, Rate: 6250000, ChunkSize: 64, FrameTime: 16 * time.Millisecond}},
+		{"serial-115200", ShaperConfig{Rate: 11520, SerialMode: true}},
+	}
+	const block = readBufferSize
+
+	for _, tc := range cases {
+		b.Run(tc.name, func(b *testing.B) {
+			builder, err := newPipelineBuilder(StageEnv{Config: tc.cfg, Rand: rand.New(rand.NewSource(1))})
+			if err != nil {
+				b.Fatal(err)
+			}
+			p := builder.build()
+			p.sink = func([]byte) error { return nil }
+
+			// Virtual time a block spends on the wire
+			step := time.Millisecond
+			if tc.cfg.Rate > 0 {
+				step = time.Duration(float64(block) / float64(tc.cfg.Rate) * float64(time.Second))
+			}
+			data := make([]byte, block)
+			now := virtualEpoch
+
+			b.SetBytes(block)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := p.push(now, data); err != nil {
+					b.Fatal(err)
+				}
+				now = now.Add(step)
+				// Release at each due time, as Run's wake timer would
+				for {
+					next, ok := p.next()
+					if !ok || next.After(now) {
+						break
+					}
+					if err := p.release(next); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkShaperRun copies an endless source through an unshaped Shaper,
+// measuring the reader goroutine and event loop overhead per read.
+func BenchmarkShaperRun(b *testing.B) {
+	b.SetBytes(readBufferSize)
+	b.ReportAllocs()
+	src := io.LimitReader(zeroReader{}, int64(b.N)*readBufferSize)
+	if err := Copy(context.Background(), io.Discard, src, ShaperConfig{}); err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+package shape
+
+import (
+	"context"
+	"io"
+)
+
+// Chain shapes one direction of a path that crosses several links, such
+// as a poor Wi-Fi hop to the home router and then an intercontinental
+// route to the server. Each hop is a Shaper with its own delay, jitter,
+// rate, loss and queue, writing into the next, so delays add up and data
+// piles up in the queue of the slowest hop.
+type Chain struct {
+	hops []*Shaper
+}
+
+// NewChain returns a Chain through a Shaper for each of cfgs, in the order
+// data crosses them. It panics if cfgs is empty.
+func NewChain(cfgs ...ShaperConfig) *Chain {
+	if len(cfgs) == 0 {
+		panic("shape: chain without hops")
+	}
+	c := &Chain{hops: make([]*Shaper, len(cfgs))}
+	for i, cfg := range cfgs {
+		c.hops[i] = NewShaper(cfg)
+	}
+	return c
+}
+
+// Hops returns the Chain's Shapers, in the order data crosses them, for
+// their Stats or to retune one with SetConfig.
+func (c *Chain) Hops() []*Shaper {
+	return c.hops
+}
+
+// Stats returns a snapshot of each hop's Stats, in order.
+func (c *Chain) Stats() []Stats {
+	stats := make([]Stats, len(c.hops))
+	for i, s := range c.hops {
+		stats[i] = s.Stats()
+	}
+	return stats
+}
+
+// Run shapes data from src to dst through every hop, like Shaper.Run. When
+// src ends, each hop drains into the next before the next finishes. Run
+// returns once every hop has stopped, with the first error any of them hit,
+// the last hop's first.
+func (c *Chain) Run(ctx context.Context, src io.Reader, dst io.Writer) error {
+	last := len(c.hops) - 1
+	errs := make(chan error, last)
+	pipes := make([]*io.PipeReader, last)
+	in := src
+	for i, s := range c.hops[:last] {
+		pr, pw := io.Pipe()
+		go func(s *Shaper, in io.Reader) {
+			err := s.Run(ctx, in, pw)
+			// The next hop drains whatever it holds, however this one stopped
+			pw.Close()
+			errs <- err
+		}(s, in)
+		in, pipes[i] = pr, pr
+	}
+	err := c.hops[last].Run(ctx, in, dst)
+
+	// Unblock hops still writing into one that has given up
+	for _, pr := range pipes {
+		pr.CloseWithError(io.ErrClosedPipe)
+	}
+	for range last {
+		if e := <-errs; err == nil {
+			err = e
+		}
+	}
+	return err
+}
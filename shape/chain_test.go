@@ -0,0 +1,51 @@
+package shape
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestChain checks that each hop's delay adds up and that the slowest
+// hop's rate sets the pace.
+func TestChain(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+	c := NewChain(
+		ShaperConfig{Delay: 100 * time.Millisecond, Rate: 100000, Clock: fc},
+		ShaperConfig{Delay: 200 * time.Millisecond, Rate: 1000, Clock: fc},
+	)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(context.Background(), strings.NewReader(strings.Repeat("x", 200)), dst)
+	}()
+	var err error
+	stepUntil(t, fc, func() bool {
+		select {
+		case err = <-done:
+			return true
+		default:
+			return false
+		}
+	})
+	if err != nil || dst.String() != strings.Repeat("x", 200) {
+		t.Fatalf("Run wrote %q, %v; want all 200 bytes", dst.String(), err)
+	}
+
+	// The second hop's 100-byte burst goes after both delays, the rest at
+	// its 1000 bytes/s
+	if got := dst.writes[0].t.Sub(virtualEpoch); got != 300*time.Millisecond {
+		t.Errorf("first write after %v, want 300ms", got)
+	}
+	if got := dst.writes[len(dst.writes)-1].t.Sub(virtualEpoch); got != 400*time.Millisecond {
+		t.Errorf("last write after %v, want 400ms", got)
+	}
+	st := c.Stats()
+	if len(st) != 2 || st[0].BytesWritten != 200 || st[1].BytesWritten != 200 {
+		t.Errorf("hop stats %+v, want 200 bytes through each", st)
+	}
+	if st[0].RateBlocked != 0 || st[1].RateBlocked == 0 {
+		t.Errorf("rate waits %v and %v, want only the second hop to hold data back", st[0].RateBlocked, st[1].RateBlocked)
+	}
+}
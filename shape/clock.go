@@ -0,0 +1,210 @@
+package shape
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the time source a Shaper uses for timestamps and waiting.
+// The default is the system clock; tests can inject a FakeClock to run
+// long or slow transfers in virtual time.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the subset of *time.Timer that a Shaper needs.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// SystemClock returns a Clock backed by the time package.
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+// configClock returns cfg.Clock, or the system clock if it is unset.
+func configClock(cfg ShaperConfig) Clock {
+	if cfg.Clock == nil {
+		return SystemClock()
+	}
+	return cfg.Clock
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	t *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time        { return t.t.C }
+func (t systemTimer) Stop() bool                 { return t.t.Stop() }
+func (t systemTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+// FakeClock is a manually advanced Clock. Time only moves when Advance,
+// AdvanceToNext or Set is called, and timers fire as the clock passes
+// their deadlines. It is safe for concurrent use.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	cond   *sync.Cond
+}
+
+// NewFakeClock returns a FakeClock whose current time is start.
+func NewFakeClock(start time.Time) *FakeClock {
+	c := &FakeClock{now: start}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current virtual time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer that fires once the clock reaches now+d.
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: c, ch: make(chan time.Time, 1)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schedule(t, d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer that comes due
+// along the way in deadline order.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock to t, firing every timer due at or before t.
+// Moving the clock backwards is a no-op.
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) > 0 && !c.timers[0].deadline.After(t) {
+		c.fire(c.timers[0])
+	}
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// AdvanceToNext moves the clock to the deadline of the earliest pending
+// timer and fires it. It returns false if no timer is pending.
+func (c *FakeClock) AdvanceToNext() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.timers) == 0 {
+		return false
+	}
+	c.fire(c.timers[0])
+	return true
+}
+
+// Waiters returns the number of timers that have not fired or been stopped.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil blocks until at least n timers are pending.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// schedule adds t to the pending set with a deadline d from now.
+// c.mu must be held.
+func (c *FakeClock) schedule(t *fakeTimer, d time.Duration) {
+	t.deadline = c.now.Add(d)
+	if d <= 0 {
+		t.send(c.now)
+		return
+	}
+	i := sort.Search(len(c.timers), func(i int) bool {
+		return c.timers[i].deadline.After(t.deadline)
+	})
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+	c.cond.Broadcast()
+}
+
+// fire advances the clock to t's deadline and delivers it. c.mu must be held.
+func (c *FakeClock) fire(t *fakeTimer) {
+	c.remove(t)
+	if t.deadline.After(c.now) {
+		c.now = t.deadline
+	}
+	t.send(c.now)
+}
+
+// remove drops t from the pending set, reporting whether it was pending.
+// c.mu must be held.
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	for i, pending := range c.timers {
+		if pending == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+// Stop prevents the timer from firing and discards any undelivered tick,
+// matching the semantics of time.Timer since Go 1.23.
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.drain()
+	return t.clock.remove(t)
+}
+
+// Reset reschedules the timer to fire d from the clock's current time.
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.drain()
+	active := t.clock.remove(t)
+	t.clock.schedule(t, d)
+	return active
+}
+
+func (t *fakeTimer) send(now time.Time) {
+	select {
+	case t.ch <- now:
+	default:
+	}
+}
+
+func (t *fakeTimer) drain() {
+	select {
+	case <-t.ch:
+	default:
+	}
+}
@@ -0,0 +1,63 @@
+package shape
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockFiresInDeadlineOrder(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	late := fc.NewTimer(2 * time.Second)
+	early := fc.NewTimer(time.Second)
+
+	if n := fc.Waiters(); n != 2 {
+		t.Fatalf("Waiters() = %d, want 2", n)
+	}
+
+	if !fc.AdvanceToNext() {
+		t.Fatal("AdvanceToNext found no timer")
+	}
+	select {
+	case at := <-early.C():
+		if !at.Equal(virtualEpoch.Add(time.Second)) {
+			t.Errorf("early timer fired at %v", at)
+		}
+	default:
+		t.Fatal("early timer did not fire first")
+	}
+	select {
+	case <-late.C():
+		t.Fatal("late timer fired too soon")
+	default:
+	}
+
+	fc.Advance(5 * time.Second)
+	if got := fc.Now(); !got.Equal(virtualEpoch.Add(6 * time.Second)) {
+		t.Errorf("Now() = %v after advancing", got)
+	}
+	if at := <-late.C(); !at.Equal(virtualEpoch.Add(2 * time.Second)) {
+		t.Errorf("late timer fired at %v, want its deadline", at)
+	}
+}
+
+func TestFakeClockStopAndReset(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	timer := fc.NewTimer(time.Second)
+
+	if !timer.Stop() {
+		t.Error("Stop() on a pending timer returned false")
+	}
+	if fc.AdvanceToNext() {
+		t.Error("stopped timer still pending")
+	}
+
+	if timer.Reset(time.Minute) {
+		t.Error("Reset() on a stopped timer returned true")
+	}
+	fc.Advance(time.Minute)
+	select {
+	case <-timer.C():
+	default:
+		t.Error("reset timer did not fire")
+	}
+}
@@ -0,0 +1,362 @@
+package shape
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CrossPattern is how synthetic background traffic is sent.
+type CrossPattern int
+
+const (
+	// CrossConstant sends at Rate all the time, like a video call.
+	CrossConstant CrossPattern = iota
+	// CrossOnOff alternates between sending at Rate and silence, for
+	// periods drawn from exponential distributions with means On and Off,
+	// like web browsing or a sync client.
+	CrossOnOff
+	// CrossTrace replays Trace, repeating it once it runs out.
+	CrossTrace
+)
+
+var crossPatternNames = map[CrossPattern]string{
+	CrossConstant: "constant",
+	CrossOnOff:    "onoff",
+	CrossTrace:    "trace",
+}
+
+func (p CrossPattern) String() string {
+	if name, ok := crossPatternNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("CrossPattern(%d)", int(p))
+}
+
+// Cross traffic parameters
+const (
+	crossPacketSize    = 1500                   // Bytes per background packet at a set rate
+	defaultCrossBuffer = 200 * time.Millisecond // Default bottleneck buffer
+	crossForget        = 20                     // On/off cycles after which the phase is random again
+)
+
+// CrossTraffic describes background traffic sharing a Shaper's link, as
+// when a video call or a download runs alongside the terminal. It takes
+// its share of Rate and queues ahead of terminal data that arrives after
+// it, so keystrokes wait behind it.
+type CrossTraffic struct {
+	Pattern CrossPattern
+	Rate    int64         // Bytes per second while sending; 0 = bulk, keeping the buffer full like a TCP download
+	On, Off time.Duration // Mean sending and silent periods (CrossOnOff)
+	Trace   []CrossSample // Bytes sent at offsets from the start (CrossTrace)
+
+	// Buffer is the most background traffic the bottleneck holds, in time
+	// at Rate; more is dropped, as a router's queue would (0 = 200ms). It
+	// bounds the queueing delay background traffic adds.
+	Buffer time.Duration
+}
+
+// CrossSample is a burst of background traffic in a trace.
+type CrossSample struct {
+	At    time.Duration // Offset from the start of the trace
+	Bytes int
+}
+
+// ParseCrossTraffic parses a background traffic description: a bandwidth
+// such as "2mbit" for constant traffic, "bulk" for a download that keeps
+// the link busy, or "onoff:RATE:ON:OFF" (RATE may be bulk) for bursts of
+// mean length ON separated by mean silences OFF, e.g. "onoff:5mbit:2s:8s".
+// Traces are read with ReadCrossTrace.
+func ParseCrossTraffic(s string) (*CrossTraffic, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	parts := strings.Split(s, ":")
+	switch {
+	case parts[0] == "onoff" && len(parts) == 4:
+		rate, err := parseCrossRate(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		on, err := time.ParseDuration(parts[2])
+		if err != nil || on <= 0 {
+			return nil, fmt.Errorf("invalid on period: %s", parts[2])
+		}
+		off, err := time.ParseDuration(parts[3])
+		if err != nil || off <= 0 {
+			return nil, fmt.Errorf("invalid off period: %s", parts[3])
+		}
+		return &CrossTraffic{Pattern: CrossOnOff, Rate: rate, On: on, Off: off}, nil
+	case parts[0] == "onoff":
+		return nil, fmt.Errorf("invalid on/off traffic: %s (want onoff:RATE:ON:OFF)", s)
+	case len(parts) == 1:
+		rate, err := parseCrossRate(s)
+		if err != nil {
+			return nil, err
+		}
+		return &CrossTraffic{Pattern: CrossConstant, Rate: rate}, nil
+	}
+	return nil, fmt.Errorf("unknown cross traffic: %s", s)
+}
+
+// parseCrossRate parses a bandwidth, or "bulk" for 0.
+func parseCrossRate(s string) (int64, error) {
+	if s == "bulk" {
+		return 0, nil
+	}
+	rate, err := ParseBandwidth(s)
+	if err != nil {
+		return 0, err
+	}
+	if rate <= 0 {
+		return 0, fmt.Errorf("invalid cross traffic rate: %s", s)
+	}
+	return rate, nil
+}
+
+// ReadCrossTrace reads a background traffic trace: one burst per line, as
+// a time and a size in bytes separated by spaces, tabs or commas. Times
+// are seconds from the start, as tshark's frame.time_relative gives them,
+// or durations such as "250ms". Blank lines, # comments and a header line
+// are skipped. The trace repeats every last-time.
+func ReadCrossTrace(r io.Reader) (*CrossTraffic, error) {
+	var trace []CrossSample
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := splitFields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("trace line %d: want a time and a size", n)
+		}
+		at, err := parseTraceTime(fields[0])
+		if err != nil && len(trace) == 0 {
+			continue // Header
+		}
+		if err != nil {
+			return nil, fmt.Errorf("trace line %d: %w", n, err)
+		}
+		size, err := strconv.Atoi(fields[1])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("trace line %d: invalid size %q", n, fields[1])
+		}
+		if len(trace) > 0 && at < trace[len(trace)-1].At {
+			return nil, fmt.Errorf("trace line %d: time goes backwards", n)
+		}
+		trace = append(trace, CrossSample{At: at, Bytes: size})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(trace) == 0 {
+		return nil, errors.New("trace: no data")
+	}
+	if trace[len(trace)-1].At <= 0 {
+		return nil, errors.New("trace: must span some time")
+	}
+	return &CrossTraffic{Pattern: CrossTrace, Trace: trace}, nil
+}
+
+// parseTraceTime parses a trace time in seconds, or with a unit.
+func parseTraceTime(s string) (time.Duration, error) {
+	if sec, err := strconv.ParseFloat(s, 64); err == nil {
+		if sec < 0 || math.IsNaN(sec) || math.IsInf(sec, 0) {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		return time.Duration(sec * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return d, nil
+}
+
+// bottleneckBuffer returns a buffer of d (0 = 200ms) at rate in bytes: at
+// least one packet.
+func bottleneckBuffer(d time.Duration, rate int64) int {
+	if d <= 0 {
+		d = defaultCrossBuffer
+	}
+	return max(int(mulDiv(uint64(d), uint64(rate), uint64(time.Second))), crossPacketSize)
+}
+
+// crossSource generates the arrivals of a CrossTraffic. It is run lazily:
+// each call to advance produces everything that arrived since the last,
+// in order, so the rate stage needs no wake-ups of its own for it.
+type crossSource struct {
+	cfg     *CrossTraffic
+	rng     *rand.Rand
+	started bool
+
+	nextAt   time.Time // Next packet at Rate
+	on       bool      // CrossOnOff: sending
+	switchAt time.Time // CrossOnOff: end of the current period
+	base     time.Time // CrossTrace: start of the current repetition
+	idx      int       // CrossTrace: next sample
+}
+
+func newCrossSource(cfg *CrossTraffic, rng *rand.Rand) *crossSource {
+	return &crossSource{cfg: cfg, rng: rng}
+}
+
+// advance reports the traffic that arrives up to now through send, as
+// bytes arriving at a time; n == 0 asks for the buffer to be filled, for
+// bulk traffic. Traffic starts at the first call.
+//
+// Traffic more than keep before now is skipped instead of sent, so a call
+// after hours of idling costs no more than one after a second. advance
+// returns the bytes skipped.
+func (c *crossSource) advance(now time.Time, keep time.Duration, send func(at time.Time, n int)) int64 {
+	var skipped int64
+	if !c.started {
+		c.start(now)
+	} else {
+		skipped = c.skip(now.Add(-keep))
+	}
+	switch c.cfg.Pattern {
+	case CrossConstant:
+		c.sendUntil(now, send)
+
+	case CrossOnOff:
+		for {
+			end := now
+			if c.switchAt.Before(now) {
+				end = c.switchAt
+			}
+			if c.on {
+				c.sendUntil(end, send)
+			}
+			if c.switchAt.After(now) {
+				return skipped
+			}
+			c.on = !c.on
+			c.nextAt = c.switchAt
+			c.switchAt = c.switchAt.Add(c.period())
+		}
+
+	case CrossTrace:
+		period := c.cfg.Trace[len(c.cfg.Trace)-1].At
+		for {
+			s := c.cfg.Trace[c.idx]
+			at := c.base.Add(s.At)
+			if at.After(now) {
+				return skipped
+			}
+			if s.Bytes > 0 {
+				send(at, s.Bytes)
+			}
+			if c.idx++; c.idx == len(c.cfg.Trace) {
+				c.idx, c.base = 0, c.base.Add(period)
+			}
+		}
+	}
+	return skipped
+}
+
+// skip moves the traffic on to to without sending what arrives before it,
+// a whole period at a time where the pattern repeats, and returns the
+// bytes passed over.
+func (c *crossSource) skip(to time.Time) int64 {
+	switch c.cfg.Pattern {
+	case CrossConstant:
+		return c.skipSends(to)
+
+	case CrossOnOff:
+		if cycle := c.cfg.On + c.cfg.Off; to.Sub(c.switchAt) > crossForget*cycle {
+			// Exponential periods forget the past, so after this many the
+			// traffic is in a random phase, as when it started
+			n := mulDiv(uint64(to.Sub(c.nextAt)), uint64(c.cfg.Rate)*uint64(c.cfg.On), uint64(time.Second)*uint64(cycle))
+			c.start(to)
+			return int64(n)
+		}
+		var n int64
+		for c.switchAt.Before(to) {
+			if c.on {
+				n += c.skipSends(c.switchAt)
+			}
+			c.on = !c.on
+			c.nextAt = c.switchAt
+			c.switchAt = c.switchAt.Add(c.period())
+		}
+		if c.on {
+			n += c.skipSends(to)
+		}
+		return n
+
+	case CrossTrace:
+		var n int64
+		period := c.cfg.Trace[len(c.cfg.Trace)-1].At
+		if reps := to.Sub(c.base)/period - 1; reps > 0 {
+			// Each repetition passed over from idx on is one of every sample
+			for _, s := range c.cfg.Trace {
+				n += int64(reps) * int64(s.Bytes)
+			}
+			c.base = c.base.Add(reps * period)
+		}
+		for c.base.Add(c.cfg.Trace[c.idx].At).Before(to) {
+			n += int64(c.cfg.Trace[c.idx].Bytes)
+			if c.idx++; c.idx == len(c.cfg.Trace) {
+				c.idx, c.base = 0, c.base.Add(period)
+			}
+		}
+		return n
+	}
+	return 0
+}
+
+// start begins the traffic at now: on/off traffic in a random phase.
+func (c *crossSource) start(now time.Time) {
+	c.started = true
+	c.nextAt, c.base = now, now
+	if c.cfg.Pattern == CrossOnOff {
+		c.on = c.rng.Float64()*float64(c.cfg.On+c.cfg.Off) < float64(c.cfg.On)
+		c.switchAt = now.Add(c.period())
+	}
+}
+
+// period draws the length of the on/off period just starting.
+func (c *crossSource) period() time.Duration {
+	mean := c.cfg.Off
+	if c.on {
+		mean = c.cfg.On
+	}
+	return max(time.Duration(c.rng.ExpFloat64()*float64(mean)), time.Millisecond)
+}
+
+// sendUntil sends at Rate up to end, or fills the buffer at end for bulk
+// traffic.
+func (c *crossSource) sendUntil(end time.Time, send func(at time.Time, n int)) {
+	if c.cfg.Rate <= 0 {
+		send(end, 0)
+		return
+	}
+	gap := c.gap()
+	for !c.nextAt.After(end) {
+		send(c.nextAt, crossPacketSize)
+		c.nextAt = c.nextAt.Add(gap)
+	}
+}
+
+// skipSends moves the next packet at Rate on to to or after, returning the
+// bytes of the packets passed over. Bulk traffic has nothing to skip.
+func (c *crossSource) skipSends(to time.Time) int64 {
+	if c.cfg.Rate <= 0 || !c.nextAt.Before(to) {
+		return 0
+	}
+	gap := c.gap()
+	k := (to.Sub(c.nextAt) + gap - 1) / gap
+	c.nextAt = c.nextAt.Add(k * gap)
+	return int64(k) * crossPacketSize
+}
+
+// gap returns the time between packets at Rate.
+func (c *crossSource) gap() time.Duration {
+	return max(time.Duration(crossPacketSize*int64(time.Second)/c.cfg.Rate), time.Nanosecond)
+}
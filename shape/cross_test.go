@@ -0,0 +1,176 @@
+package shape
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCrossTraffic(t *testing.T) {
+	tests := []struct {
+		input string
+		want  CrossTraffic
+	}{
+		{"2mbit", CrossTraffic{Pattern: CrossConstant, Rate: 250000}},
+		{"bulk", CrossTraffic{Pattern: CrossConstant}},
+		{"onoff:bulk:2s:8s", CrossTraffic{Pattern: CrossOnOff, On: 2 * time.Second, Off: 8 * time.Second}},
+		{"OnOff:1mbit:500ms:1s", CrossTraffic{Pattern: CrossOnOff, Rate: 125000, On: 500 * time.Millisecond, Off: time.Second}},
+	}
+	for _, tt := range tests {
+		got, err := ParseCrossTraffic(tt.input)
+		if err != nil || got.Pattern != tt.want.Pattern || got.Rate != tt.want.Rate || got.On != tt.want.On || got.Off != tt.want.Off {
+			t.Errorf("ParseCrossTraffic(%q) = %+v, %v; want %+v", tt.input, got, err, tt.want)
+		}
+	}
+	for _, input := range []string{"", "fast", "0", "onoff:1mbit:2s", "onoff:1mbit:0s:1s", "trace:x"} {
+		if _, err := ParseCrossTraffic(input); err == nil {
+			t.Errorf("ParseCrossTraffic(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+func TestReadCrossTrace(t *testing.T) {
+	c, err := ReadCrossTrace(strings.NewReader("time,bytes\n# a comment\n0.0,1500\n0.25,600\n\n1,1500\n"))
+	if err != nil {
+		t.Fatalf("ReadCrossTrace failed: %v", err)
+	}
+	want := []CrossSample{{0, 1500}, {250 * time.Millisecond, 600}, {time.Second, 1500}}
+	if c.Pattern != CrossTrace || len(c.Trace) != len(want) {
+		t.Fatalf("got %+v, want trace %v", c, want)
+	}
+	for i := range want {
+		if c.Trace[i] != want[i] {
+			t.Errorf("sample %d = %v, want %v", i, c.Trace[i], want[i])
+		}
+	}
+	for _, input := range []string{"", "0 1500\n", "1 1500\n0.5 100\n", "0 1500\n1 lots\n", "0 1500\n2\n"} {
+		if _, err := ReadCrossTrace(strings.NewReader(input)); err == nil {
+			t.Errorf("ReadCrossTrace(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+// TestCrossSourceTrace checks that a trace is replayed from its first use
+// and repeats.
+func TestCrossSourceTrace(t *testing.T) {
+	c := newCrossSource(&CrossTraffic{Pattern: CrossTrace, Trace: []CrossSample{{0, 1}, {time.Second, 2}}}, nil)
+	var got []string
+	c.advance(virtualEpoch.Add(time.Second), time.Hour, func(at time.Time, n int) {})
+	c.advance(virtualEpoch.Add(3500*time.Millisecond), time.Hour, func(at time.Time, n int) {
+		got = append(got, at.Sub(virtualEpoch).String()+":"+strings.Repeat("x", n))
+	})
+	if s := strings.Join(got, " "); s != "2s:xx 2s:x 3s:xx 3s:x" {
+		t.Errorf("arrivals %s, want each repetition to follow the last", s)
+	}
+
+	// After a long gap only the last of it is replayed
+	c = newCrossSource(c.cfg, nil)
+	got = nil
+	c.advance(virtualEpoch.Add(time.Second), time.Hour, func(at time.Time, n int) {})
+	skipped := c.advance(virtualEpoch.Add(time.Hour+500*time.Millisecond), time.Second, func(at time.Time, n int) {
+		got = append(got, at.Sub(virtualEpoch).String()+":"+strings.Repeat("x", n))
+	})
+	if s := strings.Join(got, " "); s != "1h0m0s:xx 1h0m0s:x" || skipped != 3*3598 {
+		t.Errorf("arrivals %s after skipping %d bytes, want the last second's after 3598 repetitions", s, skipped)
+	}
+}
+
+// TestRateStageCrossBulk checks that bulk traffic keeps the bottleneck
+// buffer full, so every keystroke waits out the buffer.
+func TestRateStageCrossBulk(t *testing.T) {
+	cross := &CrossTraffic{Pattern: CrossConstant, Buffer: 200 * time.Millisecond}
+	r := newRateStage(ShaperConfig{Rate: 10000, Cross: cross}, nil, nil)
+	var at []time.Duration
+	now := virtualEpoch
+	emit := func(p []byte) error {
+		at = append(at, now.Sub(virtualEpoch))
+		return nil
+	}
+	for _, push := range []time.Duration{0, time.Second} {
+		now = virtualEpoch.Add(push)
+		if err := r.Push(now, []byte("x"), emit); err != nil {
+			t.Fatal(err)
+		}
+		next, ok := r.Next()
+		if !ok {
+			t.Fatalf("keystroke at %v went straight through", push)
+		}
+		now = next
+		if err := r.Release(now, emit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 2000 bytes of buffer plus the keystroke at 10000 bytes/s
+	want := []time.Duration{200100 * time.Microsecond, 1200100 * time.Microsecond}
+	if len(at) != 2 || at[0] != want[0] || at[1] != want[1] {
+		t.Errorf("keystrokes written at %v, want %v", at, want)
+	}
+	var st Stats
+	r.addStats(now, &st)
+	if st.CrossBytes < 2*2000 {
+		t.Errorf("cross traffic %d bytes, want at least a buffer's worth per keystroke", st.CrossBytes)
+	}
+}
+
+// TestRateStageCrossSerial checks that on a serial line a keystroke waits
+// for the background packet on the wire, and only for that.
+func TestRateStageCrossSerial(t *testing.T) {
+	// 1500-byte packets every 3s, each taking 1.5s on the line
+	cross := &CrossTraffic{Pattern: CrossConstant, Rate: 500, Buffer: 2 * time.Second}
+	r := newRateStage(ShaperConfig{Rate: 1000, SerialMode: true, Cross: cross}, nil, nil)
+	var at []time.Duration
+	now := virtualEpoch
+	emit := func(p []byte) error {
+		at = append(at, now.Sub(virtualEpoch))
+		return nil
+	}
+	for _, push := range []time.Duration{0, 2 * time.Second, 3200 * time.Millisecond} {
+		now = virtualEpoch.Add(push)
+		if err := r.Push(now, []byte("x"), emit); err != nil {
+			t.Fatal(err)
+		}
+		next, _ := r.Next()
+		now = next
+		if err := r.Release(now, emit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []time.Duration{1501 * time.Millisecond, 2001 * time.Millisecond, 4501 * time.Millisecond}
+	if len(at) != 3 || at[0] != want[0] || at[1] != want[1] || at[2] != want[2] {
+		t.Errorf("keystrokes written at %v, want %v", at, want)
+	}
+}
+
+// TestShaperCrossIdle checks that a write after hours of idling under
+// cross traffic waits only on the traffic still queued, without replaying
+// every background packet since the last write.
+func TestShaperCrossIdle(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	s := NewShaper(ShaperConfig{
+		Rate:  12500000,                                             // 100mbit
+		Cross: &CrossTraffic{Pattern: CrossConstant, Rate: 6250000}, // 50mbit
+		Clock: fc,
+	})
+	dst := &clockWriter{clock: fc}
+	src, w := io.Pipe()
+	done := startVirtual(s, dst, src)
+
+	const idle = 6 * time.Hour
+	for i, at := range []time.Duration{0, idle} {
+		fc.Set(virtualEpoch.Add(at))
+		go w.Write([]byte("x"))
+		stepUntil(t, fc, func() bool { return dst.count() > i })
+		if wait := dst.writes[i].t.Sub(virtualEpoch.Add(at)); wait > time.Millisecond {
+			t.Errorf("write at %v took %v, want at most a packet's serialization", at, wait)
+		}
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	// The link still carried the background traffic while idle
+	if got, want := s.Stats().CrossBytes, int64(idle.Seconds()*6250000); got < want*99/100 || got > want*101/100 {
+		t.Errorf("cross traffic %d bytes, want about %d", got, want)
+	}
+}
@@ -0,0 +1,92 @@
+package shape
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrHangup is returned by Shaper.Run once its Hangup has declared the
+// connection dead.
+var ErrHangup = errors.New("connection dropped")
+
+// Hangup decides when a connection is beyond saving, as a real session
+// dies when ssh gives up on its keepalives, a NAT forgets an idle mapping
+// or a serial line loses carrier. Share one between the Shapers for both
+// directions of a connection through ShaperConfig.Hangup.
+//
+// The connection dies when data has waited out an outage for longer than
+// the stall limit, as TCP or ssh gives up on a peer that does not answer,
+// or when data is sent after the link has been idle both ways for longer
+// than the idle limit, as a NAT that has dropped the mapping answers with
+// a reset. Like the real thing, neither rule notices a dead link until
+// there is something to send. From then on each Shaper's Run returns
+// ErrHangup when it next has data to send.
+type Hangup struct {
+	stall time.Duration
+	idle  time.Duration
+
+	mu   sync.Mutex
+	last time.Time // Latest data sent either way
+	dead bool
+}
+
+// NewHangup returns a Hangup with the given stall and idle limits; 0
+// disables a rule.
+func NewHangup(stall, idle time.Duration) *Hangup {
+	return &Hangup{stall: stall, idle: idle}
+}
+
+// Dead reports whether the connection has been declared dead.
+func (h *Hangup) Dead() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dead
+}
+
+// start begins the idle period at now, for the first Shaper built.
+func (h *Hangup) start(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.last.IsZero() {
+		h.last = now
+	}
+}
+
+// sent records data entering the link at now. It returns ErrHangup if the
+// connection is dead, or dies now after lying idle.
+func (h *Hangup) sent(now time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dead && h.idle > 0 && now.Sub(h.last) > h.idle {
+		h.dead = true
+	}
+	if h.dead {
+		return ErrHangup
+	}
+	if now.After(h.last) {
+		h.last = now
+	}
+	return nil
+}
+
+// deadline returns when data held since since kills the connection, if
+// the stall limit is set.
+func (h *Hangup) deadline(since time.Time) (time.Time, bool) {
+	if h.stall <= 0 {
+		return time.Time{}, false
+	}
+	return since.Add(h.stall), true
+}
+
+// stalled returns ErrHangup, declaring the connection dead, if data held
+// since since has waited past the stall limit at now.
+func (h *Hangup) stalled(since, now time.Time) error {
+	if at, ok := h.deadline(since); !ok || now.Before(at) {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dead = true
+	return ErrHangup
+}
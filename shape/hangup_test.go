@@ -0,0 +1,97 @@
+package shape
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHangupStall checks that data held by an outage for longer than the
+// stall limit kills the connection, and data that gets through in time
+// does not.
+func TestHangupStall(t *testing.T) {
+	h := NewHangup(5*time.Second, 0)
+	o := newOutageStage(ShaperConfig{
+		Outages: &OutageSchedule{Fixed: []Outage{{time.Second, 3 * time.Second}, {10 * time.Second, time.Hour}}},
+		Hangup:  h,
+		Clock:   NewFakeClock(virtualEpoch),
+	})
+	emit := func([]byte) error { return nil }
+	at := func(d time.Duration) time.Time { return virtualEpoch.Add(d) }
+
+	// Held for 2s, inside the limit
+	if err := o.Push(at(2*time.Second), []byte("x"), emit); err != nil {
+		t.Fatal(err)
+	}
+	if next, _ := o.Next(); !next.Equal(at(4 * time.Second)) {
+		t.Fatalf("Next = %v, want the end of the first outage", next.Sub(virtualEpoch))
+	}
+	if err := o.Release(at(4*time.Second), emit); err != nil {
+		t.Fatalf("Release after a short outage: %v", err)
+	}
+
+	if err := o.Push(at(12*time.Second), []byte("x"), emit); err != nil {
+		t.Fatal(err)
+	}
+	next, _ := o.Next()
+	if !next.Equal(at(17 * time.Second)) {
+		t.Fatalf("Next = %v, want the stall limit at 17s", next.Sub(virtualEpoch))
+	}
+	if err := o.Release(next, emit); !errors.Is(err, ErrHangup) || !h.Dead() {
+		t.Errorf("Release at the stall limit = %v (dead %v), want ErrHangup", err, h.Dead())
+	}
+}
+
+// TestHangupIdle checks that data sent after both directions have been
+// idle for longer than the idle limit kills the connection for both.
+func TestHangupIdle(t *testing.T) {
+	h := NewHangup(0, time.Minute)
+	fc := NewFakeClock(virtualEpoch)
+	up := newOutageStage(ShaperConfig{Hangup: h, Clock: fc})
+	down := newOutageStage(ShaperConfig{Hangup: h, Clock: fc})
+	emit := func([]byte) error { return nil }
+
+	for _, push := range []struct {
+		stage *outageStage
+		at    time.Duration
+	}{{up, 50 * time.Second}, {down, 100 * time.Second}, {up, 150 * time.Second}} {
+		if err := push.stage.Push(virtualEpoch.Add(push.at), []byte("x"), emit); err != nil {
+			t.Fatalf("push at %v: %v", push.at, err)
+		}
+	}
+	if err := down.Push(virtualEpoch.Add(211*time.Second), []byte("x"), emit); !errors.Is(err, ErrHangup) {
+		t.Errorf("push after 61s idle = %v, want ErrHangup", err)
+	}
+	if err := up.Push(virtualEpoch.Add(212*time.Second), []byte("x"), emit); !errors.Is(err, ErrHangup) {
+		t.Errorf("push in the other direction = %v, want ErrHangup", err)
+	}
+}
+
+// TestShaperHangup checks that Run returns ErrHangup, even while
+// draining, once data has been stuck long enough.
+func TestShaperHangup(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	s := NewShaper(ShaperConfig{
+		Outages: &OutageSchedule{Fixed: []Outage{{0, time.Hour}}},
+		Hangup:  NewHangup(10*time.Second, 0),
+		Clock:   fc,
+	})
+	dst := &clockWriter{clock: fc}
+	done := startVirtual(s, dst, strings.NewReader("lost"))
+	var err error
+	stepUntil(t, fc, func() bool {
+		select {
+		case err = <-done:
+			return true
+		default:
+			return false
+		}
+	})
+	if !errors.Is(err, ErrHangup) || dst.count() != 0 {
+		t.Errorf("Run = %v after %d writes, want ErrHangup and nothing written", err, dst.count())
+	}
+	if got := fc.Now().Sub(virtualEpoch); got != 10*time.Second {
+		t.Errorf("hung up at %v, want 10s", got)
+	}
+}
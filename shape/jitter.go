@@ -0,0 +1,206 @@
+package shape
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// JitterDistribution is the shape of the random variation added to each
+// chunk's delay. ShaperConfig.Jitter sets its scale.
+//
+// Every distribution has a mean of zero, so Delay stays the average delay
+// whichever is chosen, and none takes more than Jitter off it (except
+// normal, whose lower tail is only cut off at zero delay). The tailed
+// distributions keep most chunks a little early and make a few very late,
+// as on real wireless and congested links.
+type JitterDistribution int
+
+const (
+	// JitterUniform spreads delays evenly over Delay ± Jitter.
+	JitterUniform JitterDistribution = iota
+	// JitterNormal uses a normal distribution with standard deviation
+	// Jitter.
+	JitterNormal
+	// JitterLogNormal uses a lognormal distribution with mean Jitter,
+	// shifted down by Jitter. JitterShape is the σ of the underlying normal
+	// (default 1); larger values give a longer tail.
+	JitterLogNormal
+	// JitterPareto uses a Pareto (Lomax) distribution with mean Jitter,
+	// shifted down by Jitter. JitterShape is the tail index α (default 2,
+	// must be above 1); smaller values give a heavier tail.
+	JitterPareto
+	// JitterExponential uses an exponential distribution with mean Jitter,
+	// shifted down by Jitter.
+	JitterExponential
+)
+
+// Shape defaults and limits for the tailed distributions
+const (
+	defaultLogNormalSigma = 1.0
+	defaultParetoAlpha    = 2.0
+
+	// maxJitterTail caps a single sample at this many times Jitter above
+	// the mean, so one freak draw cannot stall an ordered stream for
+	// minutes.
+	maxJitterTail = 50
+
+	// maxJitterCorrelation keeps JitterCorrelation below 1, where the
+	// jitter would never change again.
+	maxJitterCorrelation = 0.999
+)
+
+var jitterDistributionNames = map[JitterDistribution]string{
+	JitterUniform:     "uniform",
+	JitterNormal:      "normal",
+	JitterLogNormal:   "lognormal",
+	JitterPareto:      "pareto",
+	JitterExponential: "exponential",
+}
+
+func (d JitterDistribution) String() string {
+	if name, ok := jitterDistributionNames[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("JitterDistribution(%d)", int(d))
+}
+
+// ParseJitterDistribution parses "uniform", "normal", "lognormal",
+// "pareto" and "exponential" (or "exp").
+func ParseJitterDistribution(s string) (JitterDistribution, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "exp" {
+		return JitterExponential, nil
+	}
+	for d, name := range jitterDistributionNames {
+		if s == name {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown jitter distribution: %s", s)
+}
+
+// jitterSampler draws jitter from a distribution using a Shaper's seeded
+// random source, so a given Seed always yields the same sequence. With
+// Latency set, the jitter is a draw from it less its mean, which the delay
+// stage uses as the base delay.
+//
+// With JitterCorrelation set, draws are correlated through a Gaussian
+// copula: an AR(1) process z(n) = ρ·z(n-1) + √(1-ρ²)·ε(n) keeps a standard
+// normal value that wanders from chunk to chunk, and each draw is the
+// distribution's quantile at Φ(z). Consecutive chunks see similar delays,
+// yet every draw still follows the chosen distribution, tail included;
+// netem's correlation, by contrast, averages samples and so narrows the
+// distribution as correlation grows.
+type jitterSampler struct {
+	latency *LatencyDistribution
+	dist    JitterDistribution
+	scale   time.Duration // Jitter
+	shape   float64       // JitterShape, with the default applied
+	corr    float64       // JitterCorrelation, clamped to [0, maxJitterCorrelation]
+	z       float64       // AR(1) state when correlated
+	primed  bool          // z holds a value
+	rng     *rand.Rand
+}
+
+func newJitterSampler(cfg ShaperConfig, rng *rand.Rand) jitterSampler {
+	j := jitterSampler{rng: rng}
+	j.configure(cfg)
+	return j
+}
+
+// configure adopts the distribution and parameters in cfg.
+func (j *jitterSampler) configure(cfg ShaperConfig) {
+	j.latency = cfg.Latency
+	j.dist, j.scale, j.shape = cfg.JitterDist, cfg.Jitter, cfg.JitterShape
+	j.corr = math.Max(0, math.Min(cfg.JitterCorrelation, maxJitterCorrelation))
+	switch j.dist {
+	case JitterLogNormal:
+		if j.shape <= 0 {
+			j.shape = defaultLogNormalSigma
+		}
+	case JitterPareto:
+		if j.shape <= 1 {
+			j.shape = defaultParetoAlpha
+		}
+	}
+}
+
+// sample returns the jitter for the next chunk.
+func (j *jitterSampler) sample() time.Duration {
+	if j.corr > 0 && (j.latency != nil || j.scale > 0) {
+		return j.correlated()
+	}
+	if j.latency != nil {
+		return j.latency.Sample(j.rng) - j.latency.Mean()
+	}
+	if j.scale <= 0 {
+		return 0
+	}
+	if j.dist == JitterUniform {
+		// Generate random value in range [0, 2*jitter], then subtract jitter
+		jitterRange := int64(j.scale) * 2
+		return time.Duration(j.rng.Int63n(jitterRange)) - j.scale
+	}
+
+	// The rest are drawn in units of Jitter
+	var x float64
+	switch j.dist {
+	case JitterNormal:
+		x = j.rng.NormFloat64()
+	case JitterLogNormal:
+		// exp(μ + σZ) has mean exp(μ + σ²/2), which must be 1
+		mu := -j.shape * j.shape / 2
+		x = math.Exp(mu+j.shape*j.rng.NormFloat64()) - 1
+	case JitterPareto:
+		// Lomax with scale α-1 has mean 1; 1-Float64 is in (0, 1]
+		u := 1 - j.rng.Float64()
+		x = (j.shape-1)*(math.Pow(u, -1/j.shape)-1) - 1
+	case JitterExponential:
+		x = j.rng.ExpFloat64() - 1
+	}
+	x = math.Max(-maxJitterTail, math.Min(x, maxJitterTail))
+	return time.Duration(x * float64(j.scale))
+}
+
+// correlated advances the AR(1) state and returns the jitter at its
+// quantile.
+func (j *jitterSampler) correlated() time.Duration {
+	if j.primed {
+		j.z = j.corr*j.z + math.Sqrt(1-j.corr*j.corr)*j.rng.NormFloat64()
+	} else {
+		j.z, j.primed = j.rng.NormFloat64(), true
+	}
+	z := j.z
+	if j.latency != nil {
+		return j.latency.Quantile(normalCDF(z)) - j.latency.Mean()
+	}
+
+	// As in sample, in units of Jitter; upper is 1-Φ(z), which keeps its
+	// precision far out in the tail
+	var x float64
+	switch j.dist {
+	case JitterUniform:
+		x = 2*normalCDF(z) - 1
+	case JitterNormal:
+		x = z
+	case JitterLogNormal:
+		mu := -j.shape * j.shape / 2
+		x = math.Exp(mu+j.shape*z) - 1
+	case JitterPareto:
+		upper := normalCDF(-z)
+		x = (j.shape-1)*(math.Pow(upper, -1/j.shape)-1) - 1
+	case JitterExponential:
+		upper := normalCDF(-z)
+		x = -math.Log(upper) - 1
+	}
+	x = math.Max(-maxJitterTail, math.Min(x, maxJitterTail))
+	return time.Duration(x * float64(j.scale))
+}
+
+// normalCDF returns Φ(z), the standard normal distribution function.
+func normalCDF(z float64) float64 {
+	return math.Erfc(-z/math.Sqrt2) / 2
+}
@@ -0,0 +1,158 @@
+package shape
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseJitterDistribution(t *testing.T) {
+	for d := JitterUniform; d <= JitterExponential; d++ {
+		got, err := ParseJitterDistribution(d.String())
+		if err != nil || got != d {
+			t.Errorf("ParseJitterDistribution(%q) = %v, %v", d.String(), got, err)
+		}
+	}
+	if got, _ := ParseJitterDistribution("exp"); got != JitterExponential {
+		t.Errorf("ParseJitterDistribution(exp) = %v", got)
+	}
+	if _, err := ParseJitterDistribution("cauchy"); err == nil {
+		t.Error("ParseJitterDistribution(cauchy) succeeded, want an error")
+	}
+}
+
+// TestJitterDistributions draws many samples from each distribution and
+// checks the properties the profiles rely on: a mean of zero, nothing more
+// than Jitter below it (normal aside), and a tail well beyond Jitter for
+// the tailed shapes.
+func TestJitterDistributions(t *testing.T) {
+	const (
+		jitter = 10 * time.Millisecond
+		n      = 200000
+	)
+	tests := []struct {
+		dist     JitterDistribution
+		bounded  bool          // Never below -jitter
+		minP999  time.Duration // 99.9th percentile at least this
+		maxP999  time.Duration // ...and at most this
+		meanSlop time.Duration
+	}{
+		{JitterUniform, true, 9 * time.Millisecond, jitter, 100 * time.Microsecond},
+		{JitterNormal, false, 30 * time.Millisecond, 33 * time.Millisecond, 100 * time.Microsecond},
+		{JitterLogNormal, true, 80 * time.Millisecond, 160 * time.Millisecond, 300 * time.Microsecond},
+		{JitterPareto, true, 200 * time.Millisecond, 400 * time.Millisecond, 500 * time.Microsecond},
+		{JitterExponential, true, 55 * time.Millisecond, 65 * time.Millisecond, 200 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dist.String(), func(t *testing.T) {
+			j := newJitterSampler(ShaperConfig{Jitter: jitter, JitterDist: tt.dist}, rand.New(rand.NewSource(1)))
+			samples := make([]time.Duration, n)
+			var sum time.Duration
+			for i := range samples {
+				samples[i] = j.sample()
+				sum += samples[i]
+			}
+			slices.Sort(samples)
+
+			if mean := sum / n; mean < -tt.meanSlop || mean > tt.meanSlop {
+				t.Errorf("mean %v, want 0 ± %v", mean, tt.meanSlop)
+			}
+			if tt.bounded && samples[0] < -jitter {
+				t.Errorf("min %v below -%v", samples[0], jitter)
+			}
+			if p := samples[n*999/1000]; p < tt.minP999 || p > tt.maxP999 {
+				t.Errorf("99.9th percentile %v, want %v to %v", p, tt.minP999, tt.maxP999)
+			}
+			if max := samples[n-1]; max > maxJitterTail*jitter {
+				t.Errorf("max %v beyond the %dx cap", max, maxJitterTail)
+			}
+		})
+	}
+}
+
+// TestJitterSeedDeterministic checks that every distribution yields the
+// same sequence for the same seed, correlated or not.
+func TestJitterSeedDeterministic(t *testing.T) {
+	for d := JitterUniform; d <= JitterExponential; d++ {
+		for _, corr := range []float64{0, 0.8} {
+			cfg := ShaperConfig{Jitter: 50 * time.Millisecond, JitterDist: d, JitterCorrelation: corr}
+			a := newJitterSampler(cfg, rand.New(rand.NewSource(42)))
+			b := newJitterSampler(cfg, rand.New(rand.NewSource(42)))
+			for i := 0; i < 100; i++ {
+				if x, y := a.sample(), b.sample(); x != y {
+					t.Fatalf("%v (correlation %v): sample %d differs with the same seed: %v vs %v", d, corr, i, x, y)
+				}
+			}
+		}
+	}
+}
+
+// TestJitterCorrelation checks that correlated jitter drifts, with about
+// the requested lag-1 autocorrelation, while every distribution keeps its
+// mean, lower bound and tail.
+func TestJitterCorrelation(t *testing.T) {
+	const (
+		jitter = 10 * time.Millisecond
+		n      = 200000
+	)
+	for d := JitterUniform; d <= JitterExponential; d++ {
+		t.Run(d.String(), func(t *testing.T) {
+			cfg := ShaperConfig{Jitter: jitter, JitterDist: d, JitterCorrelation: 0.5}
+			j := newJitterSampler(cfg, rand.New(rand.NewSource(1)))
+			samples := make([]float64, n)
+			for i := range samples {
+				samples[i] = float64(j.sample()) / float64(jitter)
+			}
+			mean, r := lag1(samples)
+			if mean < -0.05 || mean > 0.05 {
+				t.Errorf("mean %.3f×jitter, want 0", mean)
+			}
+			// The copula keeps rank correlation; the linear one is lower for
+			// the skewed shapes
+			if r < 0.2 || r > 0.55 {
+				t.Errorf("lag-1 autocorrelation %.3f, want about 0.5", r)
+			}
+			slices.Sort(samples)
+			if d != JitterNormal && samples[0] < -1 {
+				t.Errorf("min %.3f×jitter below -jitter", samples[0])
+			}
+		})
+	}
+
+	// Without correlation, draws are independent
+	j := newJitterSampler(ShaperConfig{Jitter: jitter, JitterDist: JitterNormal}, rand.New(rand.NewSource(1)))
+	samples := make([]float64, n)
+	for i := range samples {
+		samples[i] = float64(j.sample()) / float64(jitter)
+	}
+	if _, r := lag1(samples); r < -0.02 || r > 0.02 {
+		t.Errorf("uncorrelated lag-1 autocorrelation %.3f, want 0", r)
+	}
+
+	// Strong correlation applies to measured latency too
+	latency, _ := NewLatencyDistribution([]time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 100 * time.Millisecond})
+	j = newJitterSampler(ShaperConfig{Latency: latency, JitterCorrelation: 0.95}, rand.New(rand.NewSource(1)))
+	for i := range samples {
+		samples[i] = float64(j.sample())
+	}
+	if _, r := lag1(samples); r < 0.85 {
+		t.Errorf("latency lag-1 autocorrelation %.3f, want about 0.95", r)
+	}
+}
+
+// lag1 returns the mean and lag-1 autocorrelation of xs.
+func lag1(xs []float64) (mean, r float64) {
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+	var num, den float64
+	for i, x := range xs {
+		den += (x - mean) * (x - mean)
+		if i > 0 {
+			num += (x - mean) * (xs[i-1] - mean)
+		}
+	}
+	return mean, num / den
+}
@@ -0,0 +1,342 @@
+package shape
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LatencyDistribution is an empirical latency distribution, built from
+// measured samples or a histogram. Set as ShaperConfig.Latency, each chunk's
+// delay is drawn from it instead of from Delay and Jitter, so a Shaper can
+// reproduce a link that was actually measured.
+//
+// Sampling interpolates linearly between the measured values, so draws are
+// continuous but never fall outside the smallest and largest of them. A
+// LatencyDistribution is immutable and safe to share between Shapers.
+type LatencyDistribution struct {
+	values []time.Duration // Sorted
+	cum    []float64       // Cumulative weight up to the middle of each value
+	total  float64
+	mean   time.Duration
+}
+
+// NewLatencyDistribution returns the distribution of samples, each counted
+// once.
+func NewLatencyDistribution(samples []time.Duration) (*LatencyDistribution, error) {
+	weights := make([]float64, len(samples))
+	for i := range weights {
+		weights[i] = 1
+	}
+	return NewLatencyHistogram(samples, weights)
+}
+
+// NewLatencyHistogram returns the distribution of a histogram: values[i]
+// was seen counts[i] times.
+func NewLatencyHistogram(values []time.Duration, counts []float64) (*LatencyDistribution, error) {
+	if len(values) != len(counts) {
+		return nil, errors.New("latency histogram: values and counts differ in length")
+	}
+	type point struct {
+		v time.Duration
+		w float64
+	}
+	points := make([]point, 0, len(values))
+	for i, v := range values {
+		switch {
+		case v < 0:
+			return nil, fmt.Errorf("latency histogram: negative latency %v", v)
+		case counts[i] < 0 || math.IsNaN(counts[i]) || math.IsInf(counts[i], 0):
+			return nil, fmt.Errorf("latency histogram: invalid count %v for %v", counts[i], v)
+		case counts[i] > 0:
+			points = append(points, point{v, counts[i]})
+		}
+	}
+	if len(points) == 0 {
+		return nil, errors.New("latency histogram: no samples")
+	}
+	slices.SortFunc(points, func(a, b point) int { return int(a.v - b.v) })
+
+	d := &LatencyDistribution{
+		values: make([]time.Duration, len(points)),
+		cum:    make([]float64, len(points)),
+	}
+	var sum float64
+	for i, p := range points {
+		d.values[i] = p.v
+		d.cum[i] = d.total + p.w/2
+		d.total += p.w
+		sum += float64(p.v) * p.w
+	}
+	d.mean = time.Duration(sum / d.total)
+	return d, nil
+}
+
+// Mean returns the mean latency.
+func (d *LatencyDistribution) Mean() time.Duration { return d.mean }
+
+// Quantile returns the latency below which a fraction q (0 ≤ q ≤ 1) of
+// draws fall.
+func (d *LatencyDistribution) Quantile(q float64) time.Duration {
+	return d.at(math.Max(0, math.Min(q, 1)) * d.total)
+}
+
+// Sample draws a latency using rng.
+func (d *LatencyDistribution) Sample(rng *rand.Rand) time.Duration {
+	return d.at(rng.Float64() * d.total)
+}
+
+// Scale returns the distribution with every latency multiplied by f, for
+// example 0.5 to turn round-trip times into one-way delays.
+func (d *LatencyDistribution) Scale(f float64) *LatencyDistribution {
+	s := &LatencyDistribution{
+		values: make([]time.Duration, len(d.values)),
+		cum:    d.cum,
+		total:  d.total,
+		mean:   time.Duration(float64(d.mean) * f),
+	}
+	for i, v := range d.values {
+		s.values[i] = time.Duration(float64(v) * f)
+	}
+	return s
+}
+
+// at returns the latency at cumulative weight u, interpolating between the
+// neighbouring values.
+func (d *LatencyDistribution) at(u float64) time.Duration {
+	i, _ := slices.BinarySearch(d.cum, u)
+	switch {
+	case i == 0:
+		return d.values[0]
+	case i == len(d.values):
+		return d.values[len(d.values)-1]
+	}
+	lo, hi := d.cum[i-1], d.cum[i]
+	frac := (u - lo) / (hi - lo)
+	return d.values[i-1] + time.Duration(frac*float64(d.values[i]-d.values[i-1]))
+}
+
+// baseDelay returns the mean delay cfg gives each chunk: Delay, or the
+// mean of Latency when that is set.
+func baseDelay(cfg ShaperConfig) time.Duration {
+	if cfg.Latency != nil {
+		return cfg.Latency.Mean()
+	}
+	return cfg.Delay
+}
+
+// Latency file formats recognised by ReadLatencyDistribution
+var (
+	// "time=12.3 ms" (Linux, macOS, BSD ping), "time<1ms" (Windows)
+	pingTimeRe = regexp.MustCompile(`\btime[=<]([0-9.]+)\s*(ms|s|us|µs)?`)
+	// "p <hop> <microseconds>" from mtr --raw
+	mtrRawRe = regexp.MustCompile(`^p\s+(\d+)\s+(\d+)`)
+	// "  3.|-- host  0.0%  10  23.1  24.0  22.5  27.9  1.6" from mtr --report
+	mtrReportRe = regexp.MustCompile(`^\s*\d+\.\s*\|--\s+\S+\s+([0-9.]+)%?\s+(\d+)\s+([0-9.]+)\s+([0-9.]+)\s+([0-9.]+)\s+([0-9.]+)\s+([0-9.]+)`)
+)
+
+// ReadLatencyDistribution reads latency measurements in any of these
+// formats, detected from the content:
+//
+//   - ping output: every "time=12.3 ms" reply line is a sample
+//   - mtr --raw output: the ping samples ("p" lines) of the last hop
+//   - mtr --report output: the last hop's Avg and StDev, as a normal
+//     distribution cut off at its Best and Wrst
+//   - a list or CSV of samples, one per line; with a header, the column
+//     named rtt, latency, time, delay or ms, otherwise the first
+//   - a histogram: a CSV whose header has a count (or frequency) column,
+//     each row giving a latency and how often it was seen
+//
+// Values without a unit are in milliseconds; "12.3ms", "800us" and "1.2s"
+// are also accepted. Blank lines and lines starting with # are ignored.
+func ReadLatencyDistribution(r io.Reader) (*LatencyDistribution, error) {
+	var lines []string
+	var lineNums []int // Line numbers of lines in the file, for errors
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		if line := strings.TrimSpace(sc.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, sc.Text())
+			lineNums = append(lineNums, n)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("latency file: no data")
+	}
+
+	for _, line := range lines {
+		switch {
+		case pingTimeRe.MatchString(line):
+			return parsePing(lines)
+		case mtrRawRe.MatchString(strings.TrimSpace(line)):
+			return parseMtrRaw(lines)
+		case mtrReportRe.MatchString(line):
+			return parseMtrReport(lines)
+		}
+	}
+	return parseLatencyCSV(lines, lineNums)
+}
+
+func parsePing(lines []string) (*LatencyDistribution, error) {
+	var samples []time.Duration
+	for _, line := range lines {
+		m := pingTimeRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		d, err := parseLatency(m[1] + m[2])
+		if err != nil {
+			return nil, fmt.Errorf("ping output: %w", err)
+		}
+		samples = append(samples, d)
+	}
+	return NewLatencyDistribution(samples)
+}
+
+func parseMtrRaw(lines []string) (*LatencyDistribution, error) {
+	byHop := map[int][]time.Duration{}
+	last := -1
+	for _, line := range lines {
+		m := mtrRawRe.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		hop, _ := strconv.Atoi(m[1])
+		us, _ := strconv.ParseInt(m[2], 10, 64)
+		byHop[hop] = append(byHop[hop], time.Duration(us)*time.Microsecond)
+		last = max(last, hop)
+	}
+	return NewLatencyDistribution(byHop[last])
+}
+
+// mtrReportPoints is how many points approximate an mtr report's normal
+// distribution.
+const mtrReportPoints = 41
+
+func parseMtrReport(lines []string) (*LatencyDistribution, error) {
+	var fields []float64
+	for _, line := range lines {
+		m := mtrReportRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		loss, _ := strconv.ParseFloat(m[1], 64)
+		if loss >= 100 {
+			continue // Hop never answered
+		}
+		fields = fields[:0]
+		for _, s := range m[4:] { // Avg, Best, Wrst, StDev
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("mtr report: %w", err)
+			}
+			fields = append(fields, f)
+		}
+	}
+	if fields == nil {
+		return nil, errors.New("mtr report: no responding hop")
+	}
+
+	avg, best, worst, stdev := fields[0], fields[1], fields[2], fields[3]
+	ms := func(f float64) time.Duration { return time.Duration(f * float64(time.Millisecond)) }
+	if stdev <= 0 || worst <= best {
+		return NewLatencyDistribution([]time.Duration{ms(avg)})
+	}
+	values := make([]time.Duration, mtrReportPoints)
+	counts := make([]float64, mtrReportPoints)
+	for i := range values {
+		x := best + (worst-best)*float64(i)/(mtrReportPoints-1)
+		z := (x - avg) / stdev
+		values[i], counts[i] = ms(x), math.Exp(-z*z/2)
+	}
+	return NewLatencyHistogram(values, counts)
+}
+
+// parseLatencyCSV parses a list, CSV or histogram. lineNums holds each
+// line's number in the file.
+func parseLatencyCSV(lines []string, lineNums []int) (*LatencyDistribution, error) {
+	valueCol, countCol := 0, -1
+	header := splitFields(lines[0])
+	if len(header) == 0 {
+		return nil, fmt.Errorf("latency file line %d: no values", lineNums[0])
+	}
+	if _, err := parseLatency(header[0]); err != nil {
+		valueCol = -1
+		for i, name := range header {
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "count", "frequency", "freq", "n":
+				countCol = i
+			case "rtt", "latency", "time", "delay", "ms", "value", "bucket":
+				if valueCol < 0 {
+					valueCol = i
+				}
+			}
+		}
+		if valueCol < 0 {
+			valueCol = 0
+			if countCol == 0 {
+				valueCol = 1
+			}
+		}
+		lines, lineNums = lines[1:], lineNums[1:]
+	}
+
+	var values []time.Duration
+	var counts []float64
+	for i, line := range lines {
+		n := lineNums[i]
+		fields := splitFields(line)
+		switch {
+		case len(fields) == 0:
+			return nil, fmt.Errorf("latency file line %d: no values", n)
+		case valueCol >= len(fields) || countCol >= len(fields):
+			return nil, fmt.Errorf("latency file line %d: too few columns", n)
+		}
+		v, err := parseLatency(fields[valueCol])
+		if err != nil {
+			return nil, fmt.Errorf("latency file line %d: %w", n, err)
+		}
+		c := 1.0
+		if countCol >= 0 {
+			if c, err = strconv.ParseFloat(strings.TrimSpace(fields[countCol]), 64); err != nil {
+				return nil, fmt.Errorf("latency file line %d: invalid count %q", n, fields[countCol])
+			}
+		}
+		values = append(values, v)
+		counts = append(counts, c)
+	}
+	return NewLatencyHistogram(values, counts)
+}
+
+// splitFields splits a CSV, TSV or whitespace-separated line.
+func splitFields(line string) []string {
+	return strings.FieldsFunc(line, func(r rune) bool {
+		return r == ',' || r == ';' || r == '\t' || r == ' '
+	})
+}
+
+// parseLatency parses a latency in milliseconds, or with a unit.
+func parseLatency(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if ms, err := strconv.ParseFloat(s, 64); err == nil {
+		if ms < 0 || math.IsNaN(ms) || math.IsInf(ms, 0) {
+			return 0, fmt.Errorf("invalid latency %q", s)
+		}
+		return time.Duration(ms * float64(time.Millisecond)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid latency %q", s)
+	}
+	return d, nil
+}
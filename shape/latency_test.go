@@ -0,0 +1,178 @@
+package shape
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadLatencyDistribution(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		min, max time.Duration
+		mean     time.Duration
+	}{
+		{
+			name: "linux ping",
+			input: `PING 1.1.1.1 (1.1.1.1) 56(84) bytes of data.
+64 bytes from 1.1.1.1: icmp_seq=1 ttl=57 time=10.0 ms
+64 bytes from 1.1.1.1: icmp_seq=2 ttl=57 time=20.0 ms
+64 bytes from 1.1.1.1: icmp_seq=4 ttl=57 time=30.0 ms
+
+--- 1.1.1.1 ping statistics ---
+4 packets transmitted, 3 received, 25% packet loss, time 3004ms
+rtt min/avg/max/mdev = 10.0/20.0/30.0/8.165 ms`,
+			min: 10 * time.Millisecond, max: 30 * time.Millisecond, mean: 20 * time.Millisecond,
+		},
+		{
+			name: "windows ping",
+			input: `Reply from 1.1.1.1: bytes=32 time<1ms TTL=57
+Reply from 1.1.1.1: bytes=32 time=3ms TTL=57`,
+			min: time.Millisecond, max: 3 * time.Millisecond, mean: 2 * time.Millisecond,
+		},
+		{
+			name: "mtr raw",
+			input: `x 0 33000
+h 0 192.168.1.1
+p 0 1500 33000
+h 1 203.0.113.7
+p 1 40000 33001
+p 1 60000 33002
+p 0 2500 33003`,
+			min: 40 * time.Millisecond, max: 60 * time.Millisecond, mean: 50 * time.Millisecond,
+		},
+		{
+			name: "mtr report",
+			input: `Start: 2026-10-16T09:00:00+0000
+HOST: laptop                      Loss%   Snt   Last   Avg  Best  Wrst StDev
+  1.|-- 192.168.1.1                0.0%    10    1.2   1.3   1.1   1.6   0.1
+  2.|-- ???                       100.0    10    0.0   0.0   0.0   0.0   0.0
+  3.|-- 203.0.113.7                0.0%    10   80.0  80.0  70.0  90.0   5.0
+  4.|-- ???                       100.0    10    0.0   0.0   0.0   0.0   0.0`,
+			min: 70 * time.Millisecond, max: 90 * time.Millisecond, mean: 80 * time.Millisecond,
+		},
+		{
+			name:  "list",
+			input: "# RTTs in ms\n5\n15\n\n10ms\n",
+			min:   5 * time.Millisecond, max: 15 * time.Millisecond, mean: 10 * time.Millisecond,
+		},
+		{
+			name:  "csv with header",
+			input: "timestamp,rtt\n1700000000,100\n1700000001,300\n",
+			min:   100 * time.Millisecond, max: 300 * time.Millisecond, mean: 200 * time.Millisecond,
+		},
+		{
+			name:  "histogram",
+			input: "rtt_bucket,count\n10,3\n50,1\n90,0\n",
+			min:   10 * time.Millisecond, max: 50 * time.Millisecond, mean: 20 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := ReadLatencyDistribution(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("ReadLatencyDistribution failed: %v", err)
+			}
+			if got := d.Quantile(0); got != tt.min {
+				t.Errorf("min %v, want %v", got, tt.min)
+			}
+			if got := d.Quantile(1); got != tt.max {
+				t.Errorf("max %v, want %v", got, tt.max)
+			}
+			if got := d.Mean(); got != tt.mean {
+				t.Errorf("mean %v, want %v", got, tt.mean)
+			}
+		})
+	}
+}
+
+func TestReadLatencyDistributionErrors(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"# nothing but comments\n",
+		"rtt\n",
+		"rtt\n12\nfast\n",
+		"rtt,count\n10,many\n",
+		"-5\n",
+		",,,\n12\n",
+		"12\n ; \n",
+		"PING 10.0.0.1 (10.0.0.1) 56(84) bytes of data.\nRequest timeout for icmp_seq 0\n",
+	} {
+		if _, err := ReadLatencyDistribution(strings.NewReader(input)); err == nil {
+			t.Errorf("ReadLatencyDistribution(%q) succeeded, want an error", input)
+		}
+	}
+
+	// Errors give the line in the file, comments, blanks and header included
+	_, err := ReadLatencyDistribution(strings.NewReader("# ping export\n\nrtt\n12\n\nfast\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 6:") {
+		t.Errorf("error %v, want it at line 6", err)
+	}
+}
+
+// TestLatencyDistributionSample checks that draws follow the measured
+// distribution: a bimodal sample set should yield mostly values near its two
+// modes, in the right proportion, and nothing outside its range.
+func TestLatencyDistributionSample(t *testing.T) {
+	var samples []time.Duration
+	for i := 0; i < 90; i++ {
+		samples = append(samples, 20*time.Millisecond+time.Duration(i%3)*time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		samples = append(samples, 200*time.Millisecond+time.Duration(i%3)*time.Millisecond)
+	}
+	d, err := NewLatencyDistribution(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 100000
+	rng := rand.New(rand.NewSource(1))
+	var fast, slow int
+	for i := 0; i < n; i++ {
+		v := d.Sample(rng)
+		switch {
+		case v < 20*time.Millisecond || v > 202*time.Millisecond:
+			t.Fatalf("sample %v outside the measured range", v)
+		case v <= 22*time.Millisecond:
+			fast++
+		case v >= 200*time.Millisecond:
+			slow++
+		}
+	}
+	// Only the half-sample on each side of the gap is spread across it
+	if f := float64(fast) / n; f < 0.88 || f > 0.91 {
+		t.Errorf("%.3f of samples near 20ms, want about 0.9", f)
+	}
+	if f := float64(slow) / n; f < 0.09 || f > 0.11 {
+		t.Errorf("%.3f of samples near 200ms, want about 0.1", f)
+	}
+
+	half := d.Scale(0.5)
+	if half.Mean() != d.Mean()/2 || half.Quantile(1) != 101*time.Millisecond {
+		t.Errorf("Scale(0.5): mean %v, max %v", half.Mean(), half.Quantile(1))
+	}
+}
+
+// TestShaperLatency checks that a Shaper with Latency set delays data by a
+// draw from it, ignoring Delay and Jitter.
+func TestShaperLatency(t *testing.T) {
+	latency, err := NewLatencyDistribution([]time.Duration{250 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+	cfg := ShaperConfig{Delay: time.Second, Jitter: time.Second, Latency: latency}
+	if err := copyVirtual(t, fc, dst, strings.NewReader("hello"), cfg); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if len(dst.writes) != 1 || dst.String() != "hello" {
+		t.Fatalf("writes %v, want hello once", dst.writes)
+	}
+	if got := dst.writes[0].t.Sub(virtualEpoch); got != 250*time.Millisecond {
+		t.Errorf("data delayed %v, want 250ms", got)
+	}
+}
@@ -0,0 +1,159 @@
+package shape
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TCP recovery parameters for the loss model
+const (
+	segmentSize     = 1448                   // TCP payload per segment: 1500-byte MTU less IP, TCP and timestamp headers
+	dupAckThreshold = 3                      // Duplicate ACKs that trigger a fast retransmit
+	minRTO          = 200 * time.Millisecond // Linux's minimum retransmission timeout
+	maxRTO          = 120 * time.Second      // Linux's maximum retransmission timeout
+	maxLoss         = 0.99                   // Loss is capped here: at 1 nothing would ever arrive
+)
+
+// lossModel turns packet loss into what it looks like on a TCP stream: no
+// bytes go missing, but a lost segment holds itself and everything behind
+// it back until it is retransmitted.
+//
+// Each chunk is cut into segments and each segment is lost or not, either
+// independently (Bernoulli) or in bursts (Gilbert-Elliott). A lost segment
+// stalls its chunk by one RTT if enough data follows it for the receiver's
+// duplicate ACKs to trigger a fast retransmit, and by the retransmission
+// timeout otherwise, as for a lone keystroke. A retransmission can be lost
+// too, and each time the timeout doubles; it goes out at least an RTT
+// later, past any burst, so it is lost independently at the mean rate.
+// Segments lost in the same chunk are recovered together, so the chunk
+// stalls for the longest of them.
+type lossModel struct {
+	rate  float64       // Loss
+	burst float64       // LossBurst
+	rtt   time.Duration // RTT, or twice the base delay
+	bad   bool          // Gilbert-Elliott state: losing segments
+	rng   *rand.Rand
+
+	// Segments sent in the current and previous RTT, to tell a busy stream
+	// (which will send enough for duplicate ACKs) from an idle one
+	winStart  time.Time
+	cur, prev int
+}
+
+func newLossModel(cfg ShaperConfig, rng *rand.Rand) lossModel {
+	l := lossModel{rng: rng}
+	l.configure(cfg)
+	return l
+}
+
+// configure adopts the loss parameters in cfg.
+func (l *lossModel) configure(cfg ShaperConfig) {
+	l.rate = math.Max(0, math.Min(cfg.Loss, maxLoss))
+	l.burst = cfg.LossBurst
+	l.rtt = roundTrip(cfg)
+	if l.burst <= 1 {
+		l.bad = false
+	}
+}
+
+// stall decides the fate of the segments of an n-byte chunk sent at now,
+// and returns how many were lost and how long the chunk is held back for
+// their recovery.
+func (l *lossModel) stall(now time.Time, n int) (lost int, stall time.Duration) {
+	if l.rate <= 0 {
+		return 0, 0
+	}
+	segments := (n + segmentSize - 1) / segmentSize
+	l.advance(now)
+	busy := l.cur + l.prev
+	l.cur += segments
+
+	for i := range segments {
+		if !l.lose() {
+			continue
+		}
+		lost++
+		rto := l.rtt + minRTO
+		var s time.Duration
+		if busy+segments-1-i >= dupAckThreshold {
+			s = l.rtt
+		} else {
+			s, rto = rto, min(2*rto, maxRTO)
+		}
+		for l.rng.Float64() < l.rate {
+			lost++
+			s, rto = s+rto, min(2*rto, maxRTO)
+		}
+		stall = max(stall, s)
+	}
+	return lost, stall
+}
+
+// advance moves the segment count window on to now.
+func (l *lossModel) advance(now time.Time) {
+	window := max(l.rtt, time.Millisecond)
+	if elapsed := now.Sub(l.winStart); elapsed >= window {
+		l.prev = l.cur
+		if elapsed >= 2*window {
+			l.prev = 0
+		}
+		l.cur, l.winStart = 0, now
+	}
+}
+
+// lose reports whether the next segment is lost.
+//
+// The Gilbert-Elliott model loses every segment sent in its bad state and
+// none in its good state. Leaving the bad state with probability 1/burst
+// gives bursts of burst segments on average, and entering it with
+// probability rate/(burst·(1-rate)) makes rate of all segments lost. That
+// probability reaches 1 at rate burst/(1+burst) (see CheckLossBurst);
+// beyond it the model loses less than rate.
+func (l *lossModel) lose() bool {
+	if l.burst <= 1 {
+		return l.rng.Float64() < l.rate
+	}
+	lost := l.bad
+	if l.bad {
+		l.bad = l.rng.Float64() >= 1/l.burst
+	} else {
+		l.bad = l.rng.Float64() < l.rate/(l.burst*(1-l.rate))
+	}
+	return lost
+}
+
+// CheckLossBurst returns an error if a loss rate cannot be reached in
+// bursts of mean length burst (see ShaperConfig.LossBurst): at rates above
+// burst/(1+burst) the good state would have to last less than a segment.
+// Bursts of 1 or less, independent losses, allow any rate ParseLoss does.
+func CheckLossBurst(rate, burst float64) error {
+	// Allow for rounding at the limit itself
+	if burst > 1 && rate/(burst*(1-rate)) > 1+1e-9 {
+		return fmt.Errorf("loss rate %g%% too high for bursts of %g segments (at most %.4g%%)", rate*100, burst, 100*burst/(1+burst))
+	}
+	return nil
+}
+
+// ParseLoss parses a loss rate given as a percentage ("2%", "0.5%") or a
+// fraction ("0.02"). It must be at least 0 and below 1 (100%); with burst
+// loss, CheckLossBurst bounds it further.
+func ParseLoss(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	num, scale := s, 1.0
+	if t, ok := strings.CutSuffix(s, "%"); ok {
+		num, scale = strings.TrimSpace(t), 0.01
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid loss rate: %s", s)
+	}
+	f *= scale
+	if f < 0 || f >= 1 || math.IsNaN(f) {
+		return 0, fmt.Errorf("loss rate out of range: %s (must be at least 0 and below 100%%)", s)
+	}
+	return f, nil
+}
@@ -0,0 +1,178 @@
+package shape
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLoss(t *testing.T) {
+	tests := []struct {
+		input string
+		want  float64
+	}{
+		{"0", 0},
+		{"2%", 0.02},
+		{"0.5 %", 0.005},
+		{"0.02", 0.02},
+	}
+	for _, tt := range tests {
+		got, err := ParseLoss(tt.input)
+		if err != nil || math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("ParseLoss(%q) = %v, %v; want %v", tt.input, got, err, tt.want)
+		}
+	}
+	for _, input := range []string{"", "lots", "100%", "1", "-1%"} {
+		if _, err := ParseLoss(input); err == nil {
+			t.Errorf("ParseLoss(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+// TestCheckLossBurst checks the highest loss rate each burst length can
+// reach: burst/(1+burst), where the good state lasts a single segment.
+func TestCheckLossBurst(t *testing.T) {
+	tests := []struct {
+		rate, burst float64
+		ok          bool
+	}{
+		{0.8, 4, true},
+		{0.81, 4, false},
+		{0.6, 1.5, true},
+		{0.61, 1.5, false},
+		{0.6, 1, true}, // Independent losses
+		{0.99, 0, true},
+	}
+	for _, tt := range tests {
+		if err := CheckLossBurst(tt.rate, tt.burst); (err == nil) != tt.ok {
+			t.Errorf("CheckLossBurst(%v, %v) = %v, want ok %v", tt.rate, tt.burst, err, tt.ok)
+		}
+	}
+
+	// At the limit the model still loses the requested fraction
+	l := newLossModel(ShaperConfig{Loss: 0.8, LossBurst: 4}, rand.New(rand.NewSource(1)))
+	lost := 0
+	const n = 100000
+	for range n {
+		if l.lose() {
+			lost++
+		}
+	}
+	if f := float64(lost) / n; math.Abs(f-0.8) > 0.01 {
+		t.Errorf("lost %.3f of segments at the limit, want 0.8", f)
+	}
+}
+
+// TestLossModelRates checks that both models lose the requested fraction
+// of segments, and that Gilbert-Elliott loses them in bursts of the
+// requested mean length.
+func TestLossModelRates(t *testing.T) {
+	const n = 500000
+	for _, burst := range []float64{0, 4} {
+		l := newLossModel(ShaperConfig{Loss: 0.03, LossBurst: burst}, rand.New(rand.NewSource(1)))
+		var lost, bursts int
+		prev := false
+		for i := 0; i < n; i++ {
+			x := l.lose()
+			if x {
+				lost++
+				if !prev {
+					bursts++
+				}
+			}
+			prev = x
+		}
+		if rate := float64(lost) / n; rate < 0.028 || rate > 0.032 {
+			t.Errorf("burst %v: lost %.4f of segments, want 0.03", burst, rate)
+		}
+		wantBurst := max(1/(1-0.03), burst) // Independent losses still run together now and then
+		if got := float64(lost) / float64(bursts); math.Abs(got-wantBurst) > 0.2 {
+			t.Errorf("burst %v: mean burst %.2f segments, want %.2f", burst, got, wantBurst)
+		}
+	}
+}
+
+// TestLossModelStall checks the stall each kind of loss causes: an idle
+// stream waits for the retransmission timeout, doubled for each lost
+// retransmission, while a busy one recovers by fast retransmit in an RTT.
+func TestLossModelStall(t *testing.T) {
+	const rtt = 100 * time.Millisecond
+	rto := rtt + minRTO
+	allowed := func(first time.Duration) map[time.Duration]bool {
+		// first, then each lost retransmission adds the next timeout
+		ok := map[time.Duration]bool{first: true}
+		s, next := first, rto
+		if first == rto {
+			next = 2 * rto
+		}
+		for i := 0; i < 10; i++ {
+			s, next = s+next, 2*next
+			ok[s] = true
+		}
+		return ok
+	}
+
+	l := newLossModel(ShaperConfig{Loss: 0.2, RTT: rtt}, rand.New(rand.NewSource(1)))
+	now := virtualEpoch
+	idle, busy := allowed(rto), allowed(rtt)
+	var idleLosses int
+	for i := 0; i < 2000; i++ {
+		// A keystroke every 10 RTTs: nothing follows a loss
+		now = now.Add(10 * rtt)
+		if lost, stall := l.stall(now, 1); lost > 0 {
+			idleLosses++
+			if !idle[stall] {
+				t.Fatalf("idle stream stalled %v, want %v backed off", stall, rto)
+			}
+		}
+	}
+	for i := 0; i < 2000; i++ {
+		// A full-sized segment every millisecond: duplicate ACKs follow
+		now = now.Add(time.Millisecond)
+		lost, stall := l.stall(now, segmentSize)
+		if i >= dupAckThreshold && lost > 0 && !busy[stall] {
+			t.Fatalf("busy stream stalled %v, want %v backed off", stall, rtt)
+		}
+	}
+	if idleLosses < 300 {
+		t.Errorf("only %d idle losses, want about 400", idleLosses)
+	}
+}
+
+// TestShaperLoss checks that a lost segment holds its chunk back but never
+// loses data, and that Stats and the Observer account for the stall.
+func TestShaperLoss(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+	obs := &traceObserver{}
+	cfg := ShaperConfig{Delay: 50 * time.Millisecond, Loss: 0.5, Seed: 2, Clock: fc, Observer: obs}
+	s := NewShaper(cfg)
+	done := startVirtual(s, dst, strings.NewReader("hello"))
+	stepUntil(t, fc, func() bool { return dst.count() == 1 })
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if dst.String() != "hello" {
+		t.Fatalf("output %q, want hello", dst.String())
+	}
+	st := s.Stats()
+	if st.SegmentsLost == 0 {
+		t.Fatal("no segment lost; pick another seed")
+	}
+	// One keystroke, nothing behind it: a timeout of RTT + minRTO, doubled
+	// per lost retransmission
+	rto := 100*time.Millisecond + minRTO
+	want := rto * time.Duration(1<<st.SegmentsLost-1)
+	if st.LossStall != want {
+		t.Errorf("stall %v after %d losses, want %v", st.LossStall, st.SegmentsLost, want)
+	}
+	if got := dst.writes[0].t.Sub(virtualEpoch); got != cfg.Delay+want {
+		t.Errorf("written after %v, want %v", got, cfg.Delay+want)
+	}
+	if trace := obs.trace(); len(trace) == 0 || !strings.HasPrefix(trace[0], "0s lost ") {
+		t.Errorf("trace %q does not start with the loss", trace)
+	}
+}
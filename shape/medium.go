@@ -0,0 +1,96 @@
+package shape
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Medium is a half-duplex channel shared by the Shapers for both
+// directions of a link, as on a radio modem or a shared serial line: only
+// one direction sends at a time, and each change of direction costs a
+// turnaround while the line switches over. Typing while output streams
+// then contends with it.
+//
+// The Shapers' rate stages draw on one token bucket, or in SerialMode on
+// one wire clock, held by the Medium. Shapers sharing a Medium should have
+// the same Rate and SerialMode; the bucket follows the last one configured.
+type Medium struct {
+	turnaround time.Duration
+
+	mu      sync.Mutex
+	last    *rateStage    // Direction that sent last
+	limiter *rate.Limiter // Shared token bucket
+	free    time.Time     // Serial mode: when the wire is next free
+}
+
+// NewMedium returns a Medium that takes turnaround to change direction.
+func NewMedium(turnaround time.Duration) *Medium {
+	return &Medium{turnaround: turnaround}
+}
+
+// bucket returns the shared token bucket, created for rt and burst by
+// the first stage to ask.
+func (m *Medium) bucket(rt int64, burst int) *rate.Limiter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.limiter == nil {
+		m.limiter = rate.NewLimiter(rate.Limit(rt), burst)
+	}
+	return m.limiter
+}
+
+// turn charges the bucket for a change of direction to s at now, if s did
+// not send last.
+func (m *Medium) turn(s *rateStage, now time.Time) {
+	if m.last != nil && m.last != s && m.turnaround > 0 {
+		n := int(float64(m.limiter.Limit()) * m.turnaround.Seconds())
+		for burst := m.limiter.Burst(); n > 0; n -= burst {
+			m.limiter.ReserveN(now, min(n, burst))
+		}
+	}
+	m.last = s
+}
+
+// allow takes n tokens for s at now if they, and any turnaround, are
+// available.
+func (m *Medium) allow(s *rateStage, now time.Time, n int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	need := float64(n)
+	if m.last != nil && m.last != s {
+		need += float64(m.limiter.Limit()) * m.turnaround.Seconds()
+	}
+	if m.limiter.TokensAt(now) < need {
+		return false
+	}
+	m.turn(s, now)
+	return m.limiter.AllowN(now, n)
+}
+
+// reserve reserves n tokens for s at now, after any turnaround.
+func (m *Medium) reserve(s *rateStage, now time.Time, n int) *rate.Reservation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.turn(s, now)
+	return m.limiter.ReserveN(now, n)
+}
+
+// claim books the wire for s for d, from at or as soon after as the other
+// direction has finished and the line has turned round, and returns when
+// s may start sending.
+func (m *Medium) claim(s *rateStage, at time.Time, d time.Duration) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	free := m.free
+	if m.last != nil && m.last != s {
+		free = free.Add(m.turnaround)
+	}
+	start := at
+	if free.After(start) {
+		start = free
+	}
+	m.last, m.free = s, start.Add(d)
+	return start
+}
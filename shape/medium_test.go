@@ -0,0 +1,101 @@
+package shape
+
+import (
+	"testing"
+	"time"
+)
+
+// TestMediumTokenBucket checks that the two directions draw on one bucket
+// and pay for turning the line round.
+func TestMediumTokenBucket(t *testing.T) {
+	m := NewMedium(100 * time.Millisecond)
+	cfg := ShaperConfig{Rate: 1000, Medium: m}
+	up, down := newRateStage(cfg, nil, nil), newRateStage(cfg, nil, nil)
+	written := 0
+	emit := func(p []byte) error {
+		written += len(p)
+		return nil
+	}
+
+	// The upstream takes the whole 100-byte burst
+	if err := up.Push(virtualEpoch, make([]byte, 100), emit); err != nil {
+		t.Fatal(err)
+	}
+	if written != 100 {
+		t.Fatalf("wrote %d bytes upstream, want the burst at once", written)
+	}
+
+	// A byte downstream waits for 100 bytes' worth of turnaround, then its
+	// own token
+	if err := down.Push(virtualEpoch, []byte("x"), emit); err != nil {
+		t.Fatal(err)
+	}
+	next, ok := down.Next()
+	if want := virtualEpoch.Add(101 * time.Millisecond); !ok || !next.Equal(want) {
+		t.Errorf("downstream byte due at %v, want %v", next.Sub(virtualEpoch), want.Sub(virtualEpoch))
+	}
+}
+
+// TestMediumSerial checks that in serial mode a direction waits for the
+// other's piece to cross the wire and for the line to turn round.
+func TestMediumSerial(t *testing.T) {
+	m := NewMedium(50 * time.Millisecond)
+	cfg := ShaperConfig{Rate: 1000, SerialMode: true, Medium: m}
+	up, down := newRateStage(cfg, nil, nil), newRateStage(cfg, nil, nil)
+	written := 0
+	emit := func(p []byte) error {
+		written += len(p)
+		return nil
+	}
+
+	// 100 bytes upstream hold the line for 100ms
+	if err := up.Push(virtualEpoch, make([]byte, 100), emit); err != nil {
+		t.Fatal(err)
+	}
+	if err := down.Push(virtualEpoch.Add(10*time.Millisecond), []byte("x"), emit); err != nil {
+		t.Fatal(err)
+	}
+	if next, _ := down.Next(); !next.Equal(virtualEpoch.Add(151 * time.Millisecond)) {
+		t.Errorf("downstream byte due at %v, want 151ms", next.Sub(virtualEpoch))
+	}
+	if last := drainRate(t, up, emit, &written); !last.Equal(virtualEpoch.Add(100 * time.Millisecond)) {
+		t.Errorf("upstream finished at %v, want 100ms", last.Sub(virtualEpoch))
+	}
+
+	// Upstream again: the line turns back once the downstream byte is done
+	if err := up.Push(virtualEpoch.Add(120*time.Millisecond), []byte("y"), emit); err != nil {
+		t.Fatal(err)
+	}
+	if next, _ := up.Next(); !next.Equal(virtualEpoch.Add(202 * time.Millisecond)) {
+		t.Errorf("second upstream byte due at %v, want 202ms", next.Sub(virtualEpoch))
+	}
+}
+
+// TestMediumSerialTakesTurns checks that the wire is booked a piece at a
+// time, so the directions take turns instead of one holding the line.
+func TestMediumSerialTakesTurns(t *testing.T) {
+	m := NewMedium(50 * time.Millisecond)
+	cfg := ShaperConfig{Rate: 1000, SerialMode: true, Medium: m}
+	up, down := newRateStage(cfg, nil, nil), newRateStage(cfg, nil, nil)
+	written := 0
+	emit := func(p []byte) error {
+		written += len(p)
+		return nil
+	}
+	for range 2 {
+		if err := up.Push(virtualEpoch, make([]byte, 50), emit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := down.Push(virtualEpoch.Add(10*time.Millisecond), []byte("x"), emit); err != nil {
+		t.Fatal(err)
+	}
+
+	// Up for 50ms, turn, down for 1ms, turn, up for 50ms
+	if last := drainRate(t, down, emit, &written); !last.Equal(virtualEpoch.Add(101 * time.Millisecond)) {
+		t.Errorf("downstream byte written at %v, want 101ms", last.Sub(virtualEpoch))
+	}
+	if last := drainRate(t, up, emit, &written); !last.Equal(virtualEpoch.Add(201 * time.Millisecond)) {
+		t.Errorf("upstream finished at %v, want 201ms", last.Sub(virtualEpoch))
+	}
+}
@@ -0,0 +1,81 @@
+package shape
+
+import "time"
+
+// Observer receives a Shaper's shaping events as they happen, for traces,
+// test assertions and visualizations. Set it in ShaperConfig.Observer.
+//
+// Methods are called from the goroutine running Shaper.Run, in event order,
+// with the time the Shaper took the event to happen at. They must return
+// quickly and must not call Run; SetConfig and Stats are safe. Embed
+// NopObserver to implement only the events of interest.
+//
+// The events come from the built-in stages; a custom stage that replaces
+// one can report them itself through StageEnv.Config.Observer.
+type Observer interface {
+	// WindowWaitStarted reports the window stage starting to hold data
+	// back, with window bytes already in flight. window is 0 when only
+	// Nagle's algorithm is holding it.
+	WindowWaitStarted(now time.Time, window int)
+
+	// WindowWaitFinished reports the window stage's queue running empty
+	// again after holding data back for waited.
+	WindowWaitFinished(now time.Time, waited time.Duration)
+
+	// ChunkDelayed reports a chunk of size bytes entering the delay queue
+	// at now, with the jitter drawn for it and the time it is due out.
+	ChunkDelayed(now time.Time, size int, jitter time.Duration, due time.Time)
+
+	// SegmentsLost reports lost TCP segments in a chunk entering the delay
+	// queue at now, holding it back by stall for their retransmission. It
+	// comes just before the chunk's ChunkDelayed, whose due time includes
+	// the stall.
+	SegmentsLost(now time.Time, lost int, stall time.Duration)
+
+	// ChunkReleased reports a chunk leaving the delay queue at now.
+	ChunkReleased(now time.Time, size int, due time.Time)
+
+	// BytesWritten reports n bytes written to the destination.
+	BytesWritten(now time.Time, n int)
+
+	// RateWaitStarted reports the rate stage starting to hold data back,
+	// waiting for tokens or for the wire.
+	RateWaitStarted(now time.Time)
+
+	// RateWaitFinished reports the rate stage's queue running empty again
+	// after holding data back for waited.
+	RateWaitFinished(now time.Time, waited time.Duration)
+
+	// FrameFlushed reports a frame of size bytes leaving the frame stage.
+	FrameFlushed(now time.Time, size int)
+
+	// OutageStarted reports the link going down at now until until. An
+	// outage is noticed when data next arrives or is due, so it may be
+	// reported after events from later times.
+	OutageStarted(now time.Time, until time.Time)
+
+	// OutageFinished reports the link coming back at now after an outage
+	// of lasted. Data held during it goes on from here.
+	OutageFinished(now time.Time, lasted time.Duration)
+
+	// DrainStarted reports the source reaching EOF; the Shaper now writes
+	// out what it still holds and returns.
+	DrainStarted(now time.Time)
+}
+
+// NopObserver is an Observer that ignores every event. Embed it in an
+// observer to implement only some of the methods.
+type NopObserver struct{}
+
+func (NopObserver) WindowWaitStarted(now time.Time, window int)                               {}
+func (NopObserver) WindowWaitFinished(now time.Time, waited time.Duration)                    {}
+func (NopObserver) ChunkDelayed(now time.Time, size int, jitter time.Duration, due time.Time) {}
+func (NopObserver) SegmentsLost(now time.Time, lost int, stall time.Duration)                 {}
+func (NopObserver) ChunkReleased(now time.Time, size int, due time.Time)                      {}
+func (NopObserver) BytesWritten(now time.Time, n int)                                         {}
+func (NopObserver) RateWaitStarted(now time.Time)                                             {}
+func (NopObserver) RateWaitFinished(now time.Time, waited time.Duration)                      {}
+func (NopObserver) FrameFlushed(now time.Time, size int)                                      {}
+func (NopObserver) OutageStarted(now time.Time, until time.Time)                              {}
+func (NopObserver) OutageFinished(now time.Time, lasted time.Duration)                        {}
+func (NopObserver) DrainStarted(now time.Time)                                                {}
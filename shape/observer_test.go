@@ -0,0 +1,116 @@
+package shape
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// traceObserver records events as strings, with times relative to
+// virtualEpoch.
+type traceObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *traceObserver) add(now time.Time, format string, args ...any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf("%v ", now.Sub(virtualEpoch))+fmt.Sprintf(format, args...))
+}
+
+func (o *traceObserver) trace() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return slices.Clone(o.events)
+}
+
+func (o *traceObserver) WindowWaitStarted(now time.Time, window int) {
+	o.add(now, "window wait at %d", window)
+}
+func (o *traceObserver) WindowWaitFinished(now time.Time, waited time.Duration) {
+	o.add(now, "window wait done after %v", waited)
+}
+func (o *traceObserver) ChunkDelayed(now time.Time, size int, jitter time.Duration, due time.Time) {
+	o.add(now, "delayed %d jitter=%v due=%v", size, jitter, due.Sub(virtualEpoch))
+}
+func (o *traceObserver) SegmentsLost(now time.Time, lost int, stall time.Duration) {
+	o.add(now, "lost %d stall=%v", lost, stall)
+}
+func (o *traceObserver) ChunkReleased(now time.Time, size int, due time.Time) {
+	o.add(now, "released %d due=%v", size, due.Sub(virtualEpoch))
+}
+func (o *traceObserver) BytesWritten(now time.Time, n int) { o.add(now, "written %d", n) }
+func (o *traceObserver) RateWaitStarted(now time.Time)     { o.add(now, "rate wait") }
+func (o *traceObserver) RateWaitFinished(now time.Time, waited time.Duration) {
+	o.add(now, "rate wait done after %v", waited)
+}
+func (o *traceObserver) FrameFlushed(now time.Time, size int) { o.add(now, "frame %d", size) }
+func (o *traceObserver) OutageStarted(now time.Time, until time.Time) {
+	o.add(now, "outage until %v", until.Sub(virtualEpoch))
+}
+func (o *traceObserver) OutageFinished(now time.Time, lasted time.Duration) {
+	o.add(now, "outage over after %v", lasted)
+}
+func (o *traceObserver) DrainStarted(now time.Time) { o.add(now, "drain") }
+
+// TestShaperObserver traces 20 bytes through a 100ms delay, a 20ms frame
+// and a 100 B/s token bucket with a 10-byte burst.
+func TestShaperObserver(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	obs := &traceObserver{}
+	s := NewShaper(ShaperConfig{
+		Delay: 100 * time.Millisecond, FrameTime: 20 * time.Millisecond, Rate: 100,
+		Clock: fc, Observer: obs,
+	})
+	dst := &clockWriter{clock: fc}
+	done := startVirtual(s, dst, strings.NewReader(strings.Repeat("x", 20)))
+
+	// Let the loop see EOF before time moves, so the drain event is at 0s
+	for len(obs.trace()) < 2 {
+		runtime.Gosched()
+	}
+	stepUntil(t, fc, func() bool { return dst.count() == 2 })
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	want := []string{
+		"0s delayed 20 jitter=0s due=100ms",
+		"0s drain",
+		"100ms released 20 due=100ms",
+		"120ms frame 20",
+		"120ms written 10",
+		"120ms rate wait",
+		"220ms written 10",
+		"220ms rate wait done after 100ms",
+	}
+	if got := obs.trace(); !slices.Equal(got, want) {
+		t.Errorf("trace:\n  %s\nwant:\n  %s", strings.Join(got, "\n  "), strings.Join(want, "\n  "))
+	}
+}
+
+// writeCounter implements only BytesWritten, taking the rest from
+// NopObserver.
+type writeCounter struct {
+	NopObserver
+	n int
+}
+
+func (w *writeCounter) BytesWritten(now time.Time, n int) { w.n += n }
+
+func TestNopObserverEmbedding(t *testing.T) {
+	obs := &writeCounter{}
+	fc := NewFakeClock(virtualEpoch)
+	cfg := ShaperConfig{Delay: time.Millisecond, Observer: obs}
+	if err := copyVirtual(t, fc, &strings.Builder{}, strings.NewReader("hello"), cfg); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if obs.n != 5 {
+		t.Errorf("observer saw %d bytes written, want 5", obs.n)
+	}
+}
@@ -0,0 +1,303 @@
+package shape
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// minOutage is the shortest random outage drawn.
+const minOutage = time.Millisecond
+
+// Outage is a blackout at a fixed time in an OutageSchedule.
+type Outage struct {
+	At       time.Duration // Offset from when the Shaper is built
+	Duration time.Duration
+}
+
+// OutageSchedule describes when a Shaper's link goes dark, as when a train
+// enters a tunnel or a phone drops between cells. Data sent during an
+// outage is held where it enters the link and goes on once it is back,
+// under the usual delay and rate limits; data already on the link when it
+// goes down still arrives.
+//
+// Fixed outages and random ones may be combined; where they overlap the
+// link stays down until the last of them ends. Give both directions the
+// same schedule for a dead link, or one of them alone for a one-way
+// blackout.
+type OutageSchedule struct {
+	Fixed []Outage
+
+	// Random outages begin after idle periods drawn from an exponential
+	// distribution with mean Every, and last for times drawn from one with
+	// mean Length. Every = 0 means none.
+	Every, Length time.Duration
+
+	// Seed seeds the random outages (0 = time-based). Shapers whose
+	// schedules have the same Seed go down together.
+	Seed int64
+}
+
+// ParseOutages parses a comma-separated list of outages: "AT+DURATION" for
+// a fixed outage starting AT after startup, such as "30s+5s", and
+// "random:EVERY:LENGTH" for outages of mean length LENGTH with a mean of
+// EVERY between them, such as "random:10m:8s".
+func ParseOutages(s string) (*OutageSchedule, error) {
+	sched := &OutageSchedule{}
+	for _, item := range strings.Split(strings.ToLower(s), ",") {
+		item = strings.TrimSpace(item)
+		if spec, ok := strings.CutPrefix(item, "random:"); ok {
+			every, length, ok := strings.Cut(spec, ":")
+			if !ok || sched.Every > 0 {
+				return nil, fmt.Errorf("invalid random outages: %s (want one random:EVERY:LENGTH)", item)
+			}
+			var err error
+			if sched.Every, err = time.ParseDuration(every); err != nil || sched.Every <= 0 {
+				return nil, fmt.Errorf("invalid time between outages: %s", every)
+			}
+			if sched.Length, err = time.ParseDuration(length); err != nil || sched.Length <= 0 {
+				return nil, fmt.Errorf("invalid outage length: %s", length)
+			}
+			continue
+		}
+		at, length, ok := strings.Cut(item, "+")
+		if !ok {
+			return nil, fmt.Errorf("invalid outage: %q (want AT+DURATION or random:EVERY:LENGTH)", item)
+		}
+		o := Outage{}
+		var err error
+		if o.At, err = time.ParseDuration(at); err != nil || o.At < 0 {
+			return nil, fmt.Errorf("invalid outage time: %s", at)
+		}
+		if o.Duration, err = time.ParseDuration(length); err != nil || o.Duration <= 0 {
+			return nil, fmt.Errorf("invalid outage duration: %s", length)
+		}
+		sched.Fixed = append(sched.Fixed, o)
+	}
+	return sched, nil
+}
+
+// outageWindow is when one outage holds the link down.
+type outageWindow struct {
+	start, end time.Time
+}
+
+// outageTimeline produces the outages of a schedule in order of their
+// start. Random outages are drawn as they are needed, so the timeline runs
+// for as long as the Shaper does.
+type outageTimeline struct {
+	fixed         []outageWindow // Fixed outages still to come, by start
+	every, length time.Duration
+	rng           *rand.Rand
+	random        outageWindow // Next random outage
+}
+
+func newOutageTimeline(sched *OutageSchedule, start time.Time) *outageTimeline {
+	t := &outageTimeline{every: sched.Every, length: sched.Length}
+	for _, o := range sched.Fixed {
+		at := start.Add(o.At)
+		t.fixed = append(t.fixed, outageWindow{start: at, end: at.Add(o.Duration)})
+	}
+	slices.SortFunc(t.fixed, func(a, b outageWindow) int { return a.start.Compare(b.start) })
+	if t.every > 0 {
+		seed := sched.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		t.rng = rand.New(rand.NewSource(seed))
+		t.random.end = start
+		t.draw()
+	}
+	return t
+}
+
+// draw picks the random outage after the current one.
+func (t *outageTimeline) draw() {
+	idle := time.Duration(t.rng.ExpFloat64() * float64(t.every))
+	length := max(time.Duration(t.rng.ExpFloat64()*float64(t.length)), minOutage)
+	t.random.start = t.random.end.Add(idle)
+	t.random.end = t.random.start.Add(length)
+}
+
+// peek returns the next outage to start, if there is one.
+func (t *outageTimeline) peek() (outageWindow, bool) {
+	switch {
+	case len(t.fixed) > 0 && (t.rng == nil || t.fixed[0].start.Before(t.random.start)):
+		return t.fixed[0], true
+	case t.rng != nil:
+		return t.random, true
+	}
+	return outageWindow{}, false
+}
+
+// pop removes the outage peek returned.
+func (t *outageTimeline) pop() {
+	if len(t.fixed) > 0 && (t.rng == nil || t.fixed[0].start.Before(t.random.start)) {
+		t.fixed = t.fixed[1:]
+		return
+	}
+	t.draw()
+}
+
+// outageStage holds data back while the link is down, and passes it on in
+// order when it comes back. It asks to be woken at every outage's start
+// and end, even with nothing held, so observers hear of them as they
+// happen; each call still catches up with every boundary passed since the
+// last. As the point where data enters the link, it also reports the data
+// sent to Hangup.
+type outageStage struct {
+	timeline *outageTimeline // Nil without outages
+	down     bool
+	until    time.Time // End of the current outage
+	hangup   *Hangup
+
+	queue     ring[[]byte] // Data held during the outage
+	heldSince time.Time    // When the oldest data in queue arrived
+	pool      bufferPool
+	obs       Observer
+
+	// For Stats
+	outages atomic.Int64
+	end     atomic.Int64 // until, in Unix nanoseconds
+	wait    waitTimer
+}
+
+// newOutageStage returns a stage following cfg.Outages and cfg.Hangup
+// from the time on cfg.Clock.
+func newOutageStage(cfg ShaperConfig) *outageStage {
+	o := &outageStage{hangup: cfg.Hangup, obs: cfg.Observer}
+	if cfg.Outages == nil && cfg.Hangup == nil {
+		return o
+	}
+	now := configClock(cfg).Now()
+	if cfg.Outages != nil {
+		o.timeline = newOutageTimeline(cfg.Outages, now)
+	}
+	if cfg.Hangup != nil {
+		cfg.Hangup.start(now)
+	}
+	return o
+}
+
+func (o *outageStage) Push(now time.Time, p []byte, emit Emit) error {
+	if err := o.advance(now, emit); err != nil {
+		return err
+	}
+	if o.hangup != nil {
+		if err := o.hangup.sent(now); err != nil {
+			return err
+		}
+	}
+	if !o.down {
+		return emit(p)
+	}
+	if o.queue.len() == 0 {
+		o.heldSince = now
+	}
+	o.queue.push(o.pool.clone(p))
+	return o.stalled(now)
+}
+
+func (o *outageStage) Next() (time.Time, bool) {
+	if o.timeline == nil {
+		return time.Time{}, false
+	}
+	if !o.down {
+		next, ok := o.timeline.peek()
+		return next.start, ok
+	}
+	if o.hangup != nil && o.queue.len() > 0 {
+		if at, ok := o.hangup.deadline(o.heldSince); ok && at.Before(o.until) {
+			return at, true
+		}
+	}
+	return o.until, true
+}
+
+func (o *outageStage) Release(now time.Time, emit Emit) error {
+	if err := o.advance(now, emit); err != nil {
+		return err
+	}
+	return o.stalled(now)
+}
+
+// stalled returns ErrHangup if the data held has waited too long.
+func (o *outageStage) stalled(now time.Time) error {
+	if o.hangup == nil || o.queue.len() == 0 {
+		return nil
+	}
+	return o.hangup.stalled(o.heldSince, now)
+}
+
+// advance brings the link's state up to now, passing on the data held
+// back when an outage ends. Outages are reported at the times they begin
+// and end, which may be before now.
+func (o *outageStage) advance(now time.Time, emit Emit) error {
+	if o.timeline == nil {
+		return nil
+	}
+	for {
+		if o.down {
+			if o.until.After(now) {
+				return nil
+			}
+			o.down = false
+			_, lasted, _ := o.wait.update(o.until, false)
+			if o.obs != nil {
+				o.obs.OutageFinished(o.until, lasted)
+			}
+			if err := o.flush(emit); err != nil {
+				return err
+			}
+		}
+
+		next, ok := o.timeline.peek()
+		if !ok || next.start.After(now) {
+			return nil
+		}
+		o.timeline.pop()
+		// Outages that overlap this one extend it
+		for {
+			more, ok := o.timeline.peek()
+			if !ok || more.start.After(next.end) {
+				break
+			}
+			o.timeline.pop()
+			if more.end.After(next.end) {
+				next.end = more.end
+			}
+		}
+		o.down, o.until = true, next.end
+		o.outages.Add(1)
+		o.end.Store(next.end.UnixNano())
+		o.wait.update(next.start, true)
+		if o.obs != nil {
+			o.obs.OutageStarted(next.start, next.end)
+		}
+	}
+}
+
+// flush passes on everything held, oldest first.
+func (o *outageStage) flush(emit Emit) error {
+	for o.queue.len() > 0 {
+		buf := o.queue.pop()
+		err := emit(buf)
+		o.pool.put(buf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *outageStage) addStats(now time.Time, out *Stats) {
+	out.Outages = o.outages.Load()
+	// An outage that has ended but not yet been seen to counts to its end
+	if end := time.Unix(0, o.end.Load()); now.After(end) {
+		now = end
+	}
+	out.OutageTime = o.wait.total(now)
+}
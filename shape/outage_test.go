@@ -0,0 +1,181 @@
+package shape
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOutages(t *testing.T) {
+	got, err := ParseOutages("30s+5s, random:10m:8s,1m+500ms")
+	if err != nil {
+		t.Fatalf("ParseOutages failed: %v", err)
+	}
+	want := []Outage{{30 * time.Second, 5 * time.Second}, {time.Minute, 500 * time.Millisecond}}
+	if !slices.Equal(got.Fixed, want) || got.Every != 10*time.Minute || got.Length != 8*time.Second {
+		t.Errorf("ParseOutages = %+v, want fixed %v and random 10m:8s", got, want)
+	}
+	for _, input := range []string{"", "30s", "30s+0s", "-1s+1s", "random:10m", "random:0s:1s", "random:1m:1s,random:2m:1s"} {
+		if _, err := ParseOutages(input); err == nil {
+			t.Errorf("ParseOutages(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+// TestOutageStage checks that data sent during an outage is held and
+// passed on in order when the link comes back, and that an outage over
+// while the link was idle is still reported.
+func TestOutageStage(t *testing.T) {
+	obs := &traceObserver{}
+	o := newOutageStage(ShaperConfig{
+		Outages:  &OutageSchedule{Fixed: []Outage{{5 * time.Second, time.Second}, {time.Second, 2 * time.Second}}},
+		Clock:    NewFakeClock(virtualEpoch),
+		Observer: obs,
+	})
+	var got []string
+	now := virtualEpoch
+	emit := func(p []byte) error {
+		got = append(got, now.Sub(virtualEpoch).String()+":"+string(p))
+		return nil
+	}
+	for _, push := range []struct {
+		at   time.Duration
+		data string
+	}{{500 * time.Millisecond, "a"}, {1500 * time.Millisecond, "b"}, {2 * time.Second, "c"}} {
+		now = virtualEpoch.Add(push.at)
+		if err := o.Push(now, []byte(push.data), emit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next, ok := o.Next()
+	if !ok || !next.Equal(virtualEpoch.Add(3*time.Second)) {
+		t.Fatalf("Next = %v, %v; want the end of the outage at 3s", next.Sub(virtualEpoch), ok)
+	}
+	now = next
+	if err := o.Release(now, emit); err != nil {
+		t.Fatal(err)
+	}
+	now = virtualEpoch.Add(7 * time.Second)
+	if err := o.Push(now, []byte("d"), emit); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := strings.Join(got, " "); s != "500ms:a 3s:b 3s:c 7s:d" {
+		t.Errorf("writes %s, want b and c held until 3s", s)
+	}
+	want := []string{
+		"1s outage until 3s",
+		"3s outage over after 2s",
+		"5s outage until 6s",
+		"6s outage over after 1s",
+	}
+	if got := obs.trace(); !slices.Equal(got, want) {
+		t.Errorf("trace:\n  %s\nwant:\n  %s", strings.Join(got, "\n  "), strings.Join(want, "\n  "))
+	}
+	var st Stats
+	o.addStats(now, &st)
+	if st.Outages != 2 || st.OutageTime != 3*time.Second {
+		t.Errorf("stats: %d outages for %v, want 2 for 3s", st.Outages, st.OutageTime)
+	}
+}
+
+// TestOutageTimelineRandom checks that random outages follow their seed
+// and means, and that overlapping outages are merged.
+func TestOutageTimelineRandom(t *testing.T) {
+	sched := &OutageSchedule{Every: time.Minute, Length: 5 * time.Second, Seed: 7}
+	a, b := newOutageTimeline(sched, virtualEpoch), newOutageTimeline(sched, virtualEpoch)
+	var idle, down time.Duration
+	last := virtualEpoch
+	const n = 2000
+	for range n {
+		wa, _ := a.peek()
+		wb, _ := b.peek()
+		if wa != wb {
+			t.Fatalf("timelines with the same seed differ: %v and %v", wa, wb)
+		}
+		idle += wa.start.Sub(last)
+		down += wa.end.Sub(wa.start)
+		last = wa.end
+		a.pop()
+		b.pop()
+	}
+	if mean := idle / n; mean < 50*time.Second || mean > 70*time.Second {
+		t.Errorf("mean time between outages %v, want about 1m", mean)
+	}
+	if mean := down / n; mean < 4*time.Second || mean > 6*time.Second {
+		t.Errorf("mean outage %v, want about 5s", mean)
+	}
+
+	// A fixed outage inside a random one only lengthens it
+	first, _ := newOutageTimeline(sched, virtualEpoch).peek()
+	sched.Fixed = []Outage{{first.start.Sub(virtualEpoch) + time.Millisecond, time.Hour}}
+	o := newOutageStage(ShaperConfig{Outages: sched, Clock: NewFakeClock(virtualEpoch)})
+	if err := o.Push(first.start, []byte("x"), func([]byte) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if want := first.start.Add(time.Hour + time.Millisecond); !o.until.Equal(want) || o.outages.Load() != 1 {
+		t.Errorf("outage until %v (%d outages), want one until %v", o.until, o.outages.Load(), want)
+	}
+}
+
+// TestShaperOutage checks that data held by an outage then crosses the
+// link's delay and rate limit.
+func TestShaperOutage(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	s := NewShaper(ShaperConfig{
+		Delay: 100 * time.Millisecond, Rate: 100, Burst: 10,
+		Outages: &OutageSchedule{Fixed: []Outage{{0, time.Second}}},
+		Clock:   fc,
+	})
+	dst := &clockWriter{clock: fc}
+	done := startVirtual(s, dst, strings.NewReader(strings.Repeat("x", 20)))
+	stepUntil(t, fc, func() bool { return dst.count() == 2 })
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// 10 bytes go with the burst, 10 more a tenth of a second later
+	for i, want := range []time.Duration{1100 * time.Millisecond, 1200 * time.Millisecond} {
+		if got := dst.writes[i].t.Sub(virtualEpoch); got != want {
+			t.Errorf("write %d at %v, want %v", i, got, want)
+		}
+	}
+	if st := s.Stats(); st.Outages != 1 || st.OutageTime != time.Second {
+		t.Errorf("stats: %d outages for %v, want 1 for 1s", st.Outages, st.OutageTime)
+	}
+}
+
+// TestShaperOutageIdle checks that outages on an idle link are reported
+// as they begin and end, and that the Shaper still returns once drained.
+func TestShaperOutageIdle(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	obs := &traceObserver{}
+	s := NewShaper(ShaperConfig{
+		Outages:  &OutageSchedule{Fixed: []Outage{{time.Second, 2 * time.Second}, {5 * time.Second, time.Second}}},
+		Clock:    fc,
+		Observer: obs,
+	})
+	src, w := io.Pipe()
+	done := startVirtual(s, io.Discard, src)
+
+	for i, want := range []struct {
+		at    time.Duration
+		event string
+	}{
+		{time.Second, "1s outage until 3s"},
+		{3 * time.Second, "3s outage over after 2s"},
+		{5 * time.Second, "5s outage until 6s"},
+		{6 * time.Second, "6s outage over after 1s"},
+	} {
+		stepUntil(t, fc, func() bool { return len(obs.trace()) > i })
+		if got, at := obs.trace()[i], fc.Now().Sub(virtualEpoch); got != want.event || at != want.at {
+			t.Errorf("event %d: %q at %v, want %q as it happens", i, got, at, want.event)
+		}
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+}
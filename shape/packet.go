@@ -0,0 +1,94 @@
+package shape
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultMTU is the packet size when PacketOverhead is set without MTU:
+// Ethernet's.
+const defaultMTU = 1500
+
+// PacketFormat describes how a protocol frames a stream into packets.
+type PacketFormat struct {
+	MTU         int    // Packet size, overhead included
+	Overhead    int    // Bytes of framing per packet
+	Description string // What the overhead is made of
+}
+
+// PacketFormats are presets for ShaperConfig.MTU and PacketOverhead. The
+// overheads are typical figures for IPv4; options, other ciphers and
+// compression move them by a few bytes either way.
+var PacketFormats = map[string]PacketFormat{
+	"tcp": {
+		MTU:         1500,
+		Overhead:    52,
+		Description: "IPv4 + TCP with timestamps",
+	},
+	"ssh": {
+		MTU:         1500,
+		Overhead:    88,
+		Description: "TCP + SSH packet, channel data header, padding and 16-byte MAC",
+	},
+	"mosh": {
+		MTU:         500,
+		Overhead:    80,
+		Description: "IPv4 + UDP + mosh nonce, OCB tag, timestamps, fragment and instruction headers",
+	},
+}
+
+// ParsePacketFormat parses a packet format: the name of one of the
+// PacketFormats, or a per-packet overhead in bytes with the default MTU.
+func ParsePacketFormat(s string) (PacketFormat, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if f, ok := PacketFormats[s]; ok {
+		return f, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n >= defaultMTU {
+		return PacketFormat{}, fmt.Errorf("unknown packet format: %s", s)
+	}
+	return PacketFormat{MTU: defaultMTU, Overhead: n}, nil
+}
+
+// packetizer charges a stream for the packets it would travel in. Each
+// write starts a new packet, and a packet carries up to MTU less overhead
+// bytes of it. Without PacketOverhead it charges the payload alone.
+type packetizer struct {
+	payload  int // Bytes of data per packet
+	overhead int // PacketOverhead (0 = no packet layer)
+}
+
+func newPacketizer(cfg ShaperConfig) packetizer {
+	if cfg.PacketOverhead <= 0 {
+		return packetizer{}
+	}
+	mtu := cfg.MTU
+	if mtu <= 0 {
+		mtu = defaultMTU
+	}
+	return packetizer{payload: max(mtu-cfg.PacketOverhead, 1), overhead: cfg.PacketOverhead}
+}
+
+func (pk packetizer) enabled() bool { return pk.overhead > 0 }
+
+// mtu returns the size of a full packet, overhead included.
+func (pk packetizer) mtu() int { return pk.payload + pk.overhead }
+
+// cost returns the bytes n bytes of data take on the link.
+func (pk packetizer) cost(n int) int {
+	if !pk.enabled() || n <= 0 {
+		return n
+	}
+	return n + pk.overhead*((n+pk.payload-1)/pk.payload)
+}
+
+// pieceSize returns the most data that fits in burst bytes of link
+// capacity, in whole packets. burst must hold at least one full packet.
+func (pk packetizer) pieceSize(burst int) int {
+	if !pk.enabled() {
+		return burst
+	}
+	return max(burst/pk.mtu(), 1) * pk.payload
+}
@@ -0,0 +1,129 @@
+package shape
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePacketFormat(t *testing.T) {
+	tests := []struct {
+		input string
+		want  PacketFormat
+	}{
+		{"tcp", PacketFormats["tcp"]},
+		{" SSH ", PacketFormats["ssh"]},
+		{"mosh", PacketFormats["mosh"]},
+		{"40", PacketFormat{MTU: 1500, Overhead: 40}},
+	}
+	for _, tt := range tests {
+		got, err := ParsePacketFormat(tt.input)
+		if err != nil || got != tt.want {
+			t.Errorf("ParsePacketFormat(%q) = %+v, %v; want %+v", tt.input, got, err, tt.want)
+		}
+	}
+	for _, input := range []string{"", "udp", "-1", "1500"} {
+		if _, err := ParsePacketFormat(input); err == nil {
+			t.Errorf("ParsePacketFormat(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+func TestPacketizerCost(t *testing.T) {
+	pk := newPacketizer(ShaperConfig{PacketOverhead: 52})
+	for _, tt := range []struct{ n, want int }{
+		{0, 0},
+		{1, 53},
+		{1448, 1500},
+		{1449, 1449 + 2*52},
+	} {
+		if got := pk.cost(tt.n); got != tt.want {
+			t.Errorf("cost(%d) = %d, want %d", tt.n, got, tt.want)
+		}
+	}
+	if got := pk.pieceSize(3200); got != 2*1448 {
+		t.Errorf("pieceSize(3200) = %d, want two packets' worth", got)
+	}
+	if got := newPacketizer(ShaperConfig{MTU: 576}).cost(1000); got != 1000 {
+		t.Errorf("cost without overhead = %d, want the payload alone", got)
+	}
+}
+
+// drainRate releases r until it holds nothing and returns the time of the
+// last write and the bytes written.
+func drainRate(t *testing.T, r *rateStage, emit Emit, written *int) time.Time {
+	t.Helper()
+	var last time.Time
+	for {
+		next, ok := r.Next()
+		if !ok {
+			return last
+		}
+		before := *written
+		if err := r.Release(next, emit); err != nil {
+			t.Fatal(err)
+		}
+		if *written > before {
+			last = next
+		}
+	}
+}
+
+// TestRateStagePacketOverhead checks that keystrokes are charged for their
+// framing: at 1000 bytes/s, 88 bytes of SSH-style overhead make each one
+// cost 89, so 1000 of them take 89 seconds, less the initial burst.
+func TestRateStagePacketOverhead(t *testing.T) {
+	r := newRateStage(ShaperConfig{Rate: 1000, PacketOverhead: 88}, nil, nil)
+	if r.burst != 1500 {
+		t.Fatalf("burst %d, want one full packet", r.burst)
+	}
+	written := 0
+	emit := func(p []byte) error {
+		written += len(p)
+		return nil
+	}
+	for i := 0; i < 1000; i++ {
+		if err := r.Push(virtualEpoch, []byte("x"), emit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if written != 1500/89 {
+		t.Errorf("%d keystrokes sent at once, want the %d the burst pays for", written, 1500/89)
+	}
+	last := drainRate(t, r, emit, &written)
+	want := time.Duration(1000*89-1500) * time.Millisecond
+	if got := last.Sub(virtualEpoch); written != 1000 || got < want-time.Millisecond || got > want {
+		t.Errorf("%d keystrokes, the last at %v; want 1000 by %v", written, got, want)
+	}
+}
+
+// TestRateStageSerialPacketOverhead checks that in serial mode each
+// packet's framing takes wire time ahead of its data.
+func TestRateStageSerialPacketOverhead(t *testing.T) {
+	// 10 bytes of data and 10 of framing per packet
+	r := newRateStage(ShaperConfig{Rate: 960, SerialMode: true, PacketOverhead: 10, MTU: 20}, nil, nil)
+	var writes []int
+	written := 0
+	emit := func(p []byte) error {
+		writes = append(writes, len(p))
+		written += len(p)
+		return nil
+	}
+	if err := r.Push(virtualEpoch, make([]byte, 25), emit); err != nil {
+		t.Fatal(err)
+	}
+	if next, _ := r.Next(); next.Before(virtualEpoch.Add(11 * time.Second / 960)) {
+		t.Errorf("first byte due at %v, before its framing has crossed the wire", next.Sub(virtualEpoch))
+	}
+	last := drainRate(t, r, emit, &written)
+
+	// Three packets: 20 + 20 + 15 bytes on the wire
+	want := r.wire.finish(55)
+	if written != 25 || last.Before(want) || last.After(want.Add(serialQuantum)) {
+		t.Errorf("wrote %d bytes, the last at %v; want 25 at %v", written, last.Sub(virtualEpoch), want.Sub(virtualEpoch))
+	}
+	for _, n := range writes {
+		if n > 10 {
+			t.Errorf("write of %d bytes spans packets", n)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package shape
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// Emit passes data on to the next stage of a pipeline (or, after the last
+// stage, to the Shaper's output). p is only valid for the duration of the
+// call.
+type Emit func(p []byte) error
+
+// Stage is one step of a Shaper's pipeline. Data enters a stage through
+// Push and leaves through the Emit it is given. A stage that holds data
+// back (a delay queue, a rate limiter, a frame buffer) reports through Next
+// when it wants Release to be called again. A stage that holds data with
+// no time to release it, waiting for more to arrive, must implement
+// Flusher, or that data is never written once the source ends.
+//
+// Stages are driven from a single goroutine and are given the current time
+// rather than reading a clock, so they never block and run unchanged on a
+// FakeClock. A stage that holds resources, such as a file, may implement
+// io.Closer; Shaper.Run closes it on return.
+type Stage interface {
+	// Push hands p to the stage at time now. p is only valid for the
+	// duration of the call; a stage that holds on to data must copy it.
+	Push(now time.Time, p []byte, emit Emit) error
+
+	// Next reports the time at which the stage next wants Release to be
+	// called. ok is false while the stage holds nothing, unless it has an
+	// event to report on time, as the outage stage does.
+	Next() (t time.Time, ok bool)
+
+	// Release passes on everything the stage holds that is due at or
+	// before now.
+	Release(now time.Time, emit Emit) error
+}
+
+// Reconfigurer is implemented by stages that can adopt a new configuration
+// while data is in flight. Shaper.SetConfig calls Reconfigure from the
+// pipeline's goroutine; emit may be used to pass on data the change sets
+// free (a frame buffer when framing is turned off, say). Stages that do
+// not implement it keep the settings they were built with.
+type Reconfigurer interface {
+	Reconfigure(now time.Time, cfg ShaperConfig, emit Emit) error
+}
+
+// Flusher is implemented by stages that can hold data without reporting a
+// Next time, such as a stage that gathers writes until it has enough to
+// pass on. Once the source ends and no stage reports a Next time,
+// Shaper.Run calls Flush on each in pipeline order to pass on everything
+// it holds; Run returns an error if data is still held after that.
+type Flusher interface {
+	Flush(now time.Time, emit Emit) error
+}
+
+// StageEnv is what a StageFunc is given to build a stage for one Shaper.
+// A stage that discards data must report it through Drop, so the Shaper's
+// queue accounting (Queued, the queue limit and Stats) stays correct.
+type StageEnv struct {
+	Config ShaperConfig // Configuration of the Shaper being built
+	Rand   *rand.Rand   // The Shaper's seeded random source
+	Drop   func(n int)  // Reports n bytes the stage discarded instead of emitting
+}
+
+// StageFunc builds a Stage. It is called once per Shaper, so the returned
+// stage may keep per-stream state.
+type StageFunc func(env StageEnv) Stage
+
+// StageSpec places a custom stage in a Shaper's pipeline.
+//
+// If Name matches a stage already in the pipeline, that stage is replaced.
+// Otherwise the stage is inserted ahead of the stage named by Before, or
+// appended after the last stage if Before is empty.
+type StageSpec struct {
+	Name   string
+	Before string
+	New    StageFunc
+}
+
+// Names of the built-in stages, in pipeline order.
+const (
+	StageWindow = "window" // Limits data in flight to the TCP window
+	StageOutage = "outage" // Holds data while the link is down
+	StageDelay  = "delay"  // Holds data for Delay ± Jitter
+	StageChunk  = "chunk"  // Splits data into ChunkSize pieces
+	StageFrame  = "frame"  // Coalesces data into FrameTime bursts
+	StageRate   = "rate"   // Token bucket, wire serialization or delivery trace
+)
+
+// pipelineBuilder assembles the ordered list of named stages for a Shaper.
+type pipelineBuilder struct {
+	names  []string
+	stages []Stage
+}
+
+// newPipelineBuilder returns a builder holding the built-in stages for cfg,
+// with cfg.Stages applied on top.
+func newPipelineBuilder(env StageEnv) (*pipelineBuilder, error) {
+	cfg := env.Config
+	b := &pipelineBuilder{}
+	b.append(StageWindow, newWindowStage(cfg, cfg.Observer))
+	b.append(StageOutage, newOutageStage(cfg))
+	b.append(StageDelay, newDelayStage(cfg, env.Rand))
+	b.append(StageChunk, newChunkStage(cfg.ChunkSize))
+	b.append(StageFrame, newFrameStage(cfg.FrameTime, cfg.Observer))
+	if cfg.DeliveryTrace != nil {
+		if err := cfg.DeliveryTrace.check(); err != nil {
+			return nil, err
+		}
+		b.append(StageRate, newTraceStage(cfg))
+	} else {
+		b.append(StageRate, newRateStage(cfg, env.Rand, env.Drop))
+	}
+
+	for _, spec := range cfg.Stages {
+		if err := b.apply(spec, env); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *pipelineBuilder) append(name string, s Stage) {
+	b.names = append(b.names, name)
+	b.stages = append(b.stages, s)
+}
+
+func (b *pipelineBuilder) index(name string) int {
+	for i, n := range b.names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// apply adds, replaces or inserts the stage described by spec.
+func (b *pipelineBuilder) apply(spec StageSpec, env StageEnv) error {
+	if spec.New == nil {
+		return fmt.Errorf("stage %q has no constructor", spec.Name)
+	}
+	stage := spec.New(env)
+
+	if i := b.index(spec.Name); i >= 0 {
+		b.stages[i] = stage
+		return nil
+	}
+	if spec.Before == "" {
+		b.append(spec.Name, stage)
+		return nil
+	}
+
+	i := b.index(spec.Before)
+	if i < 0 {
+		return fmt.Errorf("stage %q: unknown stage %q", spec.Name, spec.Before)
+	}
+	b.names = append(b.names[:i], append([]string{spec.Name}, b.names[i:]...)...)
+	b.stages = append(b.stages[:i], append([]Stage{stage}, b.stages[i:]...)...)
+	return nil
+}
+
+// build wires the stages together into a pipeline.
+func (b *pipelineBuilder) build() *pipeline {
+	p := &pipeline{
+		names:  b.names,
+		stages: b.stages,
+		emits:  make([]Emit, len(b.stages)),
+	}
+	for i := range p.stages {
+		if i == len(p.stages)-1 {
+			p.emits[i] = func(data []byte) error { return p.sink(data) }
+			continue
+		}
+		next := i + 1
+		p.emits[i] = func(data []byte) error {
+			return p.stages[next].Push(p.now, data, p.emits[next])
+		}
+	}
+	return p
+}
+
+// pipeline drives data through an ordered list of stages into a sink.
+type pipeline struct {
+	names  []string
+	stages []Stage
+	emits  []Emit
+	sink   Emit
+	now    time.Time // Time of the event currently being processed
+}
+
+// push feeds p into the first stage at time now.
+func (p *pipeline) push(now time.Time, data []byte) error {
+	p.now = now
+	return p.stages[0].Push(now, data, p.emits[0])
+}
+
+// next returns the earliest time any stage wants to be released.
+func (p *pipeline) next() (time.Time, bool) {
+	var earliest time.Time
+	found := false
+	for _, s := range p.stages {
+		if t, ok := s.Next(); ok && (!found || t.Before(earliest)) {
+			earliest, found = t, true
+		}
+	}
+	return earliest, found
+}
+
+// reconfigure passes cfg to every stage that supports it, in order.
+func (p *pipeline) reconfigure(now time.Time, cfg ShaperConfig) error {
+	p.now = now
+	for i, s := range p.stages {
+		if r, ok := s.(Reconfigurer); ok {
+			if err := r.Reconfigure(now, cfg, p.emits[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// close closes every stage that implements io.Closer and returns the
+// first error.
+func (p *pipeline) close() error {
+	var first error
+	for _, s := range p.stages {
+		if c, ok := s.(io.Closer); ok {
+			if err := c.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// flush has every stage that implements Flusher pass on what it holds, in
+// order, so data flushed upstream reaches downstream flushers.
+func (p *pipeline) flush(now time.Time) error {
+	p.now = now
+	for i, s := range p.stages {
+		if f, ok := s.(Flusher); ok {
+			if err := f.Flush(now, p.emits[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// release lets every stage that is due at now pass its data on. Stages are
+// visited in order, so data released upstream can flow through downstream
+// stages within the same call.
+func (p *pipeline) release(now time.Time) error {
+	p.now = now
+	for i, s := range p.stages {
+		if t, ok := s.Next(); ok && !t.After(now) {
+			if err := s.Release(now, p.emits[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package shape
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upperStage is a content filter that upper-cases everything passing through.
+type upperStage struct{}
+
+func (upperStage) Push(now time.Time, p []byte, emit Emit) error {
+	return emit(bytes.ToUpper(p))
+}
+func (upperStage) Next() (time.Time, bool)                { return time.Time{}, false }
+func (upperStage) Release(now time.Time, emit Emit) error { return nil }
+
+// holdStage holds every chunk for a fixed time, like a minimal delay stage.
+type holdStage struct {
+	hold  time.Duration
+	data  []byte
+	dueAt time.Time
+}
+
+func (h *holdStage) Push(now time.Time, p []byte, emit Emit) error {
+	if len(h.data) == 0 {
+		h.dueAt = now.Add(h.hold)
+	}
+	h.data = append(h.data, p...)
+	return nil
+}
+
+func (h *holdStage) Next() (time.Time, bool) {
+	return h.dueAt, len(h.data) > 0
+}
+
+func (h *holdStage) Release(now time.Time, emit Emit) error {
+	data := h.data
+	h.data = nil
+	return emit(data)
+}
+
+func TestPipelineCustomStage(t *testing.T) {
+	cfg := ShaperConfig{
+		Delay: 10 * time.Millisecond,
+		Stages: []StageSpec{
+			{Name: "upper", Before: StageRate, New: func(StageEnv) Stage { return upperStage{} }},
+		},
+	}
+
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+	if err := copyVirtual(t, fc, dst, strings.NewReader("hello"), cfg); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	if got := dst.String(); got != "HELLO" {
+		t.Errorf("output = %q, want %q", got, "HELLO")
+	}
+	if want := virtualEpoch.Add(10 * time.Millisecond); !dst.writes[0].t.Equal(want) {
+		t.Errorf("write at %v, want %v", dst.writes[0].t, want)
+	}
+}
+
+func TestPipelineReplaceBuiltinStage(t *testing.T) {
+	cfg := ShaperConfig{
+		Delay: time.Hour, // Ignored once the delay stage is replaced
+		Stages: []StageSpec{
+			{Name: StageDelay, New: func(StageEnv) Stage { return &holdStage{hold: 3 * time.Second} }},
+		},
+	}
+
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+	if err := copyVirtual(t, fc, dst, strings.NewReader("abc"), cfg); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	if want := virtualEpoch.Add(3 * time.Second); len(dst.writes) != 1 || !dst.writes[0].t.Equal(want) {
+		t.Errorf("writes = %v, want a single write at %v", dst.writes, want)
+	}
+}
+
+func TestPipelineBuilderOrder(t *testing.T) {
+	noop := func(StageEnv) Stage { return upperStage{} }
+	b, err := newPipelineBuilder(StageEnv{Config: ShaperConfig{
+		Stages: []StageSpec{
+			{Name: "first", Before: StageDelay, New: noop},
+			{Name: "mid", Before: StageFrame, New: noop},
+			{Name: "last", New: noop},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("newPipelineBuilder: %v", err)
+	}
+
+	want := []string{StageWindow, StageOutage, "first", StageDelay, StageChunk, "mid", StageFrame, StageRate, "last"}
+	if strings.Join(b.names, ",") != strings.Join(want, ",") {
+		t.Errorf("pipeline order = %v, want %v", b.names, want)
+	}
+
+	_, err = newPipelineBuilder(StageEnv{Config: ShaperConfig{
+		Stages: []StageSpec{{Name: "x", Before: "nope", New: noop}},
+	}})
+	if err == nil {
+		t.Error("expected an error for an unknown anchor stage")
+	}
+}
+
+// lineStage passes data on a line at a time, holding a partial line with
+// no time to release it.
+type lineStage struct{ held []byte }
+
+func (l *lineStage) Push(now time.Time, p []byte, emit Emit) error {
+	l.held = append(l.held, p...)
+	if i := bytes.LastIndexByte(l.held, '\n'); i >= 0 {
+		line := l.held[:i+1]
+		l.held = bytes.Clone(l.held[i+1:])
+		return emit(line)
+	}
+	return nil
+}
+func (l *lineStage) Next() (time.Time, bool)                { return time.Time{}, false }
+func (l *lineStage) Release(now time.Time, emit Emit) error { return nil }
+
+// flushingLineStage is a lineStage that passes on its partial line at EOF.
+type flushingLineStage struct{ lineStage }
+
+func (l *flushingLineStage) Flush(now time.Time, emit Emit) error {
+	held := l.held
+	l.held = nil
+	return emit(held)
+}
+
+// TestPipelineFlushAtEOF checks that data a stage holds with nothing due
+// is flushed through the stages after it at EOF, and that Run reports
+// data a stage cannot flush instead of dropping it.
+func TestPipelineFlushAtEOF(t *testing.T) {
+	cfg := ShaperConfig{
+		Delay:  10 * time.Millisecond,
+		Stages: []StageSpec{{Name: "line", Before: StageDelay, New: func(StageEnv) Stage { return &flushingLineStage{} }}},
+	}
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+	if err := copyVirtual(t, fc, dst, strings.NewReader("one\ntwo"), cfg); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if got := dst.String(); got != "one\ntwo" {
+		t.Errorf("output = %q, want the partial line flushed", got)
+	}
+
+	cfg.Stages[0].New = func(StageEnv) Stage { return &lineStage{} }
+	dst = &clockWriter{clock: fc}
+	if err := copyVirtual(t, fc, dst, strings.NewReader("one\ntwo"), cfg); err == nil || dst.String() != "one\n" {
+		t.Errorf("Copy wrote %q and returned %v, want an error for the held line", dst.String(), err)
+	}
+}
@@ -0,0 +1,184 @@
+package shape
+
+import "time"
+
+// Profile describes a connection type in both directions.
+type Profile struct {
+	RTT         time.Duration      // Round-trip time, split evenly up/down
+	Jitter      time.Duration      // Jitter applied in both directions
+	JitterDist  JitterDistribution // Shape of the jitter (default uniform)
+	JitterShape float64            // Shape parameter for JitterDist (0 = default)
+	UpRate      int64              // Upstream bytes per second (0 = unlimited)
+	DownRate    int64              // Downstream bytes per second (0 = unlimited)
+	SerialMode  bool               // Use wire serialization instead of token bucket
+	Loss        float64            // Packet loss in both directions, as TCP retransmission stalls
+	LossBurst   float64            // Mean loss burst length in segments (0 = independent losses)
+}
+
+// Up returns the ShaperConfig for the upstream (client→server) direction.
+func (p Profile) Up() ShaperConfig {
+	return ShaperConfig{
+		Delay:       p.RTT / 2,
+		Jitter:      p.Jitter,
+		JitterDist:  p.JitterDist,
+		JitterShape: p.JitterShape,
+		Rate:        p.UpRate,
+		SerialMode:  p.SerialMode,
+		Loss:        p.Loss,
+		LossBurst:   p.LossBurst,
+		RTT:         p.RTT,
+	}
+}
+
+// Down returns the ShaperConfig for the downstream (server→client) direction.
+func (p Profile) Down() ShaperConfig {
+	return ShaperConfig{
+		Delay:       p.RTT / 2,
+		Jitter:      p.Jitter,
+		JitterDist:  p.JitterDist,
+		JitterShape: p.JitterShape,
+		Rate:        p.DownRate,
+		SerialMode:  p.SerialMode,
+		Loss:        p.Loss,
+		LossBurst:   p.LossBurst,
+		RTT:         p.RTT,
+	}
+}
+
+// Profiles defines preset configurations for common connection types.
+var Profiles = map[string]Profile{
+	// Serial connections (use wire serialization for authentic feel)
+	"9600": {
+		UpRate:     960, // 9600 baud / 10 bits per byte
+		DownRate:   960,
+		SerialMode: true,
+	},
+	"2400": {
+		UpRate:     240, // 2400 baud / 10 bits per byte
+		DownRate:   240,
+		SerialMode: true,
+	},
+
+	// Dial-up modems
+	"dialup": {
+		RTT:      150 * time.Millisecond,
+		Jitter:   30 * time.Millisecond,
+		DownRate: 56000 / 8, // 56kbit -> bytes
+		UpRate:   33600 / 8, // 33.6kbit -> bytes
+	},
+
+	// Mobile networks
+	// Radio scheduling and retransmission give cellular links a long tail,
+	// and fading makes their losses come in bursts
+	"edge": {
+		RTT:        500 * time.Millisecond,
+		Jitter:     100 * time.Millisecond,
+		JitterDist: JitterLogNormal,
+		DownRate:   200000 / 8, // 200kbit
+		UpRate:     100000 / 8, // 100kbit
+		Loss:       0.02,
+		LossBurst:  2,
+	},
+	"3g": {
+		RTT:        200 * time.Millisecond,
+		Jitter:     50 * time.Millisecond,
+		JitterDist: JitterLogNormal,
+		DownRate:   1000000 / 8, // 1mbit
+		UpRate:     384000 / 8,  // 384kbit
+		Loss:       0.005,
+	},
+	"lte": {
+		RTT:      50 * time.Millisecond,
+		Jitter:   15 * time.Millisecond,
+		DownRate: 20000000 / 8, // 20mbit
+		UpRate:   5000000 / 8,  // 5mbit
+	},
+	"lte-poor": {
+		RTT:        150 * time.Millisecond,
+		Jitter:     50 * time.Millisecond,
+		JitterDist: JitterLogNormal,
+		DownRate:   2000000 / 8, // 2mbit
+		UpRate:     500000 / 8,  // 500kbit
+		Loss:       0.01,
+		LossBurst:  2,
+	},
+
+	// Wired connections
+	"dsl": {
+		RTT:      50 * time.Millisecond,
+		Jitter:   10 * time.Millisecond,
+		DownRate: 8000000 / 8, // 8mbit
+		UpRate:   1000000 / 8, // 1mbit
+	},
+	"cable": {
+		RTT:      30 * time.Millisecond,
+		Jitter:   5 * time.Millisecond,
+		DownRate: 50000000 / 8, // 50mbit
+		UpRate:   5000000 / 8,  // 5mbit
+	},
+
+	// Satellite
+	"satellite": {
+		RTT:      600 * time.Millisecond, // Geostationary orbit
+		Jitter:   50 * time.Millisecond,
+		DownRate: 25000000 / 8, // 25mbit (Starlink-ish)
+		UpRate:   5000000 / 8,  // 5mbit
+	},
+	"satellite-geo": {
+		RTT:      700 * time.Millisecond, // High geostationary latency
+		Jitter:   100 * time.Millisecond,
+		DownRate: 10000000 / 8, // 10mbit (traditional VSAT)
+		UpRate:   2000000 / 8,  // 2mbit
+		Loss:     0.005,        // Rain fade
+	},
+
+	// WiFi scenarios: contention and link-layer retries give a heavy tail,
+	// and interference loses packets in bursts
+	"wifi-poor": {
+		RTT:        80 * time.Millisecond,
+		Jitter:     40 * time.Millisecond,
+		JitterDist: JitterPareto,
+		DownRate:   2000000 / 8, // 2mbit
+		UpRate:     1000000 / 8, // 1mbit
+		Loss:       0.01,
+		LossBurst:  3,
+	},
+	"wifi-bad": {
+		RTT:         200 * time.Millisecond,
+		Jitter:      100 * time.Millisecond,
+		JitterDist:  JitterPareto,
+		JitterShape: 1.5,        // Heavier tail than wifi-poor
+		DownRate:    500000 / 8, // 500kbit
+		UpRate:      250000 / 8, // 250kbit
+		Loss:        0.03,
+		LossBurst:   4,
+	},
+
+	// International/long-distance
+	"intercontinental": {
+		RTT:      250 * time.Millisecond, // e.g., US to Asia
+		Jitter:   30 * time.Millisecond,
+		DownRate: 10000000 / 8, // 10mbit (typical VPN)
+		UpRate:   5000000 / 8,  // 5mbit
+	},
+
+	// Deep space
+	"lunar": {
+		RTT:      2560 * time.Millisecond, // Earth-Moon ~1.28s one-way (384,400km / c)
+		Jitter:   50 * time.Millisecond,   // Space links are stable once locked
+		DownRate: 128000 / 8,              // 128kbit S-band downlink
+		UpRate:   16000 / 8,               // 16kbit uplink (commands)
+	},
+	"mars-close": {
+		RTT:      6 * time.Minute, // Mars at closest approach (~54.6M km)
+		Jitter:   time.Second,     // DSN tracking variations
+		DownRate: 2000000 / 8,     // 2mbit DSN downlink
+		UpRate:   16000 / 8,       // 16kbit uplink
+	},
+	"mars-far": {
+		RTT:      44 * time.Minute, // Mars at opposition (~401M km)
+		Jitter:   2 * time.Second,  // Longer path = more variation
+		DownRate: 500000 / 8,       // 500kbit (signal degrades with distance)
+		UpRate:   8000 / 8,         // 8kbit uplink
+	},
+}
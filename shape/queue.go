@@ -0,0 +1,255 @@
+package shape
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OverflowPolicy says what a Shaper does with data that arrives while its
+// queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock stops reading the source until there is room again, so
+	// the writer stalls the way it would behind a full TCP window.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowTailDrop discards whatever part of newly read data does not
+	// fit.
+	OverflowTailDrop
+	// OverflowCoDel tail-drops when full, like OverflowTailDrop, and also
+	// runs CoDel active queue management on the rate limiter's queue.
+	OverflowCoDel
+)
+
+// CoDel defaults from RFC 8289
+const (
+	defaultCoDelTarget   = 5 * time.Millisecond
+	defaultCoDelInterval = 100 * time.Millisecond
+)
+
+var overflowPolicyNames = map[OverflowPolicy]string{
+	OverflowBlock:    "block",
+	OverflowTailDrop: "drop",
+	OverflowCoDel:    "codel",
+}
+
+func (p OverflowPolicy) String() string {
+	if name, ok := overflowPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// ParseOverflowPolicy parses "block", "drop" (or "taildrop") and "codel".
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "taildrop" {
+		return OverflowTailDrop, nil
+	}
+	for p, name := range overflowPolicyNames {
+		if s == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown overflow policy: %s", s)
+}
+
+// queueLimit returns the byte limit cfg puts on the data a Shaper holds,
+// or 0 for no limit. QueueTime is converted to bytes at Rate, or a
+// DeliveryTrace's mean rate, on top of the bandwidth-delay product, so a
+// time limit only bounds queueing and not the data a long delay naturally
+// keeps in flight.
+func queueLimit(cfg ShaperConfig) int {
+	limit := cfg.QueueLimit
+	if rate := linkRate(cfg); cfg.QueueTime > 0 && rate > 0 {
+		held := float64(rate) * (baseDelay(cfg) + cfg.QueueTime).Seconds()
+		byTime := math.MaxInt
+		if held < float64(math.MaxInt) {
+			byTime = int(math.Max(held, 1))
+		}
+		if limit <= 0 || byTime < limit {
+			limit = byTime
+		}
+	}
+	return limit
+}
+
+// queueGauge tracks the bytes a Shaper holds between reading them from the
+// source and writing or dropping them, and enforces the queue limit.
+// The reader goroutine admits data; the Run loop releases it.
+type queueGauge struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	used    int
+	limit   int // 0 = unlimited
+	policy  OverflowPolicy
+	dropped int64
+	closed  bool // Run has returned; never block again
+}
+
+func newQueueGauge(cfg ShaperConfig) *queueGauge {
+	q := &queueGauge{limit: queueLimit(cfg), policy: cfg.QueuePolicy}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// setConfig applies a new limit and policy, waking a blocked reader if
+// that made room.
+func (q *queueGauge) setConfig(cfg ShaperConfig) {
+	q.mu.Lock()
+	q.limit, q.policy = queueLimit(cfg), cfg.QueuePolicy
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// room blocks under OverflowBlock until the queue has space, then returns
+// how many bytes may be read, at most max.
+func (q *queueGauge) room(max int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.policy != OverflowBlock {
+		return max
+	}
+	for q.limit > 0 && q.used >= q.limit && !q.closed {
+		q.cond.Wait()
+	}
+	if q.limit > 0 && !q.closed && q.limit-q.used < max {
+		return q.limit - q.used
+	}
+	return max
+}
+
+// admit accounts for n newly read bytes and returns how many of them fit;
+// the rest are counted as dropped.
+func (q *queueGauge) admit(n int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	kept := n
+	if q.limit > 0 && q.policy != OverflowBlock && q.used+n > q.limit {
+		kept = q.limit - q.used
+		if kept < 0 {
+			kept = 0
+		}
+		q.dropped += int64(n - kept)
+	}
+	q.used += kept
+	return kept
+}
+
+// release accounts for n bytes leaving the Shaper.
+func (q *queueGauge) release(n int) {
+	q.mu.Lock()
+	q.used -= n
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// drop accounts for n held bytes that a stage discarded.
+func (q *queueGauge) drop(n int) {
+	q.mu.Lock()
+	q.dropped += int64(n)
+	q.mu.Unlock()
+	q.release(n)
+}
+
+// close stops room from blocking.
+func (q *queueGauge) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *queueGauge) stats() (used, limit int, dropped int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.used, q.limit, q.dropped
+}
+
+// codel is the CoDel control law (RFC 8289). It decides, each time a piece
+// reaches the head of the rate limiter's queue, whether to drop it based on
+// how long it waited.
+type codel struct {
+	target   time.Duration
+	interval time.Duration
+
+	firstAbove time.Time // When sojourn first stayed above target, plus interval
+	dropNext   time.Time // Next drop while in the dropping state
+	count      int       // Drops since entering the dropping state
+	lastCount  int
+	dropping   bool
+}
+
+func newCoDel(cfg ShaperConfig) *codel {
+	c := &codel{target: cfg.CoDelTarget, interval: cfg.CoDelInterval}
+	if c.target <= 0 {
+		c.target = defaultCoDelTarget
+	}
+	if c.interval <= 0 {
+		c.interval = defaultCoDelInterval
+	}
+	return c
+}
+
+// okToDrop reports whether the head, having waited sojourn with backlog
+// bytes queued behind and including it, has been above target for a full
+// interval. A queue holding a single piece is never dropped from.
+func (c *codel) okToDrop(now time.Time, sojourn time.Duration, backlog, head int) bool {
+	if sojourn < c.target || backlog <= head {
+		c.firstAbove = time.Time{}
+		return false
+	}
+	if c.firstAbove.IsZero() {
+		c.firstAbove = now.Add(c.interval)
+		return false
+	}
+	return !now.Before(c.firstAbove)
+}
+
+func (c *codel) controlLaw(t time.Time) time.Time {
+	return t.Add(time.Duration(float64(c.interval) / math.Sqrt(float64(c.count))))
+}
+
+// shouldDrop is consulted for each piece as it reaches the head of the
+// queue and reports whether to discard it. The caller keeps asking for
+// each new head until it returns false or the queue is empty.
+func (c *codel) shouldDrop(now time.Time, sojourn time.Duration, backlog, head int) bool {
+	ok := c.okToDrop(now, sojourn, backlog, head)
+	if c.dropping {
+		if !ok {
+			c.dropping = false
+			return false
+		}
+		if now.Before(c.dropNext) {
+			return false
+		}
+		c.count++
+		c.dropNext = c.controlLaw(c.dropNext)
+		return true
+	}
+	if !ok {
+		return false
+	}
+
+	// Enter the dropping state, resuming near the previous drop rate if
+	// it was left only recently
+	c.dropping = true
+	delta := c.count - c.lastCount
+	if delta > 1 && now.Sub(c.dropNext) < 16*c.interval {
+		c.count = delta
+	} else {
+		c.count = 1
+	}
+	c.lastCount = c.count
+	c.dropNext = c.controlLaw(now)
+	return true
+}
+
+// exit leaves the dropping state once the queue runs empty.
+func (c *codel) exit() {
+	c.firstAbove = time.Time{}
+	c.dropping = false
+}
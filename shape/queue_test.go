@@ -0,0 +1,139 @@
+package shape
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ShaperConfig
+		want int
+	}{
+		{"unbounded", ShaperConfig{}, 0},
+		{"bytes", ShaperConfig{QueueLimit: 4096}, 4096},
+		{"time", ShaperConfig{Rate: 1000, Delay: time.Second, QueueTime: 500 * time.Millisecond}, 1500},
+		{"smaller wins", ShaperConfig{Rate: 1000, QueueTime: time.Second, QueueLimit: 100}, 100},
+		{"time without rate", ShaperConfig{QueueTime: time.Second}, 0},
+	}
+	for _, tt := range tests {
+		if got := queueLimit(tt.cfg); got != tt.want {
+			t.Errorf("%s: queueLimit() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, p := range []OverflowPolicy{OverflowBlock, OverflowTailDrop, OverflowCoDel} {
+		got, err := ParseOverflowPolicy(p.String())
+		if err != nil || got != p {
+			t.Errorf("ParseOverflowPolicy(%q) = %v, %v", p.String(), got, err)
+		}
+	}
+	if got, _ := ParseOverflowPolicy("taildrop"); got != OverflowTailDrop {
+		t.Errorf("ParseOverflowPolicy(taildrop) = %v", got)
+	}
+	if _, err := ParseOverflowPolicy("red"); err == nil {
+		t.Error("ParseOverflowPolicy(red) succeeded, want an error")
+	}
+}
+
+// TestShaperQueueBlock fills a 4-byte queue behind a 100ms delay: the
+// reader must stall until the first bytes leave, so the second half of the
+// input enters the shaper, and arrives, 100ms later.
+func TestShaperQueueBlock(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	s := NewShaper(ShaperConfig{Delay: 100 * time.Millisecond, QueueLimit: 4, Clock: fc})
+	dst := &clockWriter{clock: fc}
+
+	done := startVirtual(s, dst, strings.NewReader("abcdefgh"))
+	fc.BlockUntil(1)
+	if got := s.Queued(); got != 4 {
+		t.Errorf("Queued() = %d while blocked, want 4", got)
+	}
+	stepUntil(t, fc, func() bool { return len(done) > 0 })
+
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	want := []timedWrite{
+		{virtualEpoch.Add(100 * time.Millisecond), "abcd"},
+		{virtualEpoch.Add(200 * time.Millisecond), "efgh"},
+	}
+	if len(dst.writes) != len(want) {
+		t.Fatalf("writes = %v, want %v", dst.writes, want)
+	}
+	for i, w := range want {
+		if dst.writes[i].data != w.data || !dst.writes[i].t.Equal(w.t) {
+			t.Errorf("write %d = %v, want %v", i, dst.writes[i], w)
+		}
+	}
+	if s.Queued() != 0 || s.Dropped() != 0 {
+		t.Errorf("after drain Queued() = %d, Dropped() = %d, want 0, 0", s.Queued(), s.Dropped())
+	}
+}
+
+func TestShaperQueueTailDrop(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	s := NewShaper(ShaperConfig{
+		Delay:       100 * time.Millisecond,
+		QueueLimit:  4,
+		QueuePolicy: OverflowTailDrop,
+		Clock:       fc,
+	})
+	dst := &clockWriter{clock: fc}
+
+	done := startVirtual(s, dst, strings.NewReader("hello world"))
+	stepUntil(t, fc, func() bool { return len(done) > 0 })
+
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if dst.String() != "hell" {
+		t.Errorf("output = %q, want %q", dst.String(), "hell")
+	}
+	if got := s.Dropped(); got != 7 {
+		t.Errorf("Dropped() = %d, want 7", got)
+	}
+}
+
+// TestShaperQueueCoDel pushes a large burst into a slow token bucket. With
+// no limit the whole backlog is sent; CoDel sheds pieces from the head
+// once they have queued past the target for an interval.
+func TestShaperQueueCoDel(t *testing.T) {
+	input := bytes.Repeat([]byte("x"), 20000)
+
+	run := func(policy OverflowPolicy) (*Shaper, *clockWriter) {
+		fc := NewFakeClock(virtualEpoch)
+		s := NewShaper(ShaperConfig{Rate: 10000, QueuePolicy: policy, Clock: fc}) // 1000-byte burst
+		dst := &clockWriter{clock: fc}
+		done := startVirtual(s, dst, bytes.NewReader(input))
+		stepUntil(t, fc, func() bool { return len(done) > 0 })
+		if err := <-done; err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		return s, dst
+	}
+
+	s, dst := run(OverflowBlock)
+	if s.Dropped() != 0 || len(dst.String()) != len(input) {
+		t.Fatalf("without CoDel: wrote %d, dropped %d", len(dst.String()), s.Dropped())
+	}
+	plainEnd := dst.writes[len(dst.writes)-1].t
+
+	s, dst = run(OverflowCoDel)
+	written := len(dst.String())
+	if s.Dropped() == 0 {
+		t.Fatal("CoDel dropped nothing from a 2s standing queue")
+	}
+	if int64(written)+s.Dropped() != int64(len(input)) {
+		t.Errorf("written %d + dropped %d != %d", written, s.Dropped(), len(input))
+	}
+	if end := dst.writes[len(dst.writes)-1].t; !end.Before(plainEnd) {
+		t.Errorf("CoDel queue drained at %v, no sooner than without it (%v)",
+			end.Sub(virtualEpoch), plainEnd.Sub(virtualEpoch))
+	}
+}
@@ -0,0 +1,119 @@
+package shape
+
+import "math/bits"
+
+// ring is a FIFO queue on a circular buffer. Unlike re-slicing a slice
+// from the front, it reuses its storage once it has grown to the queue's
+// working size, so a steady stream through it does not allocate.
+type ring[T any] struct {
+	buf  []T
+	head int
+	n    int
+}
+
+func (r *ring[T]) len() int { return r.n }
+
+// push appends v at the back, growing the buffer if it is full.
+func (r *ring[T]) push(v T) {
+	if r.n == len(r.buf) {
+		r.grow()
+	}
+	r.buf[(r.head+r.n)%len(r.buf)] = v
+	r.n++
+}
+
+// front returns a pointer to the oldest element. The queue must not be
+// empty.
+func (r *ring[T]) front() *T {
+	return &r.buf[r.head]
+}
+
+// at returns a pointer to the i'th oldest element.
+func (r *ring[T]) at(i int) *T {
+	return &r.buf[(r.head+i)%len(r.buf)]
+}
+
+// pop removes and returns the oldest element. The queue must not be empty.
+func (r *ring[T]) pop() T {
+	var zero T
+	v := r.buf[r.head]
+	r.buf[r.head] = zero // Don't pin popped data
+	r.head = (r.head + 1) % len(r.buf)
+	r.n--
+	return v
+}
+
+func (r *ring[T]) grow() {
+	size := 2 * len(r.buf)
+	if size == 0 {
+		size = 16
+	}
+	buf := make([]T, size)
+	for i := 0; i < r.n; i++ {
+		buf[i] = *r.at(i)
+	}
+	r.buf, r.head = buf, 0
+}
+
+// Buffer pool size classes: powers of two from 64 bytes to 64KB. Larger
+// buffers are allocated and dropped as needed.
+const (
+	minPoolShift   = 6
+	maxPoolShift   = 16
+	maxPoolRetain  = 64 // Free buffers kept per size class
+	poolClassCount = maxPoolShift - minPoolShift + 1
+)
+
+// bufferPool recycles the buffers a stage copies held data into. Each
+// stage owns one and uses it from the pipeline's goroutine only, so it
+// needs no locking. Buffers are kept in power-of-two size classes so a
+// queue of small chunks does not pin large buffers.
+type bufferPool struct {
+	free [poolClassCount][][]byte
+}
+
+// poolClass returns the size class for n bytes, or -1 if n is too large
+// to pool.
+func poolClass(n int) int {
+	if n <= 1<<minPoolShift {
+		return 0
+	}
+	shift := bits.Len(uint(n - 1))
+	if shift > maxPoolShift {
+		return -1
+	}
+	return shift - minPoolShift
+}
+
+// get returns a pooled buffer of length n.
+func (bp *bufferPool) get(n int) []byte {
+	class := poolClass(n)
+	switch {
+	case class < 0:
+		return make([]byte, n)
+	case len(bp.free[class]) > 0:
+		free := bp.free[class]
+		buf := free[len(free)-1][:n]
+		bp.free[class] = free[:len(free)-1]
+		return buf
+	default:
+		return make([]byte, n, 1<<(class+minPoolShift))
+	}
+}
+
+// clone returns a copy of p in a pooled buffer.
+func (bp *bufferPool) clone(p []byte) []byte {
+	buf := bp.get(len(p))
+	copy(buf, p)
+	return buf
+}
+
+// put returns a buffer obtained from get or clone. The caller must not
+// use it afterwards.
+func (bp *bufferPool) put(buf []byte) {
+	class := poolClass(cap(buf))
+	if class < 0 || cap(buf) != 1<<(class+minPoolShift) || len(bp.free[class]) >= maxPoolRetain {
+		return
+	}
+	bp.free[class] = append(bp.free[class], buf[:0])
+}
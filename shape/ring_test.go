@@ -0,0 +1,46 @@
+package shape
+
+import "testing"
+
+func TestRingWrapsAndGrows(t *testing.T) {
+	var r ring[int]
+	next, want := 0, 0
+	// Interleave pushes and pops so the head wraps around while growing
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 7*round; i++ {
+			r.push(next)
+			next++
+		}
+		for i := 0; i < 5*round && r.len() > 0; i++ {
+			if got := r.pop(); got != want {
+				t.Fatalf("pop() = %d, want %d", got, want)
+			}
+			want++
+		}
+	}
+	for r.len() > 0 {
+		if got := r.pop(); got != want {
+			t.Fatalf("pop() = %d, want %d", got, want)
+		}
+		want++
+	}
+	if want != next {
+		t.Errorf("popped %d values, pushed %d", want, next)
+	}
+}
+
+func TestBufferPoolReuse(t *testing.T) {
+	var bp bufferPool
+	a := bp.clone([]byte("hello"))
+	if string(a) != "hello" || cap(a) != 64 {
+		t.Fatalf("clone = %q (cap %d), want \"hello\" (cap 64)", a, cap(a))
+	}
+	bp.put(a)
+	b := bp.get(40)
+	if &b[:1][0] != &a[:1][0] {
+		t.Error("get did not reuse the buffer handed back to the pool")
+	}
+	if big := bp.get(1 << 20); poolClass(cap(big)) >= 0 {
+		t.Errorf("1MB buffer pooled in class %d", poolClass(cap(big)))
+	}
+}
@@ -0,0 +1,440 @@
+// Package shape simulates slow, laggy links on byte streams. A Shaper
+// applies delay, jitter, rate limiting, chunking and framing to data
+// copied from an io.Reader to an io.Writer; NewReader, NewWriter, NewConn
+// and NewListener put the same conditions on in-process streams and
+// network connections.
+//
+// The ttylag command is a thin PTY wrapper around this package.
+package shape
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Buffer and limit sizes
+const (
+	readBufferSize = 4096  // Size of read buffer for source data
+	readChanBuffer = 16    // Channel buffer for read data
+	maxBurstSize   = 65536 // Cap burst at 64KB to prevent huge initial bursts
+)
+
+// ShaperConfig holds configuration for one direction of traffic shaping.
+type ShaperConfig struct {
+	Delay      time.Duration // Base delay applied to all data
+	Jitter     time.Duration // Jitter scale: Delay ± Jitter under the default uniform distribution
+	Rate       int64         // Bytes per second (0 = unlimited)
+	Burst      int           // Token bucket burst size (0 = auto-calculate)
+	ChunkSize  int           // Max bytes per write (0 = unlimited)
+	FrameTime  time.Duration // Coalesce output interval (0 = disabled)
+	Seed       int64         // Random seed for jitter (0 = use current time)
+	SerialMode bool          // Use wire serialization model (smooth) vs token bucket (bursty)
+	Clock      Clock         // Time source for delays and rate limiting (nil = system clock)
+	Stages     []StageSpec   // Custom stages to add to or replace in the pipeline
+	Observer   Observer      // Receives shaping events as they happen (nil = none)
+
+	// Jitter shape (see JitterDistribution)
+	JitterDist  JitterDistribution // Distribution of jitter (default JitterUniform)
+	JitterShape float64            // Shape parameter for lognormal (σ) and Pareto (α) jitter (0 = default)
+
+	// JitterCorrelation (0 to 1) makes each chunk's jitter depend on the
+	// last one's, so delay drifts instead of changing at random from chunk
+	// to chunk. It also applies to Latency. 0 = independent.
+	JitterCorrelation float64
+
+	// Packet loss, seen on a TCP stream as retransmission stalls (see
+	// lossModel): a chunk with a lost segment is held back, along with
+	// everything after it, for one RTT or a backed-off retransmission
+	// timeout
+	Loss      float64       // Fraction of segments lost (0 = none)
+	LossBurst float64       // Mean run of consecutive losses; above 1 selects Gilbert-Elliott burst loss (0 = independent)
+	RTT       time.Duration // Round-trip time for loss recovery and the window model (0 = twice the base delay)
+
+	// TCP window model (see windowStage): limits the data in flight
+	SlowStart     bool // Start from InitialWindow, double it every RTT, and restart after idle
+	InitialWindow int  // Initial congestion window in segments (0 = 10)
+	ReceiveWindow int  // Max bytes in flight, e.g. an SSH channel window (0 = unlimited)
+
+	// Nagle's algorithm and the peer's delayed ACKs (see windowStage): with
+	// Nagle, less than a full segment is held while data is unacknowledged;
+	// with DelayedACK, the ACK for less than two full segments comes back
+	// that much later than the RTT
+	Nagle      bool
+	DelayedACK time.Duration // Peer's delayed-ACK timer, e.g. 40ms on Linux, 200ms on Windows (0 = ACK at once)
+
+	// Packet layer (see PacketFormats): Rate is charged for the framing of
+	// each packet as well as its data. ChunkSize still sets write sizes.
+	PacketOverhead int // Bytes of protocol framing per packet (0 = charge data only)
+	MTU            int // Packet size, overhead included (0 = 1500); also what a DeliveryTrace carries per opportunity
+
+	// DeliveryTrace, when set, replaces Rate and SerialMode: data crosses
+	// the link only at the delivery opportunities it lists (see
+	// DeliveryTrace). RateVariation, Cross, CarryACKs and Medium need Rate
+	// and have no effect with it.
+	DeliveryTrace *DeliveryTrace
+
+	// RateVariation, when set, varies Rate over time (see RateVariation).
+	// It has no effect on an unlimited link.
+	RateVariation *RateVariation
+
+	// Cross, when set, is background traffic sharing Rate with the data
+	// (see CrossTraffic). It has no effect on an unlimited link.
+	Cross *CrossTraffic
+
+	// ACKs between the two directions of a connection (see ACKPath): the
+	// ACKs for the data this shaper writes are sent over SendACKs, and
+	// those on CarryACKs share Rate like Cross traffic
+	SendACKs  *ACKPath
+	CarryACKs *ACKPath
+
+	// Medium, when set, makes the link half-duplex: Rate is a single
+	// channel shared with the other Shapers on the Medium (see Medium)
+	Medium *Medium
+
+	// Outages, when set, takes the link down at times it describes (see
+	// OutageSchedule)
+	Outages *OutageSchedule
+
+	// Hangup, when set, declares the connection dead under the rules it
+	// holds, and Run then returns ErrHangup (see Hangup)
+	Hangup *Hangup
+
+	// Latency, when set, replaces Delay and Jitter: each chunk is held for
+	// a delay drawn from this measured distribution (see
+	// ReadLatencyDistribution)
+	Latency *LatencyDistribution
+
+	// Queue limits bound the data held in flight. When both are set the
+	// smaller wins; when neither is, the queue is unbounded.
+	QueueLimit    int            // Max bytes held (0 = unlimited)
+	QueueTime     time.Duration  // Max queueing at Rate beyond the bandwidth-delay product (0 = unlimited)
+	QueuePolicy   OverflowPolicy // What to do when the queue is full (default OverflowBlock)
+	CoDelTarget   time.Duration  // OverflowCoDel target sojourn time (0 = 5ms)
+	CoDelInterval time.Duration  // OverflowCoDel interval (0 = 100ms)
+
+	// Spilling keeps long delays (the deep-space profiles) out of RAM
+	DelayMemory int    // Bytes of delayed data held in memory before spilling to disk (0 = never spill)
+	SpillDir    string // Directory for the spill file ("" = os.TempDir())
+}
+
+// Shaper applies delay, jitter, rate limiting, chunking, and framing to a byte stream.
+// It reads from an input channel and writes shaped data to an output writer.
+//
+// Data passes through a pipeline of stages, built from the ShaperConfig:
+//
+//	window → outage → delay → chunk → frame → rate → output
+//
+// Two rate limiting modes are supported:
+//   - Token bucket (default): Bursty output, feels like packet networks
+//   - Wire serialization (SerialMode): Smooth byte-by-byte output, feels like serial links
+//
+// With a DeliveryTrace, the rate stage gives way to one that releases data
+// at the trace's delivery opportunities instead.
+//
+// Custom stages can be added or swapped in through ShaperConfig.Stages.
+// The configuration can be changed while Run is in progress with SetConfig.
+type Shaper struct {
+	clock    Clock
+	pipeline *pipeline
+	queue    *queueGauge
+	stats    shaperStats
+	observer Observer
+	acks     *ACKPath // SendACKs, as the pipeline has it
+
+	mu       sync.Mutex
+	config   ShaperConfig
+	pending  bool          // config changed since the pipeline last saw it
+	reconfig chan struct{} // Wakes Run to apply a pending config
+}
+
+// NewShaper creates a new Shaper with the given configuration.
+// It panics if cfg.Stages refers to an unknown stage, or cfg.DeliveryTrace
+// is empty or out of order.
+func NewShaper(cfg ShaperConfig) *Shaper {
+	clock := configClock(cfg)
+
+	// Initialize random source
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	s := &Shaper{
+		config:   cfg,
+		clock:    clock,
+		queue:    newQueueGauge(cfg),
+		observer: cfg.Observer,
+		acks:     cfg.SendACKs,
+		reconfig: make(chan struct{}, 1),
+	}
+	builder, err := newPipelineBuilder(StageEnv{Config: cfg, Rand: rng, Drop: s.drop})
+	if err != nil {
+		panic("shape: " + err.Error())
+	}
+	s.pipeline = builder.build()
+	return s
+}
+
+// Config returns the Shaper's current configuration.
+func (s *Shaper) Config() ShaperConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+// SetConfig changes the shaping parameters of the Shaper. It is safe to
+// call from any goroutine, before or during Run.
+//
+// Delay, Jitter, JitterDist, JitterShape, JitterCorrelation, Latency, Loss,
+// LossBurst, RTT, SlowStart, InitialWindow, ReceiveWindow, Nagle,
+// DelayedACK, Rate, Burst, ChunkSize, FrameTime, SerialMode, PacketOverhead,
+// MTU, RateVariation, Cross, SendACKs and CarryACKs take effect immediately.
+// Data already in the pipeline is kept: chunks in the delay queue keep the
+// due times they were given, the frame buffer keeps its contents, and data
+// waiting for the rate limiter is re-timed under the new rate (switching
+// between token bucket and wire serialization as needed); a rate variation
+// carries on unless replaced. A lower queue limit does not discard data
+// already held; it only holds back or drops new data until the queue has
+// drained below it. Clock, Seed, Stages, Observer, Medium, Outages, Hangup
+// and DeliveryTrace are fixed at NewShaper time and are ignored here.
+func (s *Shaper) SetConfig(cfg ShaperConfig) {
+	s.mu.Lock()
+	cfg.Clock = s.config.Clock
+	cfg.Seed = s.config.Seed
+	cfg.Stages = s.config.Stages
+	cfg.Observer = s.config.Observer
+	cfg.Medium = s.config.Medium
+	cfg.Outages = s.config.Outages
+	cfg.Hangup = s.config.Hangup
+	cfg.DeliveryTrace = s.config.DeliveryTrace
+	s.config = cfg
+	s.pending = true
+	s.mu.Unlock()
+	s.queue.setConfig(cfg)
+
+	select {
+	case s.reconfig <- struct{}{}:
+	default:
+	}
+}
+
+// Queued returns the number of bytes the Shaper currently holds: read from
+// the source but not yet written or dropped.
+func (s *Shaper) Queued() int {
+	used, _, _ := s.queue.stats()
+	return used
+}
+
+// QueueLimit returns the byte limit in force on the Shaper's queue, or 0 if
+// it is unbounded.
+func (s *Shaper) QueueLimit() int {
+	_, limit, _ := s.queue.stats()
+	return limit
+}
+
+// Dropped returns the number of bytes discarded so far by the overflow
+// policy or by stages.
+func (s *Shaper) Dropped() int64 {
+	_, _, dropped := s.queue.stats()
+	return dropped
+}
+
+// Stats returns a snapshot of the Shaper's counters. It is safe to call
+// from any goroutine, before, during or after Run.
+func (s *Shaper) Stats() Stats {
+	var out Stats
+	s.stats.snapshot(&out)
+	out.BytesQueued, _, out.BytesDropped = s.queue.stats()
+	now := s.clock.Now()
+	for _, stage := range s.pipeline.stages {
+		if r, ok := stage.(statsReporter); ok {
+			r.addStats(now, &out)
+		}
+	}
+	return out
+}
+
+// drop accounts for n bytes a stage discarded.
+func (s *Shaper) drop(n int) {
+	s.queue.drop(n)
+	s.stats.left(s.pipeline.now, n, false)
+}
+
+// applyConfig hands a pending configuration to the pipeline.
+func (s *Shaper) applyConfig() error {
+	s.mu.Lock()
+	cfg, pending := s.config, s.pending
+	s.pending = false
+	s.mu.Unlock()
+
+	if !pending {
+		return nil
+	}
+	s.acks = cfg.SendACKs
+	return s.pipeline.reconfigure(s.clock.Now(), cfg)
+}
+
+// Run processes data from src and writes shaped output to dst.
+// It blocks until ctx is cancelled or src returns an error (including io.EOF).
+// Data is pushed through the pipeline as it arrives and released as each
+// stage comes due.
+func (s *Shaper) Run(ctx context.Context, src io.Reader, dst io.Writer) error {
+	// Channel for data read from source
+	readCh := make(chan []byte, readChanBuffer)
+	readErr := make(chan error, 1)
+
+	// Data counts against the queue from the moment it is read, so a full
+	// queue under OverflowBlock stops the reader before it reads more.
+	defer s.queue.close()
+	defer s.pipeline.close()
+
+	// Read buffers cycle between the reader and the loop, which hands each
+	// back once the pipeline has taken (and, where it holds on to it,
+	// copied) the data.
+	free := make(chan []byte, readChanBuffer+2)
+
+	// Start reader goroutine
+	go func() {
+		defer close(readCh)
+		buf := make([]byte, readBufferSize)
+		for {
+			n, err := src.Read(buf[:s.queue.room(len(buf))])
+			s.stats.read.Add(int64(n))
+			if n = s.queue.admit(n); n > 0 {
+				select {
+				case readCh <- buf[:n]:
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case buf = <-free:
+				default:
+					buf = make([]byte, readBufferSize)
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr <- err
+				}
+				return
+			}
+		}
+	}()
+
+	// Shaped data leaves the last stage here
+	s.pipeline.sink = func(p []byte) error {
+		_, err := dst.Write(p)
+		s.queue.release(len(p))
+		s.stats.left(s.pipeline.now, len(p), true)
+		if s.acks != nil {
+			s.acks.received(s.pipeline.now, len(p))
+		}
+		if s.observer != nil {
+			s.observer.BytesWritten(s.pipeline.now, len(p))
+		}
+		return err
+	}
+
+	// Timer for waking up when the next stage is due. It is only armed
+	// while some stage holds data or, with outages, until the next outage
+	// boundary, and only re-armed when the pipeline's next deadline changes.
+	var wakeTimer Timer
+	var wakeCh <-chan time.Time // Non-nil while wakeTimer is armed
+	var wakeAt time.Time        // Deadline wakeTimer is armed for
+	defer func() {
+		if wakeTimer != nil {
+			wakeTimer.Stop()
+		}
+	}()
+
+	// Once the source is closed the shaper drains whatever is still in the
+	// pipeline, ignoring context cancellation to ensure all buffered data
+	// is written.
+	done := ctx.Done()
+	draining := false
+
+	for {
+		// Calculate next wake time based on the pipeline
+		next, ok := s.pipeline.next()
+		if draining && !ok && s.Queued() > 0 {
+			// Held with nothing due: only a flush will pass it on
+			if err := s.pipeline.flush(s.clock.Now()); err != nil {
+				return err
+			}
+			if next, ok = s.pipeline.next(); !ok && s.Queued() > 0 {
+				return fmt.Errorf("%d bytes held by a stage with nothing due at EOF", s.Queued())
+			}
+		}
+		// Drained once nothing is held, even if a stage still has a
+		// wake-up due
+		if draining && s.Queued() == 0 {
+			return nil
+		}
+		switch {
+		case ok && (wakeCh == nil || !next.Equal(wakeAt)):
+			wait := next.Sub(s.clock.Now())
+			if wakeTimer == nil {
+				wakeTimer = s.clock.NewTimer(wait)
+			} else {
+				wakeTimer.Reset(wait)
+			}
+			wakeCh, wakeAt = wakeTimer.C(), next
+		case !ok && wakeCh != nil:
+			wakeTimer.Stop()
+			wakeCh = nil
+		}
+
+		select {
+		case <-done:
+			return ctx.Err()
+
+		case err := <-readErr:
+			return err
+
+		case data, ok := <-readCh:
+			if !ok {
+				// Source closed, drain remaining data
+				readCh = nil
+				done = nil
+				draining = true
+				if s.observer != nil {
+					s.observer.DrainStarted(s.clock.Now())
+				}
+				continue
+			}
+			now := s.clock.Now()
+			s.stats.arrived(now, len(data))
+			if err := s.pipeline.push(now, data); err != nil {
+				return err
+			}
+			select {
+			case free <- data[:cap(data)]:
+			default:
+			}
+
+		case <-wakeCh:
+			wakeCh = nil
+			// Release whatever has come due
+			if err := s.pipeline.release(s.clock.Now()); err != nil {
+				return err
+			}
+
+		case <-s.reconfig:
+			if err := s.applyConfig(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Copy is a convenience function that creates a Shaper and runs it.
+// It shapes data from src to dst according to cfg.
+func Copy(ctx context.Context, dst io.Writer, src io.Reader, cfg ShaperConfig) error {
+	shaper := NewShaper(cfg)
+	return shaper.Run(ctx, src, dst)
+}
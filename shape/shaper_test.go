@@ -0,0 +1,673 @@
+package shape
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// virtualEpoch is the starting point of virtual time in FakeClock-driven tests.
+var virtualEpoch = time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// copyVirtual runs Copy on a FakeClock, stepping virtual time from one
+// pending timer to the next until the shaper finishes.
+func copyVirtual(t *testing.T, fc *FakeClock, dst io.Writer, src io.Reader, cfg ShaperConfig) error {
+	t.Helper()
+	cfg.Clock = fc
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Copy(context.Background(), dst, src, cfg)
+	}()
+
+	watchdog := time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-watchdog:
+			t.Fatal("virtual copy did not finish within 5s of real time")
+		default:
+		}
+		if !fc.AdvanceToNext() {
+			runtime.Gosched()
+		}
+	}
+}
+
+// timedWrite records a write and the (virtual) time it happened.
+type timedWrite struct {
+	t    time.Time
+	data string
+}
+
+// clockWriter records each write against a clock.
+type clockWriter struct {
+	clock  Clock
+	mu     sync.Mutex
+	writes []timedWrite
+}
+
+func (w *clockWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, timedWrite{w.clock.Now(), string(p)})
+	return len(p), nil
+}
+
+func (w *clockWriter) String() string {
+	var sb strings.Builder
+	for _, wr := range w.writes {
+		sb.WriteString(wr.data)
+	}
+	return sb.String()
+}
+
+func TestShaperDelay(t *testing.T) {
+	cfg := ShaperConfig{
+		Delay: 100 * time.Millisecond,
+		Seed:  42, // Deterministic
+	}
+
+	input := "hello"
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+
+	if err := copyVirtual(t, fc, dst, strings.NewReader(input), cfg); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	if dst.String() != input {
+		t.Errorf("output mismatch: got %q, want %q", dst.String(), input)
+	}
+
+	want := virtualEpoch.Add(100 * time.Millisecond)
+	if len(dst.writes) != 1 || !dst.writes[0].t.Equal(want) {
+		t.Errorf("writes = %v, want a single write at %v", dst.writes, want)
+	}
+}
+
+func TestShaperJitter(t *testing.T) {
+	cfg := ShaperConfig{
+		Delay:  50 * time.Millisecond,
+		Jitter: 30 * time.Millisecond,
+	}
+
+	// Each seed must produce exactly Delay plus the jitter drawn from it
+	for seed := int64(1); seed <= 5; seed++ {
+		cfg.Seed = seed
+		fc := NewFakeClock(virtualEpoch)
+		dst := &clockWriter{clock: fc}
+
+		if err := copyVirtual(t, fc, dst, strings.NewReader("x"), cfg); err != nil {
+			t.Fatalf("Copy failed: %v", err)
+		}
+
+		jitter := time.Duration(rand.New(rand.NewSource(seed)).Int63n(int64(2*cfg.Jitter))) - cfg.Jitter
+		want := virtualEpoch.Add(cfg.Delay + jitter)
+		if len(dst.writes) != 1 || !dst.writes[0].t.Equal(want) {
+			t.Errorf("seed %d: writes = %v, want a single write at %v", seed, dst.writes, want)
+		}
+
+		// Check the delay is within the expected range: [20ms, 80ms] (delay ± jitter)
+		elapsed := dst.writes[0].t.Sub(virtualEpoch)
+		if elapsed < 20*time.Millisecond || elapsed > 80*time.Millisecond {
+			t.Errorf("seed %d: delay %v outside range [20ms, 80ms]", seed, elapsed)
+		}
+	}
+}
+
+func TestShaperRateLimit(t *testing.T) {
+	// Rate limit to 100 bytes/second, so 10 bytes should take ~100ms
+	cfg := ShaperConfig{
+		Rate:  100,
+		Burst: 10, // Small burst to ensure rate limiting kicks in
+		Seed:  42,
+	}
+
+	input := strings.Repeat("x", 20) // 20 bytes
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+
+	if err := copyVirtual(t, fc, dst, strings.NewReader(input), cfg); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	if dst.String() != input {
+		t.Errorf("output mismatch: got %q, want %q", dst.String(), input)
+	}
+
+	// With burst of 10, first 10 bytes are instant, remaining 10 take 100ms
+	want := []time.Time{virtualEpoch, virtualEpoch.Add(100 * time.Millisecond)}
+	if len(dst.writes) != len(want) {
+		t.Fatalf("got %d writes, want %d", len(dst.writes), len(want))
+	}
+	for i, w := range dst.writes {
+		if !w.t.Equal(want[i]) {
+			t.Errorf("write %d at %v, want %v", i, w.t.Sub(virtualEpoch), want[i].Sub(virtualEpoch))
+		}
+	}
+}
+
+func TestShaperChunking(t *testing.T) {
+	cfg := ShaperConfig{
+		ChunkSize: 3,
+		Seed:      42,
+	}
+
+	// Test splitChunks directly
+	input := []byte("hello world")
+	chunks := splitChunks(input, cfg.ChunkSize)
+
+	// "hello world" = 11 bytes, should be 4 chunks: "hel", "lo ", "wor", "ld"
+	expectedChunks := []string{"hel", "lo ", "wor", "ld"}
+	if len(chunks) != len(expectedChunks) {
+		t.Fatalf("chunk count mismatch: got %d, want %d", len(chunks), len(expectedChunks))
+	}
+
+	for i, chunk := range chunks {
+		if string(chunk) != expectedChunks[i] {
+			t.Errorf("chunk %d: got %q, want %q", i, string(chunk), expectedChunks[i])
+		}
+	}
+}
+
+func TestShaperChunkingWrite(t *testing.T) {
+	cfg := ShaperConfig{
+		ChunkSize: 5,
+		Seed:      42,
+	}
+
+	input := "hello world" // 11 bytes
+	src := strings.NewReader(input)
+
+	// Track individual writes
+	tracker := &writeTracker{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := Copy(ctx, tracker, src, cfg)
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	// Check that no write exceeds chunk size
+	for i, w := range tracker.writes {
+		if len(w) > cfg.ChunkSize {
+			t.Errorf("write %d: size %d exceeds chunk size %d", i, len(w), cfg.ChunkSize)
+		}
+	}
+
+	// Check total data is correct
+	if tracker.total.String() != input {
+		t.Errorf("output mismatch: got %q, want %q", tracker.total.String(), input)
+	}
+}
+
+// writeTracker records each write for inspection
+type writeTracker struct {
+	writes [][]byte
+	total  bytes.Buffer
+}
+
+func (w *writeTracker) Write(p []byte) (n int, err error) {
+	// Make a copy since the slice may be reused
+	data := make([]byte, len(p))
+	copy(data, p)
+	w.writes = append(w.writes, data)
+	return w.total.Write(p)
+}
+
+func TestShaperFraming(t *testing.T) {
+	cfg := ShaperConfig{
+		FrameTime: 50 * time.Millisecond,
+		Seed:      42,
+	}
+
+	// Use a slow reader that produces data over time
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("a"))
+		time.Sleep(10 * time.Millisecond)
+		pw.Write([]byte("b"))
+		time.Sleep(10 * time.Millisecond)
+		pw.Write([]byte("c"))
+		pw.Close()
+	}()
+
+	tracker := &writeTracker{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := Copy(ctx, tracker, pr, cfg)
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	// With framing, data should be coalesced into fewer writes
+	// (exact count depends on timing, but should be less than 3)
+	if tracker.total.String() != "abc" {
+		t.Errorf("output mismatch: got %q, want %q", tracker.total.String(), "abc")
+	}
+}
+
+func TestShaperNoConfig(t *testing.T) {
+	// Test with empty config (passthrough mode)
+	cfg := ShaperConfig{}
+
+	input := "hello world"
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+
+	if err := copyVirtual(t, fc, dst, strings.NewReader(input), cfg); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	if dst.String() != input {
+		t.Errorf("output mismatch: got %q, want %q", dst.String(), input)
+	}
+
+	// Should be instant: no virtual time may pass
+	for i, w := range dst.writes {
+		if !w.t.Equal(virtualEpoch) {
+			t.Errorf("write %d delayed by %v in passthrough mode", i, w.t.Sub(virtualEpoch))
+		}
+	}
+}
+
+func TestShaperContextCancel(t *testing.T) {
+	cfg := ShaperConfig{
+		Delay: 1 * time.Second, // Long delay
+	}
+
+	// Use a reader that blocks
+	pr, pw := io.Pipe()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		pw.Write([]byte("data"))
+		// Don't close - let context cancel handle it
+	}()
+
+	var dst bytes.Buffer
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := Copy(ctx, &dst, pr, cfg)
+	elapsed := time.Since(start)
+
+	// Should be cancelled, not timeout
+	if err != context.DeadlineExceeded {
+		// Either deadline exceeded or context cancelled is fine
+		if err != context.Canceled && err != context.DeadlineExceeded {
+			t.Logf("Unexpected error type: %v (elapsed: %v)", err, elapsed)
+		}
+	}
+
+	// Should cancel reasonably quickly
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("cancel took too long: %v", elapsed)
+	}
+}
+
+// TestShaperBandwidthVerification replicates the bandwidth verification test
+// from a competing implementation. Tests 10 kbit/s throughput with 5000 bytes.
+func TestShaperBandwidthVerification(t *testing.T) {
+	// 10 kbit/s = 1250 bytes/sec
+	// 5000 bytes should take ~4 seconds
+	cfg := ShaperConfig{
+		Rate:      1250, // 10 kbit/s in bytes
+		ChunkSize: 1024,
+		Seed:      42,
+	}
+
+	input := make([]byte, 5000)
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+
+	if err := copyVirtual(t, fc, dst, bytes.NewReader(input), cfg); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	if got := len(dst.String()); got != 5000 {
+		t.Errorf("output size mismatch: got %d, want 5000", got)
+	}
+
+	// The first chunk rides on the initial burst (one chunk); the remaining
+	// 3976 bytes drain at exactly 1250 bytes/sec.
+	duration := dst.writes[len(dst.writes)-1].t.Sub(virtualEpoch)
+	want := 3180800 * time.Microsecond
+	if diff := duration - want; diff < -time.Microsecond || diff > time.Microsecond {
+		t.Errorf("transfer took %v, want %v", duration, want)
+	}
+
+	bps := float64(5000*8) / duration.Seconds()
+	t.Logf("Rate over 5000 bytes: %.2f bits/sec (target: 10000 plus one-chunk burst)", bps)
+}
+
+// TestShaperJitterVerificationBaseline replicates the jitter baseline test.
+// 100 baud = 10 bytes/sec with 10 bits/byte, so ~100ms per byte.
+func TestShaperJitterVerificationBaseline(t *testing.T) {
+	// 100 baud with 10 bits per byte = 10 bytes/sec = 100ms per byte
+	cfg := ShaperConfig{
+		Rate: 10, // 10 bytes/sec
+		Seed: 42,
+	}
+
+	// Send 10 bytes, measure inter-arrival times
+	input := make([]byte, 10)
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+
+	if err := copyVirtual(t, fc, dst, bytes.NewReader(input), cfg); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	if len(dst.writes) != 10 {
+		t.Fatalf("got %d writes, want 10 (burst is one byte)", len(dst.writes))
+	}
+
+	// Every inter-arrival time must be exactly 100ms
+	for i := 1; i < len(dst.writes); i++ {
+		if delta := dst.writes[i].t.Sub(dst.writes[i-1].t); delta != 100*time.Millisecond {
+			t.Errorf("inter-arrival %d: got %v, want 100ms", i, delta)
+		}
+	}
+}
+
+// TestShaperSerialMode tests the wire serialization model used for serial connections.
+// This produces smooth, byte-by-byte output instead of bursty token bucket output.
+func TestShaperSerialMode(t *testing.T) {
+	// 100 bytes/sec in serial mode = 10ms per byte
+	// 10 bytes should take exactly 100ms with smooth timing
+	cfg := ShaperConfig{
+		Rate:       100,
+		SerialMode: true,
+		Seed:       42,
+	}
+
+	input := strings.Repeat("x", 10) // 10 bytes
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+
+	if err := copyVirtual(t, fc, dst, strings.NewReader(input), cfg); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	// Verify output content
+	if dst.String() != input {
+		t.Errorf("output mismatch: got %q, want %q", dst.String(), input)
+	}
+
+	// Serial mode writes byte-by-byte
+	if len(dst.writes) != 10 {
+		t.Fatalf("serial mode should write byte-by-byte: got %d writes, want 10", len(dst.writes))
+	}
+
+	// Byte i leaves the wire (i+1) byte times after the start
+	for i, w := range dst.writes {
+		if len(w.data) != 1 {
+			t.Errorf("write %d: got %d bytes, want 1", i, len(w.data))
+		}
+		if want := virtualEpoch.Add(time.Duration(i+1) * 10 * time.Millisecond); !w.t.Equal(want) {
+			t.Errorf("write %d at %v, want %v", i, w.t.Sub(virtualEpoch), want.Sub(virtualEpoch))
+		}
+	}
+}
+
+// TestShaperSerialModeVsTokenBucket verifies that serial mode produces
+// smoother timing than token bucket mode.
+func TestShaperSerialModeVsTokenBucket(t *testing.T) {
+	// Send 5 bytes, measure inter-write times
+	// At 50 bytes/sec, each byte should take 20ms
+
+	measureWriteTimes := func(serialMode bool) []time.Duration {
+		cfg := ShaperConfig{
+			Rate:       50, // 50 bytes/sec = 20ms per byte
+			SerialMode: serialMode,
+			Seed:       42,
+		}
+
+		fc := NewFakeClock(virtualEpoch)
+		dst := &clockWriter{clock: fc}
+		if err := copyVirtual(t, fc, dst, strings.NewReader("12345"), cfg); err != nil {
+			t.Fatalf("Copy failed: %v", err)
+		}
+
+		// Calculate deltas
+		var deltas []time.Duration
+		for i := 1; i < len(dst.writes); i++ {
+			deltas = append(deltas, dst.writes[i].t.Sub(dst.writes[i-1].t))
+		}
+		return deltas
+	}
+
+	serialDeltas := measureWriteTimes(true)
+	tokenDeltas := measureWriteTimes(false)
+
+	t.Logf("Serial mode inter-write times: %v", serialDeltas)
+	t.Logf("Token bucket inter-write times: %v", tokenDeltas)
+
+	// Serial mode writes every byte separately, evenly spaced
+	if len(serialDeltas) != 4 {
+		t.Fatalf("serial mode: got %d deltas, want 4", len(serialDeltas))
+	}
+	for i, d := range serialDeltas {
+		if d != 20*time.Millisecond {
+			t.Errorf("serial delta %d: got %v, want 20ms", i, d)
+		}
+	}
+
+	// Token bucket fits all 5 bytes in its initial burst (one 5-byte
+	// write), so it is burstier than the wire model
+	if len(tokenDeltas) >= len(serialDeltas) {
+		t.Errorf("token bucket made %d deltas, expected fewer than serial mode's %d", len(tokenDeltas), len(serialDeltas))
+	}
+}
+
+// TestShaperMarsFarVirtual runs a 44-minute round-trip profile in virtual
+// time and checks the downstream arrival to the nanosecond.
+func TestShaperMarsFarVirtual(t *testing.T) {
+	p := Profiles["mars-far"]
+	cfg := ShaperConfig{
+		Delay:  p.RTT / 2,
+		Jitter: p.Jitter,
+		Rate:   p.DownRate,
+		Seed:   7,
+	}
+
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+	if err := copyVirtual(t, fc, dst, strings.NewReader("ls\n"), cfg); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	jitter := time.Duration(rand.New(rand.NewSource(cfg.Seed)).Int63n(int64(2*cfg.Jitter))) - cfg.Jitter
+	want := virtualEpoch.Add(22*time.Minute + jitter)
+	if len(dst.writes) != 1 || !dst.writes[0].t.Equal(want) {
+		t.Fatalf("writes = %v, want a single write at %v", dst.writes, want)
+	}
+	if dst.writes[0].data != "ls\n" {
+		t.Errorf("output mismatch: got %q", dst.writes[0].data)
+	}
+}
+
+// TestShaper300BaudTransfer checks every byte of a 300 baud serial transfer
+// leaves the wire k/Rate seconds after the transfer began, with no rounding
+// drift: the 300th byte lands at exactly 10s.
+func TestShaper300BaudTransfer(t *testing.T) {
+	cfg := ShaperConfig{
+		Rate:       300 / 10, // 300 baud, 8N1
+		SerialMode: true,
+	}
+
+	input := strings.Repeat("0123456789", 30) // 300 bytes, 10s on the wire
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+	if err := copyVirtual(t, fc, dst, strings.NewReader(input), cfg); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	if dst.String() != input {
+		t.Fatalf("output mismatch: got %d bytes", len(dst.String()))
+	}
+	for i, w := range dst.writes {
+		if len(w.data) != 1 {
+			t.Fatalf("write %d is %d bytes, want one byte per write at 300 baud", i, len(w.data))
+		}
+		// Byte k is on the wire once k/Rate seconds have passed
+		elapsed := (int64(i+1)*int64(time.Second) + cfg.Rate - 1) / cfg.Rate
+		if want := virtualEpoch.Add(time.Duration(elapsed)); !w.t.Equal(want) {
+			t.Fatalf("byte %d at %v, want %v", i, w.t.Sub(virtualEpoch), want.Sub(virtualEpoch))
+		}
+	}
+}
+
+// startVirtual starts s on a FakeClock-driven copy and returns a channel
+// that yields Run's result. The caller steps the clock.
+func startVirtual(s *Shaper, dst io.Writer, src io.Reader) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(context.Background(), src, dst)
+	}()
+	return done
+}
+
+// stepUntil advances fc from timer to timer until cond holds.
+func stepUntil(t *testing.T, fc *FakeClock, cond func() bool) {
+	t.Helper()
+	watchdog := time.After(5 * time.Second)
+	for !cond() {
+		select {
+		case <-watchdog:
+			t.Fatal("condition not reached within 5s of real time")
+		default:
+		}
+		if !fc.AdvanceToNext() {
+			runtime.Gosched()
+		}
+	}
+}
+
+// waitApplied blocks until the Run loop has picked up a SetConfig call.
+func waitApplied(t *testing.T, s *Shaper) {
+	t.Helper()
+	for len(s.reconfig) > 0 {
+		runtime.Gosched()
+	}
+}
+
+func (w *clockWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.writes)
+}
+
+// TestShaperSetConfigSwitchesRateMode starts on a slow token bucket and
+// switches to a faster wire-serialization link with bytes still queued.
+func TestShaperSetConfigSwitchesRateMode(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	s := NewShaper(ShaperConfig{Rate: 10, Clock: fc}) // 1-byte burst, 100ms/byte
+	dst := &clockWriter{clock: fc}
+
+	input := "0123456789abcdefghij"
+	done := startVirtual(s, dst, strings.NewReader(input))
+
+	stepUntil(t, fc, func() bool { return dst.count() >= 5 })
+	s.SetConfig(ShaperConfig{Rate: 100, SerialMode: true}) // 10ms/byte
+	waitApplied(t, s)
+	stepUntil(t, fc, func() bool { return len(done) > 0 })
+
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if dst.String() != input {
+		t.Fatalf("output = %q, want %q", dst.String(), input)
+	}
+
+	for i := 1; i < 5; i++ {
+		if d := dst.writes[i].t.Sub(dst.writes[i-1].t); d != 100*time.Millisecond {
+			t.Errorf("gap %d before switch = %v, want 100ms", i, d)
+		}
+	}
+	// The loop may see the change one timer later than the test made it,
+	// so only check well clear of the switch.
+	for i := 8; i < len(dst.writes); i++ {
+		if d := dst.writes[i].t.Sub(dst.writes[i-1].t); d != 10*time.Millisecond {
+			t.Errorf("gap %d after switch = %v, want 10ms", i, d)
+		}
+	}
+}
+
+// TestShaperSetConfigKeepsDelayQueue lowers the delay while a chunk is in
+// flight: the queued chunk keeps its due time and later data uses the new one.
+func TestShaperSetConfigKeepsDelayQueue(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	s := NewShaper(ShaperConfig{Delay: time.Second, Clock: fc})
+	dst := &clockWriter{clock: fc}
+
+	pr, pw := io.Pipe()
+	done := startVirtual(s, dst, pr)
+
+	pw.Write([]byte("a"))
+	fc.BlockUntil(1) // "a" is queued
+	s.SetConfig(ShaperConfig{Delay: 10 * time.Millisecond})
+	waitApplied(t, s)
+
+	stepUntil(t, fc, func() bool { return dst.count() == 1 })
+	pw.Write([]byte("b"))
+	pw.Close()
+	stepUntil(t, fc, func() bool { return len(done) > 0 })
+
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	want := []timedWrite{
+		{virtualEpoch.Add(time.Second), "a"},
+		{virtualEpoch.Add(time.Second + 10*time.Millisecond), "b"},
+	}
+	if len(dst.writes) != len(want) {
+		t.Fatalf("writes = %v, want %v", dst.writes, want)
+	}
+	for i, w := range want {
+		if dst.writes[i].data != w.data || !dst.writes[i].t.Equal(w.t) {
+			t.Errorf("write %d = %v, want %v", i, dst.writes[i], w)
+		}
+	}
+}
+
+// TestShaperSetConfigUnlimitedFlushesRateQueue lifts the rate limit while
+// data is waiting for tokens; it must go out immediately.
+func TestShaperSetConfigUnlimitedFlushesRateQueue(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	s := NewShaper(ShaperConfig{Rate: 1, Clock: fc}) // 1 byte per second
+	dst := &clockWriter{clock: fc}
+
+	done := startVirtual(s, dst, strings.NewReader("hello"))
+	fc.BlockUntil(1) // "h" written, "ello" waiting for tokens
+	s.SetConfig(ShaperConfig{})
+	// No clock steps: the queued data must go out at the current time
+	for len(done) == 0 {
+		runtime.Gosched()
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if dst.String() != "hello" {
+		t.Fatalf("output = %q", dst.String())
+	}
+	last := dst.writes[len(dst.writes)-1]
+	if !last.t.Equal(virtualEpoch) {
+		t.Errorf("queued data written at %v, want immediately", last.t.Sub(virtualEpoch))
+	}
+}
@@ -0,0 +1,99 @@
+package shape
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// spillHeaderSize is the size of a spilled record's header: the due time
+// in Unix nanoseconds followed by the data length.
+const spillHeaderSize = 8 + 4
+
+// spillFile is a FIFO of delayed chunks kept in a temporary file, so the
+// delay stage can hold hours of data for deep-space profiles without
+// keeping it in RAM.
+//
+// The file is unlinked as soon as it is created, so the kernel reclaims it
+// when the process exits, even after a crash. Where an open file cannot be
+// unlinked, it is removed on Close instead.
+type spillFile struct {
+	f        *os.File
+	name     string // Set only if the file still has to be removed on Close
+	readOff  int64
+	writeOff int64
+	count    int // Records not yet read back
+	hdr      [spillHeaderSize]byte
+}
+
+func openSpillFile(dir string) (*spillFile, error) {
+	f, err := os.CreateTemp(dir, "ttylag-spill-*")
+	if err != nil {
+		return nil, fmt.Errorf("delay spill: %w", err)
+	}
+	s := &spillFile{f: f}
+	if err := os.Remove(f.Name()); err != nil {
+		s.name = f.Name()
+	}
+	return s, nil
+}
+
+// push appends a chunk due at dueTime.
+func (s *spillFile) push(dueTime time.Time, data []byte) error {
+	binary.BigEndian.PutUint64(s.hdr[:8], uint64(dueTime.UnixNano()))
+	binary.BigEndian.PutUint32(s.hdr[8:], uint32(len(data)))
+	if _, err := s.f.WriteAt(s.hdr[:], s.writeOff); err != nil {
+		return fmt.Errorf("delay spill: %w", err)
+	}
+	if _, err := s.f.WriteAt(data, s.writeOff+spillHeaderSize); err != nil {
+		return fmt.Errorf("delay spill: %w", err)
+	}
+	s.writeOff += spillHeaderSize + int64(len(data))
+	s.count++
+	return nil
+}
+
+// pop reads back the oldest chunk into a buffer from pool. Once the file
+// has been read to the end it is truncated, so its size tracks what is
+// still spilled.
+func (s *spillFile) pop(pool *bufferPool) (delayedChunk, error) {
+	if s.count == 0 {
+		return delayedChunk{}, errors.New("delay spill: pop from empty file")
+	}
+	if _, err := s.f.ReadAt(s.hdr[:], s.readOff); err != nil {
+		return delayedChunk{}, fmt.Errorf("delay spill: %w", err)
+	}
+	due := int64(binary.BigEndian.Uint64(s.hdr[:8]))
+	data := pool.get(int(binary.BigEndian.Uint32(s.hdr[8:])))
+	if _, err := s.f.ReadAt(data, s.readOff+spillHeaderSize); err != nil && err != io.EOF {
+		return delayedChunk{}, fmt.Errorf("delay spill: %w", err)
+	}
+	s.readOff += spillHeaderSize + int64(len(data))
+	s.count--
+
+	if s.count == 0 {
+		s.readOff, s.writeOff = 0, 0
+		if err := s.f.Truncate(0); err != nil {
+			return delayedChunk{}, fmt.Errorf("delay spill: %w", err)
+		}
+	}
+	return delayedChunk{data: data, dueTime: time.Unix(0, due)}, nil
+}
+
+// size returns the number of data bytes not yet read back.
+func (s *spillFile) size() int {
+	return int(s.writeOff-s.readOff) - s.count*spillHeaderSize
+}
+
+func (s *spillFile) Close() error {
+	err := s.f.Close()
+	if s.name != "" {
+		if rerr := os.Remove(s.name); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package shape
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestDelayStageSpill drives a spilling delay stage and an in-memory one
+// through the same arrivals and checks that they release identical data
+// at identical times, while the spilling one stays within its budget and
+// leaves nothing behind in its spill directory.
+func TestDelayStageSpill(t *testing.T) {
+	const budget = 100
+	dir := t.TempDir()
+	cfg := ShaperConfig{Delay: time.Second, Jitter: 200 * time.Millisecond}
+
+	plain := newDelayStage(cfg, rand.New(rand.NewSource(7)))
+	cfg.DelayMemory, cfg.SpillDir = budget, dir
+	spilling := newDelayStage(cfg, rand.New(rand.NewSource(7)))
+	defer spilling.Close()
+
+	type release struct {
+		t    time.Time
+		data string
+	}
+	drive := func(d *delayStage, now time.Time, chunk []byte) []release {
+		var out []release
+		emit := func(p []byte) error {
+			out = append(out, release{now, string(p)})
+			return nil
+		}
+		if chunk != nil {
+			if err := d.Push(now, chunk, emit); err != nil {
+				t.Fatalf("Push: %v", err)
+			}
+		}
+		if next, ok := d.Next(); ok && !next.After(now) {
+			if err := d.Release(now, emit); err != nil {
+				t.Fatalf("Release: %v", err)
+			}
+		}
+		return out
+	}
+
+	var want, got []release
+	spilled := false
+	for i := 0; i < 200; i++ {
+		now := virtualEpoch.Add(time.Duration(i) * 10 * time.Millisecond)
+		var chunk []byte
+		if i < 50 {
+			chunk = []byte(fmt.Sprintf("chunk %02d of thirty bytes....", i))
+		}
+		want = append(want, drive(plain, now, chunk)...)
+		got = append(got, drive(spilling, now, chunk)...)
+
+		// A refill may overshoot the budget by one chunk
+		if spilling.queued > budget+30 {
+			t.Fatalf("step %d: %d bytes in memory, budget %d", i, spilling.queued, budget)
+		}
+		if spilling.spilled() {
+			spilled = true
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Fatalf("spill file left visible in %s: %v", dir, entries)
+			}
+		}
+	}
+
+	if !spilled {
+		t.Fatal("nothing was spilled to disk")
+	}
+	if len(got) != 50 || len(want) != 50 {
+		t.Fatalf("released %d chunks spilling, %d in memory, want 50", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].data != want[i].data || !got[i].t.Equal(want[i].t) {
+			t.Errorf("release %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if spilling.spill.writeOff != 0 {
+		t.Errorf("spill file not truncated after draining: %d bytes", spilling.spill.writeOff)
+	}
+}
@@ -0,0 +1,920 @@
+package shape
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// delayedChunk represents data waiting to be released after its due time.
+type delayedChunk struct {
+	data    []byte
+	dueTime time.Time
+}
+
+// delayStage holds each chunk for Delay plus a random jitter drawn from
+// JitterDist, or for a delay drawn from Latency when that is set, plus any
+// retransmission stall from Loss. Chunks leave in arrival order, so a chunk
+// with a short delay waits behind an earlier one with a long delay, as on an
+// ordered byte stream.
+//
+// With DelayMemory set, chunks beyond that many bytes are spilled to a
+// temporary file and read back, in order, as the chunks held in memory
+// leave.
+type delayStage struct {
+	delay  time.Duration
+	jitter jitterSampler
+	loss   lossModel
+	queue  ring[delayedChunk]
+	queued int // Bytes in queue
+	pool   bufferPool
+
+	budget   int        // DelayMemory
+	spillDir string     // Where to create the spill file
+	spill    *spillFile // Created on first spill
+	obs      Observer
+
+	// Queue depth for Stats, including spilled chunks
+	depthBytes  atomic.Int64
+	depthChunks atomic.Int64
+
+	// Loss figures for Stats
+	stallEnd time.Time    // When the latest retransmission stall ends
+	lost     atomic.Int64 // Segments
+	stalled  atomic.Int64 // Time with a stall pending, in nanoseconds
+}
+
+func newDelayStage(cfg ShaperConfig, rng *rand.Rand) *delayStage {
+	return &delayStage{
+		delay:    baseDelay(cfg),
+		jitter:   newJitterSampler(cfg, rng),
+		loss:     newLossModel(cfg, rng),
+		budget:   cfg.DelayMemory,
+		spillDir: cfg.SpillDir,
+		obs:      cfg.Observer,
+	}
+}
+
+// spilled reports whether any chunks are waiting on disk.
+func (d *delayStage) spilled() bool {
+	return d.spill != nil && d.spill.count > 0
+}
+
+func (d *delayStage) Push(now time.Time, p []byte, emit Emit) error {
+	// Calculate due time with jitter and any retransmission stall
+	jitter := d.jitter.sample()
+	totalDelay := d.delay + jitter
+	if totalDelay < 0 {
+		totalDelay = 0
+	}
+	lost, stall := d.loss.stall(now, len(p))
+	if lost > 0 {
+		totalDelay += stall
+		d.lost.Add(int64(lost))
+		// Overlapping stalls count once
+		if end := now.Add(stall); end.After(d.stallEnd) {
+			start := now
+			if d.stallEnd.After(now) {
+				start = d.stallEnd
+			}
+			d.stalled.Add(int64(end.Sub(start)))
+			d.stallEnd = end
+		}
+		if d.obs != nil {
+			d.obs.SegmentsLost(now, lost, stall)
+		}
+	}
+	dueTime := now.Add(totalDelay)
+	if d.obs != nil {
+		d.obs.ChunkDelayed(now, len(p), jitter, dueTime)
+	}
+
+	if d.queue.len() == 0 && !dueTime.After(now) {
+		if d.obs != nil {
+			d.obs.ChunkReleased(now, len(p), dueTime)
+		}
+		return emit(p)
+	}
+
+	// Once anything is on disk, later chunks must queue behind it there
+	if d.spilled() || (d.budget > 0 && d.queue.len() > 0 && d.queued+len(p) > d.budget) {
+		if d.spill == nil {
+			spill, err := openSpillFile(d.spillDir)
+			if err != nil {
+				return err
+			}
+			d.spill = spill
+		}
+		err := d.spill.push(dueTime, p)
+		d.publish()
+		return err
+	}
+
+	d.queue.push(delayedChunk{data: d.pool.clone(p), dueTime: dueTime})
+	d.queued += len(p)
+	d.publish()
+	return nil
+}
+
+// publish updates the queue depth reported by Stats.
+func (d *delayStage) publish() {
+	bytes, chunks := d.queued, d.queue.len()
+	if d.spill != nil {
+		bytes += d.spill.size()
+		chunks += d.spill.count
+	}
+	d.depthBytes.Store(int64(bytes))
+	d.depthChunks.Store(int64(chunks))
+}
+
+func (d *delayStage) addStats(now time.Time, out *Stats) {
+	out.DelayQueueBytes = int(d.depthBytes.Load())
+	out.DelayQueueChunks = int(d.depthChunks.Load())
+	out.SegmentsLost = d.lost.Load()
+	out.LossStall = time.Duration(d.stalled.Load())
+}
+
+// refill reads spilled chunks back into memory once the in-memory queue
+// has run dry: at least one, and then more until the budget is reached
+// (the last may overshoot it by up to one chunk).
+func (d *delayStage) refill() error {
+	for d.spilled() && (d.queue.len() == 0 || d.queued < d.budget) {
+		chunk, err := d.spill.pop(&d.pool)
+		if err != nil {
+			return err
+		}
+		d.queue.push(chunk)
+		d.queued += len(chunk.data)
+	}
+	return nil
+}
+
+// Reconfigure applies the new delay, jitter and loss to chunks pushed from
+// now on. Chunks already queued keep their due times, like packets in
+// flight.
+func (d *delayStage) Reconfigure(now time.Time, cfg ShaperConfig, emit Emit) error {
+	d.delay = baseDelay(cfg)
+	d.jitter.configure(cfg)
+	d.loss.configure(cfg)
+	d.budget = cfg.DelayMemory
+	return nil
+}
+
+// Close removes the spill file, if one was created.
+func (d *delayStage) Close() error {
+	if d.spill == nil {
+		return nil
+	}
+	err := d.spill.Close()
+	d.spill = nil
+	return err
+}
+
+func (d *delayStage) Next() (time.Time, bool) {
+	if d.queue.len() == 0 {
+		return time.Time{}, false
+	}
+	return d.queue.front().dueTime, true
+}
+
+func (d *delayStage) Release(now time.Time, emit Emit) error {
+	defer d.publish()
+	for d.queue.len() > 0 && !d.queue.front().dueTime.After(now) {
+		chunk := d.queue.pop()
+		d.queued -= len(chunk.data)
+		if d.obs != nil {
+			d.obs.ChunkReleased(now, len(chunk.data), chunk.dueTime)
+		}
+		err := emit(chunk.data)
+		d.pool.put(chunk.data)
+		if err != nil {
+			return err
+		}
+		if d.queue.len() == 0 {
+			if err := d.refill(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// chunkStage splits data into pieces of at most size bytes.
+type chunkStage struct {
+	size int
+}
+
+func newChunkStage(size int) *chunkStage {
+	return &chunkStage{size: size}
+}
+
+func (c *chunkStage) Push(now time.Time, p []byte, emit Emit) error {
+	for len(p) > 0 {
+		piece := nextChunk(p, c.size)
+		if err := emit(piece); err != nil {
+			return err
+		}
+		p = p[len(piece):]
+	}
+	return nil
+}
+
+func (c *chunkStage) Reconfigure(now time.Time, cfg ShaperConfig, emit Emit) error {
+	c.size = cfg.ChunkSize
+	return nil
+}
+
+func (c *chunkStage) Next() (time.Time, bool)                { return time.Time{}, false }
+func (c *chunkStage) Release(now time.Time, emit Emit) error { return nil }
+
+// nextChunk returns the first piece of data when split into chunks of at
+// most size bytes (0 = unlimited).
+func nextChunk(data []byte, size int) []byte {
+	if size <= 0 || len(data) <= size {
+		return data
+	}
+	return data[:size]
+}
+
+// splitChunks splits data into chunks of at most size bytes.
+// If size is 0, returns the data as a single chunk. The chunks share
+// data's backing array.
+func splitChunks(data []byte, size int) [][]byte {
+	if size <= 0 || len(data) <= size {
+		return [][]byte{data}
+	}
+
+	chunks := make([][]byte, 0, (len(data)+size-1)/size)
+	for len(data) > 0 {
+		end := size
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, data[:end])
+		data = data[end:]
+	}
+	return chunks
+}
+
+// frameStage coalesces data and releases it in one burst per interval.
+// Frame boundaries fall on a fixed grid anchored at the first data seen.
+type frameStage struct {
+	interval time.Duration
+	buffer   []byte
+	nextTick time.Time
+	flushes  atomic.Int64 // Frames released, for Stats
+	obs      Observer
+}
+
+func newFrameStage(interval time.Duration, obs Observer) *frameStage {
+	return &frameStage{interval: interval, obs: obs}
+}
+
+func (f *frameStage) Push(now time.Time, p []byte, emit Emit) error {
+	if f.interval <= 0 {
+		return emit(p)
+	}
+	if f.nextTick.IsZero() {
+		f.nextTick = now.Add(f.interval)
+	}
+	f.advanceTick(now)
+	f.buffer = append(f.buffer, p...)
+	return nil
+}
+
+// advanceTick moves the next frame boundary past now.
+func (f *frameStage) advanceTick(now time.Time) {
+	for !f.nextTick.After(now) {
+		f.nextTick = f.nextTick.Add(f.interval)
+	}
+}
+
+// Reconfigure switches to the new frame interval. Turning framing off
+// releases the buffered frame at once; otherwise the grid is re-anchored at
+// now and the buffer goes out at the next boundary.
+func (f *frameStage) Reconfigure(now time.Time, cfg ShaperConfig, emit Emit) error {
+	if cfg.FrameTime == f.interval {
+		return nil
+	}
+	f.interval = cfg.FrameTime
+	if f.interval <= 0 {
+		f.nextTick = time.Time{}
+		if len(f.buffer) == 0 {
+			return nil
+		}
+		return f.flush(now, emit)
+	}
+	f.nextTick = now.Add(f.interval)
+	return nil
+}
+
+// flush releases the buffered frame.
+func (f *frameStage) flush(now time.Time, emit Emit) error {
+	f.flushes.Add(1)
+	if f.obs != nil {
+		f.obs.FrameFlushed(now, len(f.buffer))
+	}
+	err := emit(f.buffer)
+	f.buffer = f.buffer[:0]
+	return err
+}
+
+func (f *frameStage) addStats(now time.Time, out *Stats) {
+	out.FrameFlushes = f.flushes.Load()
+}
+
+func (f *frameStage) Next() (time.Time, bool) {
+	if len(f.buffer) == 0 {
+		return time.Time{}, false
+	}
+	return f.nextTick, true
+}
+
+func (f *frameStage) Release(now time.Time, emit Emit) error {
+	f.advanceTick(now)
+	if len(f.buffer) == 0 {
+		return nil
+	}
+	return f.flush(now, emit)
+}
+
+// rateStage limits throughput to Rate bytes per second using one of two
+// models:
+//   - Token bucket (default): Bursty output, feels like packet networks
+//   - Wire serialization (SerialMode): Smooth byte-by-byte output, feels like serial links
+//
+// With a packet layer (PacketOverhead), each packet's framing is charged
+// against the bucket or the wire along with its data.
+//
+// With a Medium the stage shares its token bucket or wire with the stage
+// for the opposite direction, and each change of direction waits for the
+// line to turn round. In serial mode the wire is booked a queued piece at
+// a time.
+//
+// Cross traffic, and ACKs for the opposite direction (CarryACKs), take
+// tokens or wire time as they arrive, up to the bottleneck buffer, so
+// terminal data that arrives after them waits behind them. They are
+// charged lazily at each Push and Release, in arrival order.
+//
+// Under OverflowCoDel the queue is managed by CoDel, which drops pieces
+// that waited too long as they reach the head.
+//
+// With a RateVariation the stage follows it lazily, at each Push and
+// Release, and while it holds data also wakes for each change; a change
+// re-times the queue as Reconfigure does.
+type rateStage struct {
+	base    ShaperConfig   // As last configured, before any variation
+	vary    *rateVariation // Non-nil with a rate variation on a limited link
+	rate    int64
+	serial  bool
+	burst   int
+	pk      packetizer
+	piece   int               // Max bytes per queued piece in token bucket mode: whole packets within burst
+	framed  bool              // In serial mode, the framing of the head's current packet is on the wire
+	limiter *rate.Limiter     // Used in token bucket mode
+	res     *rate.Reservation // Tokens reserved for the head of the queue
+	wire    wire              // Used in serial mode
+	queue   ring[queuedPiece] // Pieces waiting for the wire or for tokens
+	queued  int               // Bytes in queue
+	readyAt time.Time         // When the head of the queue may be written
+	pool    bufferPool        // Buffers for queued pieces
+	cross   *crossSource      // Non-nil with cross traffic
+	acks    *ACKPath          // CarryACKs
+	medium  *Medium           // Half-duplex line shared with the other direction
+	charged time.Time         // Latest time other traffic was charged up to
+	rng     *rand.Rand        // For cross traffic
+	codel   *codel            // Non-nil under OverflowCoDel
+	drop    func(n int)       // Reports pieces CoDel discards
+	obs     Observer
+
+	// For Stats
+	wait       waitTimer    // Time spent holding data back
+	current    atomic.Int64 // rate
+	crossBytes atomic.Int64
+	ackBytes   atomic.Int64
+}
+
+// queuedPiece is data waiting in the rate stage and when it arrived there.
+// In serial mode the head piece is sent a byte at a time; off counts the
+// bytes already on the wire.
+type queuedPiece struct {
+	buf []byte
+	off int
+	at  time.Time
+}
+
+func (q *queuedPiece) data() []byte { return q.buf[q.off:] }
+
+func newRateStage(cfg ShaperConfig, rng *rand.Rand, drop func(n int)) *rateStage {
+	base := cfg
+	var vary *rateVariation
+	if cfg.RateVariation != nil && cfg.Rate > 0 {
+		vary = newRateVariation(cfg.RateVariation, rng, configClock(cfg).Now())
+		cfg.Rate = vary.rate(cfg.Rate)
+	}
+	r := &rateStage{base: base, vary: vary, rate: cfg.Rate, serial: cfg.SerialMode, pk: newPacketizer(cfg), acks: cfg.CarryACKs, medium: cfg.Medium, rng: rng, drop: drop, obs: cfg.Observer}
+	r.wire.rate = cfg.Rate
+	if cfg.Cross != nil {
+		r.cross = newCrossSource(cfg.Cross, rng)
+	}
+
+	// Serial mode uses wire serialization instead of token bucket
+	if cfg.Rate > 0 && !cfg.SerialMode {
+		r.burst = burstSize(cfg)
+		r.piece = r.pk.pieceSize(r.burst)
+		r.limiter = r.newLimiter()
+	}
+	if cfg.QueuePolicy == OverflowCoDel {
+		r.codel = newCoDel(cfg)
+	}
+	r.current.Store(cfg.Rate)
+	return r
+}
+
+// burstSize returns the token bucket burst for cfg: at least one chunk,
+// or 100ms of data, capped at 64KB. With a packet layer it always holds at
+// least one full packet.
+func burstSize(cfg ShaperConfig) int {
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = int(cfg.Rate / 10) // 100ms of data
+		if cfg.ChunkSize > 0 && cfg.ChunkSize > burst {
+			burst = cfg.ChunkSize
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		// Cap burst at 64KB to prevent huge initial bursts
+		if burst > maxBurstSize {
+			burst = maxBurstSize
+		}
+	}
+	if pk := newPacketizer(cfg); pk.enabled() {
+		burst = max(burst, pk.mtu())
+	}
+	return burst
+}
+
+// newLimiter returns a token bucket for the stage's rate and burst: the
+// Medium's, if it has one.
+func (r *rateStage) newLimiter() *rate.Limiter {
+	if r.medium != nil {
+		return r.medium.bucket(r.rate, r.burst)
+	}
+	return rate.NewLimiter(rate.Limit(r.rate), r.burst)
+}
+
+// allow takes the tokens for n bytes at now if they are available.
+func (r *rateStage) allow(now time.Time, n int) bool {
+	if r.medium != nil {
+		return r.medium.allow(r, now, n)
+	}
+	return r.limiter.AllowN(now, n)
+}
+
+// reserve reserves the tokens for n bytes at now.
+func (r *rateStage) reserve(now time.Time, n int) *rate.Reservation {
+	if r.medium != nil {
+		return r.medium.reserve(r, now, n)
+	}
+	return r.limiter.ReserveN(now, n)
+}
+
+// claimHead books the Medium for the head of the queue, following on from
+// at on the wire. If the other direction has the line, the head's
+// transmission begins once it has turned round.
+func (r *rateStage) claimHead(at time.Time) {
+	n := r.pk.cost(len(r.queue.front().data()))
+	start := r.medium.claim(r, at, r.wire.duration(int64(n)))
+	if start.After(r.wire.finish(r.wire.sent)) {
+		r.wire.begin(start)
+		r.framed = false
+	}
+}
+
+func (r *rateStage) Push(now time.Time, p []byte, emit Emit) error {
+	defer r.account(now)
+	if err := r.varyUntil(now, emit); err != nil {
+		return err
+	}
+	if r.rate <= 0 {
+		// No rate limiting
+		return emit(p)
+	}
+	r.crossUntil(now)
+
+	if r.serial {
+		r.enqueue(now, p)
+		return nil
+	}
+
+	// Write in pieces whose cost fits the burst size
+	for len(p) > 0 {
+		piece := nextChunk(p, r.piece)
+		p = p[len(piece):]
+		if r.queue.len() == 0 && r.allow(now, r.pk.cost(len(piece))) {
+			if err := emit(piece); err != nil {
+				return err
+			}
+			continue
+		}
+		r.enqueue(now, piece)
+	}
+	return nil
+}
+
+// enqueue copies p onto the queue, scheduling it if it is the new head.
+func (r *rateStage) enqueue(now time.Time, p []byte) {
+	r.queue.push(queuedPiece{buf: r.pool.clone(p), at: now})
+	r.queued += len(p)
+	if r.queue.len() == 1 {
+		switch {
+		case !r.serial:
+		case r.medium != nil:
+			at := r.wire.finish(r.wire.sent)
+			if at.Before(now) {
+				at = now
+			}
+			r.claimHead(at)
+		case !r.wire.busy(now):
+			// The line has been idle since the last byte finished
+			r.wire.begin(now)
+		}
+		r.schedule(now)
+	}
+}
+
+// pop removes the head of the queue. The caller hands its buffer back to
+// the pool once done with it.
+func (r *rateStage) pop() queuedPiece {
+	head := r.queue.pop()
+	r.queued -= len(head.data())
+	r.framed = false
+	return head
+}
+
+// emitHead pops the head of the queue and emits it.
+func (r *rateStage) emitHead(emit Emit) error {
+	head := r.pop()
+	err := emit(head.data())
+	r.pool.put(head.buf)
+	return err
+}
+
+// manage lets CoDel drop pieces from the head of the queue that have
+// waited too long. It is called whenever a new piece becomes the head.
+func (r *rateStage) manage(now time.Time) {
+	if r.codel == nil {
+		return
+	}
+	for r.queue.len() > 0 {
+		head := r.queue.front()
+		n := len(head.data())
+		if !r.codel.shouldDrop(now, now.Sub(head.at), r.queued, n) {
+			return
+		}
+		r.pool.put(r.pop().buf)
+		if r.drop != nil {
+			r.drop(n)
+		}
+	}
+	r.codel.exit()
+}
+
+// schedule works out when the head of the queue may be written.
+func (r *rateStage) schedule(now time.Time) {
+	if r.serial {
+		r.readyAt = r.wire.next(int64(r.framing()))
+		return
+	}
+	// Reserve the tokens now; the reservation matures at readyAt
+	r.res = r.reserve(now, r.pk.cost(len(r.queue.front().data())))
+	r.readyAt = now.Add(r.res.DelayFrom(now))
+}
+
+// Reconfigure re-times queued data under the new rate and mode. Tokens
+// reserved for the head under the old settings are handed back first; on
+// a change of serial speed, a byte part-way across the wire starts again
+// at the new speed. A rate variation carries on, scaling the new Rate,
+// unless it is replaced, when the new one starts from now.
+func (r *rateStage) Reconfigure(now time.Time, cfg ShaperConfig, emit Emit) error {
+	r.base = cfg
+	switch {
+	case cfg.RateVariation == nil || cfg.Rate <= 0:
+		r.vary = nil
+	case r.vary == nil || r.vary.cfg != cfg.RateVariation:
+		r.vary = newRateVariation(cfg.RateVariation, r.rng, now)
+	default:
+		r.vary.advance(now)
+	}
+	return r.reconfigure(now, r.varied(), emit)
+}
+
+// varied returns the configuration with Rate scaled by the variation.
+func (r *rateStage) varied() ShaperConfig {
+	cfg := r.base
+	if r.vary != nil {
+		cfg.Rate = r.vary.rate(cfg.Rate)
+	}
+	return cfg
+}
+
+// varyUntil makes the rate changes due by now.
+func (r *rateStage) varyUntil(now time.Time, emit Emit) error {
+	if r.vary == nil || !r.vary.advance(now) {
+		return nil
+	}
+	return r.reconfigure(now, r.varied(), emit)
+}
+
+// reconfigure adopts cfg, with its Rate as it stands after any variation.
+func (r *rateStage) reconfigure(now time.Time, cfg ShaperConfig, emit Emit) error {
+	defer r.account(now)
+	r.current.Store(cfg.Rate)
+	r.crossUntil(now)
+	if r.res != nil {
+		r.res.CancelAt(now)
+		r.res = nil
+	}
+	retime := cfg.Rate != r.rate || cfg.SerialMode != r.serial
+	r.rate, r.serial = cfg.Rate, cfg.SerialMode
+	r.pk = newPacketizer(cfg)
+	if cfg.Cross == nil {
+		r.cross = nil
+	} else if r.cross == nil || r.cross.cfg != cfg.Cross {
+		r.cross = newCrossSource(cfg.Cross, r.rng)
+	}
+	r.acks = cfg.CarryACKs
+	r.wire.rate = cfg.Rate
+	if cfg.QueuePolicy != OverflowCoDel {
+		r.codel = nil
+	} else if c := newCoDel(cfg); r.codel == nil {
+		r.codel = c
+	} else {
+		// Keep the control state; only the parameters change
+		r.codel.target, r.codel.interval = c.target, c.interval
+	}
+
+	switch {
+	case cfg.Rate <= 0:
+		// Unlimited: everything waiting goes out now
+		r.limiter = nil
+		for r.queue.len() > 0 {
+			if err := r.emitHead(emit); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case cfg.SerialMode:
+		r.limiter = nil
+		if retime {
+			r.wire.begin(now)
+		}
+
+	default:
+		r.burst = burstSize(cfg)
+		r.piece = r.pk.pieceSize(r.burst)
+		if r.limiter == nil {
+			r.limiter = r.newLimiter()
+		}
+		r.limiter.SetLimitAt(now, rate.Limit(cfg.Rate))
+		r.limiter.SetBurstAt(now, r.burst)
+		// Queued pieces must fit the new burst to ever get their tokens
+		var requeued ring[queuedPiece]
+		queued := r.queued
+		for r.queue.len() > 0 {
+			head := r.pop()
+			for _, data := range splitChunks(head.data(), r.piece) {
+				requeued.push(queuedPiece{buf: r.pool.clone(data), at: head.at})
+			}
+			r.pool.put(head.buf)
+		}
+		r.queue = requeued
+		r.queued = queued
+	}
+
+	if r.queue.len() > 0 {
+		r.schedule(now)
+	}
+	return nil
+}
+
+func (r *rateStage) Next() (time.Time, bool) {
+	if r.queue.len() == 0 {
+		return time.Time{}, false
+	}
+	if r.vary != nil {
+		if at, ok := r.vary.next(); ok && at.Before(r.readyAt) {
+			return at, true
+		}
+	}
+	return r.readyAt, true
+}
+
+func (r *rateStage) Release(now time.Time, emit Emit) error {
+	defer r.account(now)
+	if err := r.varyUntil(now, emit); err != nil {
+		return err
+	}
+	r.crossUntil(now)
+	if r.serial {
+		return r.releaseSerial(now, emit)
+	}
+	for r.queue.len() > 0 && !r.readyAt.After(now) {
+		r.res = nil
+		if err := r.emitHead(emit); err != nil {
+			return err
+		}
+		r.manage(now)
+		if r.queue.len() > 0 {
+			r.schedule(now)
+		}
+	}
+	return nil
+}
+
+// account starts or ends a busy period, in which the stage holds data
+// back, as its queue fills or empties.
+func (r *rateStage) account(now time.Time) {
+	started, waited, changed := r.wait.update(now, r.queue.len() > 0)
+	switch {
+	case !changed || r.obs == nil:
+	case started:
+		r.obs.RateWaitStarted(now)
+	default:
+		r.obs.RateWaitFinished(now, waited)
+	}
+}
+
+func (r *rateStage) addStats(now time.Time, out *Stats) {
+	out.RateBlocked = r.wait.total(now)
+	out.Rate = r.current.Load()
+	out.CrossBytes = r.crossBytes.Load()
+	out.ACKBytes = r.ackBytes.Load()
+}
+
+// crossUntil charges the link for the cross traffic and ACKs that have
+// arrived by now. On an unlimited link they are generated and ignored, so
+// they never lag behind the limiter's clock.
+func (r *rateStage) crossUntil(now time.Time) {
+	crossArrived, ackArrived := r.crossArrived, r.ackArrived
+	if r.rate <= 0 {
+		crossArrived, ackArrived = ignoreArrival, ignoreArrival
+	}
+	if r.cross != nil {
+		keep, from := r.crossKeep(), r.charged
+		skipped := r.cross.advance(now, keep, crossArrived)
+		if to := now.Add(-keep); skipped > 0 && r.rate > 0 && to.After(from) {
+			// The link carried what it had room for while it idled
+			room := mulDiv(uint64(to.Sub(from)), uint64(r.rate), uint64(time.Second))
+			r.crossBytes.Add(min(skipped, int64(room)))
+		}
+	}
+	if r.acks != nil {
+		r.acks.take(now, ackArrived)
+	}
+	r.charged = now
+}
+
+func ignoreArrival(time.Time, int) {}
+
+// crossKeep returns how much cross traffic before now crossUntil replays
+// after an idle period: twice the time the link takes to drain a full
+// bottleneck buffer. Older traffic has left the buffer, and traffic heavy
+// enough to keep it full refills it in that time. On an unlimited link
+// nothing is kept.
+func (r *rateStage) crossKeep() time.Duration {
+	if r.rate <= 0 {
+		return 0
+	}
+	limit := bottleneckBuffer(r.cross.cfg.Buffer, r.rate)
+	return 2 * time.Duration(mulDiv(uint64(limit), uint64(time.Second), uint64(r.rate)))
+}
+
+// crossArrived charges the link for n bytes of cross traffic arriving at
+// at, or as many as fill its buffer if n is 0.
+func (r *rateStage) crossArrived(at time.Time, n int) {
+	r.crossBytes.Add(int64(r.share(at, n, r.cross.cfg.Buffer)))
+}
+
+// ackArrived charges the link for n bytes of ACKs sent at at.
+func (r *rateStage) ackArrived(at time.Time, n int) {
+	var buffer time.Duration
+	if r.cross != nil {
+		buffer = r.cross.cfg.Buffer
+	}
+	r.ackBytes.Add(int64(r.share(at, n, buffer)))
+}
+
+// share charges the link for n bytes of other traffic arriving at at, or
+// as many as fill the bottleneck buffer, buffer long, if n is 0. Traffic
+// that does not fit in the buffer is dropped. It returns the bytes
+// charged. The backlog is what the link has committed to beyond now; in
+// token bucket mode unused tokens make it negative.
+//
+// ACKs may be sent before cross traffic or data the stage has already
+// seen; they are charged as of then, as the limiter's clock cannot go
+// back.
+func (r *rateStage) share(at time.Time, n int, buffer time.Duration) int {
+	if at.Before(r.charged) {
+		at = r.charged
+	}
+	r.charged = at
+	limit := bottleneckBuffer(buffer, r.rate)
+	var backlog int
+	if r.serial {
+		if r.queue.len() == 0 && !r.wire.busy(at) {
+			r.wire.begin(at)
+			r.framed = false
+		}
+		backlog = int(max(-r.wire.due(at), 0))
+	} else {
+		backlog = int(-r.limiter.TokensAt(at))
+	}
+	switch {
+	case n == 0:
+		n = limit - backlog
+	case backlog+n > limit:
+		return 0
+	}
+	if n <= 0 {
+		return 0
+	}
+	if r.serial {
+		r.wire.sent += int64(n)
+		return n
+	}
+	for left := n; left > 0; {
+		k := min(left, r.burst)
+		r.limiter.ReserveN(at, k)
+		left -= k
+	}
+	return n
+}
+
+// releaseSerial writes every byte that has finished crossing the wire by
+// now, in one write per queued piece, or per packet with a packet layer.
+func (r *rateStage) releaseSerial(now time.Time, emit Emit) error {
+	n := r.wire.due(now)
+	if n > 0 {
+		r.wire.last = now
+	}
+	for n > 0 && r.queue.len() > 0 {
+		front := r.queue.front()
+		data := front.data()
+		if r.pk.enabled() {
+			// Each packet's framing crosses the wire ahead of its data
+			if !r.framed {
+				if n < int64(r.pk.overhead) {
+					break
+				}
+				n -= int64(r.pk.overhead)
+				r.wire.sent += int64(r.pk.overhead)
+				r.framed = true
+			}
+			data = data[:min(len(data), r.pk.payload-front.off%r.pk.payload)]
+		}
+		if int64(len(data)) > n {
+			data = data[:n]
+		}
+		if len(data) == 0 {
+			break
+		}
+		if err := emit(data); err != nil {
+			return err
+		}
+		n -= int64(len(data))
+		r.wire.sent += int64(len(data))
+		if len(data) == len(front.data()) {
+			r.pool.put(r.pop().buf)
+			r.manage(now)
+			if r.medium != nil && r.queue.len() > 0 {
+				// The next piece may have to wait for the other direction
+				r.claimHead(r.wire.finish(r.wire.sent))
+				n = max(r.wire.due(now), 0)
+			}
+		} else {
+			front.off += len(data)
+			r.queued -= len(data)
+			if r.pk.enabled() && front.off%r.pk.payload == 0 {
+				r.framed = false // On to the next packet
+			}
+		}
+	}
+	if r.queue.len() > 0 {
+		r.schedule(now)
+	}
+	return nil
+}
+
+// framing returns the bytes of packet framing still to cross the wire
+// before the head's next byte.
+func (r *rateStage) framing() int {
+	if !r.pk.enabled() || r.framed {
+		return 0
+	}
+	return r.pk.overhead
+}
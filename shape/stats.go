@@ -0,0 +1,211 @@
+package shape
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of what a Shaper has done, from Shaper.Stats.
+//
+// Byte counts cover the Shaper's whole life. The delay, rate and frame
+// figures come from the built-in stages; if a custom stage replaces one of
+// them, its figures stay zero.
+type Stats struct {
+	BytesRead    int64 // Read from the source, including any dropped on arrival
+	BytesQueued  int   // Read but not yet written or dropped
+	BytesWritten int64 // Written to the destination
+	BytesDropped int64 // Discarded by the overflow policy or by stages
+
+	DelayQueueBytes  int // Bytes in the delay queue, in memory or spilled
+	DelayQueueChunks int // Chunks in the delay queue
+
+	SegmentsLost int64         // TCP segments lost, retransmissions included (see ShaperConfig.Loss)
+	LossStall    time.Duration // Time during which a retransmission stall was holding data back
+
+	Window        int           // Current TCP window in bytes (0 = no window model)
+	WindowBlocked time.Duration // Time the window stage held data back, waiting for ACKs (window or Nagle)
+
+	Rate         int64         // Current bandwidth limit in bytes per second, as varied by ShaperConfig.RateVariation, or a DeliveryTrace's mean (0 = unlimited)
+	RateBlocked  time.Duration // Time the rate stage held data back, waiting for tokens or the wire
+	CrossBytes   int64         // Background traffic carried alongside (see ShaperConfig.Cross)
+	ACKBytes     int64         // ACKs for the opposite direction carried alongside (see ShaperConfig.CarryACKs)
+	FrameFlushes int64         // Frames released by the frame stage
+
+	Outages    int64         // Outages begun (see ShaperConfig.Outages)
+	OutageTime time.Duration // Time the link has been down
+
+	Latency LatencyHistogram // Time from read to write, per byte written
+}
+
+// LatencyBuckets is the number of buckets in a LatencyHistogram.
+const LatencyBuckets = 32
+
+// LatencyHistogram counts bytes by how long they took through a Shaper, in
+// power-of-two buckets: bucket 0 holds latencies under 1ms, and bucket i
+// those from 2^(i-1)ms up to LatencyBound(i). The last bucket is
+// open-ended.
+type LatencyHistogram struct {
+	Counts [LatencyBuckets]int64 // Bytes per bucket
+	Max    time.Duration         // Highest latency seen
+}
+
+// LatencyBound returns the exclusive upper bound of histogram bucket i.
+// The last bucket has no upper bound and reports the largest Duration.
+func LatencyBound(i int) time.Duration {
+	if i >= LatencyBuckets-1 {
+		return math.MaxInt64
+	}
+	return time.Millisecond << i
+}
+
+// latencyBucket returns the histogram bucket for latency d.
+func latencyBucket(d time.Duration) int {
+	if d < time.Millisecond {
+		return 0
+	}
+	return min(bits.Len64(uint64(d/time.Millisecond)), LatencyBuckets-1)
+}
+
+// Count returns the number of bytes in the histogram.
+func (h *LatencyHistogram) Count() int64 {
+	var n int64
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+// Quantile returns an upper bound on the q-quantile (0 ≤ q ≤ 1) of the
+// latencies: the bound of the bucket it falls in, or Max if that is lower.
+// It returns 0 for an empty histogram.
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	total := h.Count()
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, c := range h.Counts {
+		seen += c
+		if seen >= rank {
+			return min(LatencyBound(i), h.Max)
+		}
+	}
+	return h.Max
+}
+
+// arrival is a run of bytes that entered the pipeline at the same time.
+type arrival struct {
+	at time.Time
+	n  int
+}
+
+// shaperStats holds a Shaper's running counters. The reader goroutine and
+// the pipeline goroutine update them with atomics, so Stats can be called
+// from anywhere and costs the data path next to nothing.
+type shaperStats struct {
+	read    atomic.Int64
+	written atomic.Int64
+
+	latency [LatencyBuckets]atomic.Int64
+	maxLat  atomic.Int64
+
+	// Bytes in the pipeline, oldest first, so each byte written can be
+	// matched with the time it arrived. Only the pipeline goroutine
+	// touches it.
+	inFlight ring[arrival]
+}
+
+// arrived records n bytes entering the pipeline at now.
+func (st *shaperStats) arrived(now time.Time, n int) {
+	st.inFlight.push(arrival{at: now, n: n})
+}
+
+// left records n bytes leaving the pipeline at now: written out, or dropped
+// if written is false. Bytes leave in the order they arrived, so they are
+// taken from the front of the in-flight queue.
+func (st *shaperStats) left(now time.Time, n int, written bool) {
+	if written {
+		st.written.Add(int64(n))
+	}
+	for n > 0 && st.inFlight.len() > 0 {
+		front := st.inFlight.front()
+		k := min(n, front.n)
+		if written {
+			st.record(now.Sub(front.at), k)
+		}
+		if front.n -= k; front.n == 0 {
+			st.inFlight.pop()
+		}
+		n -= k
+	}
+}
+
+// record adds n bytes with latency d to the histogram.
+func (st *shaperStats) record(d time.Duration, n int) {
+	st.latency[latencyBucket(d)].Add(int64(n))
+	if int64(d) > st.maxLat.Load() {
+		st.maxLat.Store(int64(d))
+	}
+}
+
+// snapshot fills in the Shaper-level fields of out.
+func (st *shaperStats) snapshot(out *Stats) {
+	out.BytesRead = st.read.Load()
+	out.BytesWritten = st.written.Load()
+	for i := range st.latency {
+		out.Latency.Counts[i] = st.latency[i].Load()
+	}
+	out.Latency.Max = time.Duration(st.maxLat.Load())
+}
+
+// statsReporter is implemented by built-in stages that contribute to
+// Stats. addStats is called from any goroutine, so the figures it reads
+// must be kept in atomics or under a lock.
+type statsReporter interface {
+	addStats(now time.Time, out *Stats)
+}
+
+// waitTimer measures the time a stage spends holding data back, over busy
+// periods that start when its queue fills and end when it empties. Only the
+// stage's goroutine calls update; total may be called from anywhere.
+type waitTimer struct {
+	mu    sync.Mutex
+	past  time.Duration // Over past busy periods
+	since time.Time     // Start of the current one; zero while idle
+}
+
+// update starts or ends a busy period if busy has changed. It reports
+// whether one started, and the length of one that ended.
+func (w *waitTimer) update(now time.Time, busy bool) (started bool, ended time.Duration, changed bool) {
+	if busy == !w.since.IsZero() {
+		return false, 0, false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if busy {
+		w.since = now
+		return true, 0, true
+	}
+	ended = now.Sub(w.since)
+	w.past += ended
+	w.since = time.Time{}
+	return false, ended, true
+}
+
+// total returns the time spent holding data back up to now.
+func (w *waitTimer) total(now time.Time) time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	total := w.past
+	if !w.since.IsZero() && now.After(w.since) {
+		total += now.Sub(w.since)
+	}
+	return total
+}
@@ -0,0 +1,104 @@
+package shape
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestShaperStats follows 20 bytes through a 100ms delay, a 20ms frame and
+// a 100 B/s token bucket with a 10-byte burst: half go out as the frame
+// flushes at 120ms, the rest wait 100ms for tokens.
+func TestShaperStats(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	s := NewShaper(ShaperConfig{Delay: 100 * time.Millisecond, FrameTime: 20 * time.Millisecond, Rate: 100, Clock: fc})
+	dst := &clockWriter{clock: fc}
+	done := startVirtual(s, dst, strings.NewReader(strings.Repeat("x", 20)))
+
+	stepUntil(t, fc, func() bool { return s.Stats().DelayQueueChunks == 1 })
+	st := s.Stats()
+	if st.BytesRead != 20 || st.BytesQueued != 20 || st.DelayQueueBytes != 20 {
+		t.Errorf("while delayed: read %d, queued %d, delay queue %d bytes; want 20 each",
+			st.BytesRead, st.BytesQueued, st.DelayQueueBytes)
+	}
+
+	stepUntil(t, fc, func() bool { return dst.count() == 2 })
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	st = s.Stats()
+	if st.BytesWritten != 20 || st.BytesQueued != 0 || st.BytesDropped != 0 {
+		t.Errorf("written %d, queued %d, dropped %d; want 20, 0, 0", st.BytesWritten, st.BytesQueued, st.BytesDropped)
+	}
+	if st.DelayQueueBytes != 0 || st.DelayQueueChunks != 0 {
+		t.Errorf("delay queue %d bytes in %d chunks after drain, want empty", st.DelayQueueBytes, st.DelayQueueChunks)
+	}
+	if st.FrameFlushes != 1 {
+		t.Errorf("FrameFlushes = %d, want 1", st.FrameFlushes)
+	}
+	if st.RateBlocked != 100*time.Millisecond {
+		t.Errorf("RateBlocked = %v, want 100ms", st.RateBlocked)
+	}
+
+	// 10 bytes took 120ms, in [64ms, 128ms); 10 took 220ms, in [128ms, 256ms)
+	h := st.Latency
+	if h.Counts[7] != 10 || h.Counts[8] != 10 || h.Count() != 20 {
+		t.Errorf("latency counts %v, want 10 in buckets 7 and 8", h.Counts)
+	}
+	if h.Max != 220*time.Millisecond {
+		t.Errorf("max latency %v, want 220ms", h.Max)
+	}
+	if q := h.Quantile(0.5); q != 128*time.Millisecond {
+		t.Errorf("median bound %v, want 128ms", q)
+	}
+	if q := h.Quantile(1); q != 220*time.Millisecond {
+		t.Errorf("max quantile %v, want 220ms", q)
+	}
+}
+
+// TestShaperStatsDrops checks that bytes dropped on arrival are counted as
+// read but not written, and don't skew the latency of those that were.
+func TestShaperStatsDrops(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	cfg := ShaperConfig{Delay: 50 * time.Millisecond, QueueLimit: 10, QueuePolicy: OverflowTailDrop, Clock: fc}
+	s := NewShaper(cfg)
+	dst := &clockWriter{clock: fc}
+	done := startVirtual(s, dst, strings.NewReader(strings.Repeat("x", 20)))
+
+	stepUntil(t, fc, func() bool { return dst.count() == 1 })
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	st := s.Stats()
+	if st.BytesRead != 20 || st.BytesWritten != 10 || st.BytesDropped != 10 {
+		t.Errorf("read %d, written %d, dropped %d; want 20, 10, 10", st.BytesRead, st.BytesWritten, st.BytesDropped)
+	}
+	if h := st.Latency; h.Count() != 10 || h.Max != 50*time.Millisecond {
+		t.Errorf("latency of %d bytes, max %v; want 10 bytes, max 50ms", h.Count(), h.Max)
+	}
+}
+
+func TestLatencyBucket(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int
+	}{
+		{0, 0},
+		{999 * time.Microsecond, 0},
+		{time.Millisecond, 1},
+		{3 * time.Millisecond, 2},
+		{4 * time.Millisecond, 3},
+		{time.Second, 10},
+		{1000 * time.Hour, LatencyBuckets - 1},
+	}
+	for _, tt := range tests {
+		if got := latencyBucket(tt.d); got != tt.want {
+			t.Errorf("latencyBucket(%v) = %d, want %d", tt.d, got, tt.want)
+		}
+		if tt.d >= LatencyBound(tt.want) {
+			t.Errorf("%v not below the bound of bucket %d (%v)", tt.d, tt.want, LatencyBound(tt.want))
+		}
+	}
+}
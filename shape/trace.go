@@ -0,0 +1,260 @@
+package shape
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DeliveryTrace describes a link by the times it can deliver a packet, as
+// the Mahimahi emulator's traces of cellular links do. At each opportunity
+// the link carries up to one MTU of queued data (ShaperConfig.MTU, 1500
+// bytes by default), or nothing if there is nothing waiting: an
+// opportunity is not saved up for data that arrives later. Several
+// opportunities at the same offset carry that many packets at once.
+//
+// The trace repeats every last opportunity, as Mahimahi's do, so offsets
+// run from just after 0 up to and including the period. Traces are read
+// with ReadDeliveryTrace.
+type DeliveryTrace struct {
+	Opportunities []time.Duration // Offsets from the start of the trace, in order, all above 0
+}
+
+// ReadDeliveryTrace reads a Mahimahi packet delivery trace: one delivery
+// opportunity per line, as a whole number of milliseconds from the start.
+// Blank lines and # comments are skipped. Opportunities at 0 are the same
+// instants as those at the end of the previous repetition, and are moved
+// there, so a repetition boundary is not counted twice.
+func ReadDeliveryTrace(r io.Reader) (*DeliveryTrace, error) {
+	t := &DeliveryTrace{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ms, err := strconv.ParseInt(line, 10, 64)
+		if err != nil || ms < 0 {
+			return nil, fmt.Errorf("trace line %d: invalid time %q (want milliseconds)", n, line)
+		}
+		at := time.Duration(ms) * time.Millisecond
+		if len(t.Opportunities) > 0 && at < t.Opportunities[len(t.Opportunities)-1] {
+			return nil, fmt.Errorf("trace line %d: time goes backwards", n)
+		}
+		t.Opportunities = append(t.Opportunities, at)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if i, _ := slices.BinarySearch(t.Opportunities, 1); i > 0 && i < len(t.Opportunities) {
+		period := t.Opportunities[len(t.Opportunities)-1]
+		for range i {
+			t.Opportunities = append(t.Opportunities, period)
+		}
+		t.Opportunities = t.Opportunities[i:]
+	}
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// check returns an error if t cannot drive a link.
+func (t *DeliveryTrace) check() error {
+	switch {
+	case len(t.Opportunities) == 0:
+		return errors.New("trace: no delivery opportunities")
+	case !slices.IsSorted(t.Opportunities) || t.Opportunities[0] <= 0:
+		return errors.New("trace: times must be in order and above 0")
+	case t.period() <= 0:
+		return errors.New("trace: must span some time")
+	}
+	return nil
+}
+
+// period returns the length of one repetition of the trace.
+func (t *DeliveryTrace) period() time.Duration {
+	return t.Opportunities[len(t.Opportunities)-1]
+}
+
+// Rate returns the trace's mean bandwidth in bytes per second with
+// packets of mtu bytes.
+func (t *DeliveryTrace) Rate(mtu int) int64 {
+	return int64(mulDiv(uint64(len(t.Opportunities)*mtu), uint64(time.Second), uint64(t.period())))
+}
+
+// traceMTU returns the bytes cfg's link carries per delivery opportunity.
+func traceMTU(cfg ShaperConfig) int {
+	if cfg.MTU > 0 {
+		return cfg.MTU
+	}
+	return defaultMTU
+}
+
+// linkRate returns the bandwidth of cfg's link in bytes per second: Rate,
+// or a DeliveryTrace's mean (0 = unlimited).
+func linkRate(cfg ShaperConfig) int64 {
+	if cfg.DeliveryTrace != nil {
+		return cfg.DeliveryTrace.Rate(traceMTU(cfg))
+	}
+	return cfg.Rate
+}
+
+// traceStage takes the rate stage's place when a Shaper follows a
+// DeliveryTrace, releasing queued data only at the trace's delivery
+// opportunities. The trace is followed lazily, like the rate stage's
+// cross traffic: opportunities that pass while the queue is empty are
+// skipped in one step when data next arrives, so an idle link holds no
+// timers.
+//
+// Each opportunity adds an MTU of credit, spent on queued data in order.
+// With a packet layer (PacketOverhead) each packet's framing is paid for
+// out of the credit ahead of its data, so an opportunity carries one full
+// packet; what is left over passes to the next piece while data is
+// waiting, and is lost once the queue empties.
+type traceStage struct {
+	trace  *DeliveryTrace
+	base   time.Time // Start of the current repetition
+	idx    int       // Next opportunity in it
+	mtu    int
+	credit int // Bytes the opportunities passed so far can still carry
+	pk     packetizer
+	framed bool // The framing of the head's current packet has been paid for
+	queue  ring[queuedPiece]
+	pool   bufferPool
+	obs    Observer
+
+	// For Stats
+	wait waitTimer
+	rate atomic.Int64 // Mean rate of the trace
+}
+
+// newTraceStage returns a stage following cfg.DeliveryTrace from the time
+// on cfg.Clock.
+func newTraceStage(cfg ShaperConfig) *traceStage {
+	s := &traceStage{trace: cfg.DeliveryTrace, base: configClock(cfg).Now(), obs: cfg.Observer}
+	s.configure(cfg)
+	return s
+}
+
+// configure adopts the packet size and layer in cfg.
+func (s *traceStage) configure(cfg ShaperConfig) {
+	s.mtu = traceMTU(cfg)
+	s.pk = newPacketizer(cfg)
+	s.rate.Store(linkRate(cfg))
+}
+
+// Reconfigure applies a new MTU or packet layer from the next opportunity.
+// The trace itself is fixed when the Shaper is built.
+func (s *traceStage) Reconfigure(now time.Time, cfg ShaperConfig, emit Emit) error {
+	s.configure(cfg)
+	return nil
+}
+
+func (s *traceStage) Push(now time.Time, p []byte, emit Emit) error {
+	if s.queue.len() == 0 {
+		s.skip(now)
+	}
+	s.queue.push(queuedPiece{buf: s.pool.clone(p), at: now})
+	return s.Release(now, emit)
+}
+
+func (s *traceStage) Next() (time.Time, bool) {
+	if s.queue.len() == 0 {
+		return time.Time{}, false
+	}
+	return s.next(), true
+}
+
+func (s *traceStage) Release(now time.Time, emit Emit) error {
+	defer s.account(now)
+	for !s.next().After(now) {
+		s.credit += s.mtu
+		s.idx++
+		s.wrap()
+	}
+	for s.credit > 0 && s.queue.len() > 0 {
+		front := s.queue.front()
+		data := front.data()
+		if s.pk.enabled() {
+			if !s.framed {
+				if s.credit < s.pk.overhead {
+					break
+				}
+				s.credit -= s.pk.overhead
+				s.framed = true
+			}
+			data = data[:min(len(data), s.pk.payload-front.off%s.pk.payload)]
+		}
+		data = data[:min(len(data), s.credit)]
+		if len(data) == 0 {
+			break
+		}
+		if err := emit(data); err != nil {
+			return err
+		}
+		s.credit -= len(data)
+		if len(data) == len(front.data()) {
+			s.pool.put(s.queue.pop().buf)
+			s.framed = false
+			continue
+		}
+		front.off += len(data)
+		if s.pk.enabled() && front.off%s.pk.payload == 0 {
+			s.framed = false // On to the next packet
+		}
+	}
+	if s.queue.len() == 0 {
+		s.credit = 0
+	}
+	return nil
+}
+
+// next returns the time of the next delivery opportunity.
+func (s *traceStage) next() time.Time {
+	return s.base.Add(s.trace.Opportunities[s.idx])
+}
+
+// wrap starts the next repetition once the current one is used up.
+func (s *traceStage) wrap() {
+	if s.idx == len(s.trace.Opportunities) {
+		s.base = s.base.Add(s.trace.period())
+		s.idx = 0
+	}
+}
+
+// skip moves past the opportunities before now, which went unused.
+func (s *traceStage) skip(now time.Time) {
+	period := s.trace.period()
+	if d := now.Sub(s.base); d >= period {
+		s.base = s.base.Add(d / period * period)
+		s.idx = 0
+	}
+	i, _ := slices.BinarySearch(s.trace.Opportunities, now.Sub(s.base))
+	s.idx = max(s.idx, i)
+	s.wrap()
+}
+
+// account starts or ends a busy period, in which the stage holds data
+// back, as its queue fills or empties.
+func (s *traceStage) account(now time.Time) {
+	started, waited, changed := s.wait.update(now, s.queue.len() > 0)
+	switch {
+	case !changed || s.obs == nil:
+	case started:
+		s.obs.RateWaitStarted(now)
+	default:
+		s.obs.RateWaitFinished(now, waited)
+	}
+}
+
+func (s *traceStage) addStats(now time.Time, out *Stats) {
+	out.RateBlocked = s.wait.total(now)
+	out.Rate = s.rate.Load()
+}
@@ -0,0 +1,150 @@
+package shape
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadDeliveryTrace(t *testing.T) {
+	got, err := ReadDeliveryTrace(strings.NewReader("# LTE downlink\n0\n3\n3\n\n10\n"))
+	if err != nil {
+		t.Fatalf("ReadDeliveryTrace failed: %v", err)
+	}
+	// The opportunity at 0 is the one at the end of the previous repetition
+	want := []time.Duration{3 * time.Millisecond, 3 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond}
+	if !slices.Equal(got.Opportunities, want) {
+		t.Errorf("opportunities %v, want %v", got.Opportunities, want)
+	}
+	if rate := got.Rate(1500); rate != 600000 {
+		t.Errorf("Rate(1500) = %d, want 4 packets per 10ms", rate)
+	}
+	for _, input := range []string{"", "0\n0", "5\n3", "1.5", "-1\n2", "1 1500"} {
+		if _, err := ReadDeliveryTrace(strings.NewReader(input)); err == nil {
+			t.Errorf("ReadDeliveryTrace(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+// traceWrites pushes each chunk into a trace stage at its time and drains
+// the stage, returning the writes as "time:bytes".
+func traceWrites(t *testing.T, s *traceStage, pushes map[time.Duration]int) []string {
+	t.Helper()
+	var got []string
+	now := virtualEpoch
+	emit := func(p []byte) error {
+		got = append(got, now.Sub(virtualEpoch).String()+":"+strconv.Itoa(len(p)))
+		return nil
+	}
+	for _, at := range slices.Sorted(maps.Keys(pushes)) {
+		for {
+			next, ok := s.Next()
+			if !ok || !next.Before(virtualEpoch.Add(at)) {
+				break
+			}
+			now = next
+			if err := s.Release(now, emit); err != nil {
+				t.Fatal(err)
+			}
+		}
+		now = virtualEpoch.Add(at)
+		if err := s.Push(now, make([]byte, pushes[at]), emit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		next, ok := s.Next()
+		if !ok {
+			return got
+		}
+		now = next
+		if err := s.Release(now, emit); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestTraceStage checks that data leaves only at delivery opportunities,
+// an MTU at a time, that the trace repeats, and that opportunities that
+// pass while the link is idle are not saved up.
+func TestTraceStage(t *testing.T) {
+	ms := time.Millisecond
+	s := newTraceStage(ShaperConfig{
+		DeliveryTrace: &DeliveryTrace{Opportunities: []time.Duration{ms, ms, 3 * ms}},
+		MTU:           100,
+		Clock:         NewFakeClock(virtualEpoch),
+	})
+	got := traceWrites(t, s, map[time.Duration]int{0: 350, 100*ms + 500*time.Microsecond: 150})
+	want := []string{"1ms:200", "3ms:100", "4ms:50", "102ms:100", "103ms:50"}
+	if !slices.Equal(got, want) {
+		t.Errorf("writes %v, want %v", got, want)
+	}
+	var st Stats
+	s.addStats(virtualEpoch.Add(200*ms), &st)
+	if st.Rate != 100000 || st.RateBlocked != 6500*time.Microsecond {
+		t.Errorf("stats: rate %d, blocked %v; want 100000 and 6.5ms", st.Rate, st.RateBlocked)
+	}
+}
+
+// TestTraceStagePackets checks that with a packet layer each opportunity
+// carries one packet: its framing and the data that fits with it.
+func TestTraceStagePackets(t *testing.T) {
+	ms := time.Millisecond
+	s := newTraceStage(ShaperConfig{
+		DeliveryTrace:  &DeliveryTrace{Opportunities: []time.Duration{ms, 2 * ms, 3 * ms}},
+		MTU:            100,
+		PacketOverhead: 40,
+		Clock:          NewFakeClock(virtualEpoch),
+	})
+	got := traceWrites(t, s, map[time.Duration]int{0: 150})
+	if want := []string{"1ms:60", "2ms:60", "3ms:30"}; !slices.Equal(got, want) {
+		t.Errorf("writes %v, want %v", got, want)
+	}
+}
+
+// TestTraceStageLeadingZero checks that a trace starting at 0 loops
+// without delivering twice at each repetition boundary.
+func TestTraceStageLeadingZero(t *testing.T) {
+	trace, err := ReadDeliveryTrace(strings.NewReader("0\n2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTraceStage(ShaperConfig{DeliveryTrace: trace, MTU: 100, Clock: NewFakeClock(virtualEpoch)})
+	got := traceWrites(t, s, map[time.Duration]int{0: 600})
+	if want := []string{"2ms:200", "4ms:200", "6ms:200"}; !slices.Equal(got, want) {
+		t.Errorf("writes %v, want two packets every 2ms", got)
+	}
+
+	// A trace built by hand must leave 0 out itself
+	if err := (&DeliveryTrace{Opportunities: []time.Duration{0, 2 * time.Millisecond}}).check(); err == nil {
+		t.Error("check accepted an opportunity at 0")
+	}
+}
+
+// TestShaperDeliveryTrace checks that a trace replaces the rate limit and
+// that data reaches it after the link's delay.
+func TestShaperDeliveryTrace(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	s := NewShaper(ShaperConfig{
+		Delay:         100 * time.Millisecond,
+		Rate:          1,
+		DeliveryTrace: &DeliveryTrace{Opportunities: []time.Duration{50 * time.Millisecond, time.Second}},
+		Clock:         fc,
+	})
+	dst := &clockWriter{clock: fc}
+	done := startVirtual(s, dst, strings.NewReader(strings.Repeat("x", 2000)))
+	stepUntil(t, fc, func() bool { return dst.count() == 2 })
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// The opportunity at 50ms has passed by the time the data arrives
+	for i, want := range []time.Duration{time.Second, 1050 * time.Millisecond} {
+		if got := dst.writes[i].t.Sub(virtualEpoch); got != want {
+			t.Errorf("write %d at %v, want %v", i, got, want)
+		}
+	}
+}
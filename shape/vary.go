@@ -0,0 +1,258 @@
+package shape
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RatePattern is how a RateVariation moves the rate.
+type RatePattern int
+
+const (
+	// RateWalk moves the rate at random every Period, by up to a tenth of
+	// the range each time, staying between Low and High. It starts from
+	// Rate, or the nearer bound if Rate is out of range.
+	RateWalk RatePattern = iota
+	// RateSine swings the rate between Low and High and back every Period,
+	// starting from the middle.
+	RateSine
+	// RateSquare holds the rate at High for the first half of each Period
+	// and at Low for the second.
+	RateSquare
+	// RateSteps changes the rate at the times in Steps.
+	RateSteps
+)
+
+var ratePatternNames = map[RatePattern]string{
+	RateWalk:   "walk",
+	RateSine:   "sine",
+	RateSquare: "square",
+	RateSteps:  "steps",
+}
+
+func (p RatePattern) String() string {
+	if name, ok := ratePatternNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("RatePattern(%d)", int(p))
+}
+
+// Rate variation parameters
+const (
+	defaultWalkPeriod = time.Second
+	walkStep          = 0.1 // Largest random walk step, as a fraction of the range
+	sineSteps         = 32  // Rate changes per sine period
+)
+
+// RateVariation varies a Shaper's bandwidth over time, as a mobile link's
+// does with signal and load. The rate is Rate scaled by a factor the
+// pattern sets, so the same variation suits both directions of an
+// asymmetric link; it changes in steps, and data waiting for the link is
+// re-timed at each.
+type RateVariation struct {
+	Pattern   RatePattern
+	Low, High float64       // Range of the factor (RateWalk, RateSine, RateSquare)
+	Period    time.Duration // Cycle (RateSine, RateSquare) or time between steps (RateWalk; 0 = 1s)
+	Steps     []RateStep    // RateSteps; the factor is 1 before the first
+}
+
+// RateStep sets the factor from an offset after the Shaper is built.
+type RateStep struct {
+	At    time.Duration
+	Scale float64
+}
+
+// ParseRateVariation parses a rate variation. Factors are fractions of the
+// configured rate, written as percentages such as "25%" or as fractions
+// such as "0.25":
+//
+//	walk:LOW:HIGH[:EVERY]   random walk, e.g. "walk:20%:100%:2s"
+//	sine:LOW:HIGH:PERIOD    e.g. "sine:50%:100%:1m"
+//	square:LOW:HIGH:PERIOD  e.g. "square:10%:100%:30s"
+//	steps:SCALE@AT,...      e.g. "steps:50%@10s,100%@20s"
+func ParseRateVariation(s string) (*RateVariation, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	name, spec, _ := strings.Cut(s, ":")
+	if name == "steps" {
+		return parseRateSteps(spec)
+	}
+	v := &RateVariation{}
+	switch name {
+	case "walk":
+		v.Pattern = RateWalk
+	case "sine":
+		v.Pattern = RateSine
+	case "square":
+		v.Pattern = RateSquare
+	default:
+		return nil, fmt.Errorf("unknown rate variation: %s", s)
+	}
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 && (len(parts) != 2 || v.Pattern != RateWalk) {
+		return nil, fmt.Errorf("invalid %s variation: %s (want %s:LOW:HIGH:PERIOD)", name, s, name)
+	}
+	var err error
+	if v.Low, err = parseRateScale(parts[0]); err != nil {
+		return nil, err
+	}
+	if v.High, err = parseRateScale(parts[1]); err != nil {
+		return nil, err
+	}
+	if v.High <= 0 || v.Low > v.High {
+		return nil, fmt.Errorf("invalid rate range: %s to %s", parts[0], parts[1])
+	}
+	if len(parts) == 3 {
+		if v.Period, err = time.ParseDuration(parts[2]); err != nil || v.Period <= 0 {
+			return nil, fmt.Errorf("invalid period: %s", parts[2])
+		}
+	}
+	return v, nil
+}
+
+// parseRateSteps parses the SCALE@AT list of a steps variation.
+func parseRateSteps(spec string) (*RateVariation, error) {
+	v := &RateVariation{Pattern: RateSteps}
+	for _, item := range strings.Split(spec, ",") {
+		scale, at, ok := strings.Cut(strings.TrimSpace(item), "@")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate step: %q (want SCALE@AT)", item)
+		}
+		var step RateStep
+		var err error
+		if step.Scale, err = parseRateScale(scale); err != nil {
+			return nil, err
+		}
+		if step.At, err = time.ParseDuration(at); err != nil || step.At < 0 {
+			return nil, fmt.Errorf("invalid rate step time: %s", at)
+		}
+		v.Steps = append(v.Steps, step)
+	}
+	return v, nil
+}
+
+// parseRateScale parses a factor: a percentage or a fraction.
+func parseRateScale(s string) (float64, error) {
+	num, pct := strings.CutSuffix(s, "%")
+	f, err := strconv.ParseFloat(num, 64)
+	if pct {
+		f /= 100
+	}
+	if err != nil || f < 0 || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid rate factor: %q", s)
+	}
+	return f, nil
+}
+
+// rateVariation follows a RateVariation from the time it is created. Like
+// crossSource it is run lazily: advance catches up with every change since
+// the last call.
+type rateVariation struct {
+	cfg    *RateVariation
+	rng    *rand.Rand
+	start  time.Time
+	steps  []RateStep // RateSteps, by time
+	tick   int        // Changes made so far
+	nextAt time.Time  // Time of the next change; zero if there are no more
+	scale  float64
+}
+
+func newRateVariation(cfg *RateVariation, rng *rand.Rand, start time.Time) *rateVariation {
+	v := &rateVariation{cfg: cfg, rng: rng, start: start, scale: 1}
+	switch cfg.Pattern {
+	case RateWalk:
+		v.scale = min(max(1, cfg.Low), cfg.High)
+	case RateSine:
+		v.scale = (cfg.Low + cfg.High) / 2
+	case RateSquare:
+		v.scale = cfg.High
+	case RateSteps:
+		v.steps = slices.Clone(cfg.Steps)
+		slices.SortStableFunc(v.steps, func(a, b RateStep) int { return cmp.Compare(a.At, b.At) })
+	}
+	v.nextAt = v.changeAt(1)
+	v.advance(start)
+	return v
+}
+
+// interval returns the time between regular changes.
+func (v *rateVariation) interval() time.Duration {
+	switch v.cfg.Pattern {
+	case RateSine:
+		return max(v.cfg.Period/sineSteps, 1)
+	case RateSquare:
+		return max(v.cfg.Period/2, 1)
+	}
+	if v.cfg.Period > 0 {
+		return v.cfg.Period
+	}
+	return defaultWalkPeriod
+}
+
+// changeAt returns the time of change n, counting from 1, or zero if there
+// is none.
+func (v *rateVariation) changeAt(n int) time.Time {
+	if v.cfg.Pattern != RateSteps {
+		return v.start.Add(time.Duration(n) * v.interval())
+	}
+	if n > len(v.steps) {
+		return time.Time{}
+	}
+	return v.start.Add(v.steps[n-1].At)
+}
+
+// advance makes the changes due by now and reports whether the factor has
+// changed.
+func (v *rateVariation) advance(now time.Time) bool {
+	old := v.scale
+	for !v.nextAt.IsZero() && !v.nextAt.After(now) {
+		v.tick++
+		v.step()
+		v.nextAt = v.changeAt(v.tick + 1)
+	}
+	return v.scale != old
+}
+
+// step sets the factor for change v.tick.
+func (v *rateVariation) step() {
+	c := v.cfg
+	switch c.Pattern {
+	case RateWalk:
+		span := c.High - c.Low
+		s := v.scale + (2*v.rng.Float64()-1)*walkStep*span
+		// Reflect off the bounds
+		if s < c.Low {
+			s = 2*c.Low - s
+		}
+		if s > c.High {
+			s = 2*c.High - s
+		}
+		v.scale = min(max(s, c.Low), c.High)
+	case RateSine:
+		mid, amp := (c.Low+c.High)/2, (c.High-c.Low)/2
+		v.scale = mid + amp*math.Sin(2*math.Pi*float64(v.tick%sineSteps)/sineSteps)
+	case RateSquare:
+		v.scale = c.High
+		if v.tick%2 == 1 {
+			v.scale = c.Low
+		}
+	case RateSteps:
+		v.scale = v.steps[v.tick-1].Scale
+	}
+}
+
+// next returns the time of the next change, if there is one.
+func (v *rateVariation) next() (time.Time, bool) {
+	return v.nextAt, !v.nextAt.IsZero()
+}
+
+// rate returns base scaled by the current factor: at least 1 byte per
+// second, so a limited link stays limited.
+func (v *rateVariation) rate(base int64) int64 {
+	return max(int64(float64(base)*v.scale), 1)
+}
@@ -0,0 +1,121 @@
+package shape
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseRateVariation(t *testing.T) {
+	tests := []struct {
+		input string
+		want  RateVariation
+	}{
+		{"walk:20%:100%", RateVariation{Pattern: RateWalk, Low: 0.2, High: 1}},
+		{"walk:0.5:1.5:2s", RateVariation{Pattern: RateWalk, Low: 0.5, High: 1.5, Period: 2 * time.Second}},
+		{"Sine:50%:100%:1m", RateVariation{Pattern: RateSine, Low: 0.5, High: 1, Period: time.Minute}},
+		{"square:10%:100%:30s", RateVariation{Pattern: RateSquare, Low: 0.1, High: 1, Period: 30 * time.Second}},
+	}
+	for _, tt := range tests {
+		got, err := ParseRateVariation(tt.input)
+		if err != nil || got.Pattern != tt.want.Pattern || got.Low != tt.want.Low || got.High != tt.want.High || got.Period != tt.want.Period {
+			t.Errorf("ParseRateVariation(%q) = %+v, %v; want %+v", tt.input, got, err, tt.want)
+		}
+	}
+	got, err := ParseRateVariation("steps:50%@10s, 200%@1m")
+	want := []RateStep{{10 * time.Second, 0.5}, {time.Minute, 2}}
+	if err != nil || got.Pattern != RateSteps || !slices.Equal(got.Steps, want) {
+		t.Errorf("ParseRateVariation(steps) = %+v, %v; want steps %v", got, err, want)
+	}
+	for _, input := range []string{"", "walk", "walk:1", "sine:50%:100%", "square:1:0.5:1s", "walk:0:0", "sine:-1:1:1s", "steps:", "steps:50%", "steps:x@1s", "drift:1:2:1s"} {
+		if _, err := ParseRateVariation(input); err == nil {
+			t.Errorf("ParseRateVariation(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+// TestRateVariationPatterns samples each pattern's factor over time.
+func TestRateVariationPatterns(t *testing.T) {
+	scales := func(cfg *RateVariation, every time.Duration, n int) []float64 {
+		v := newRateVariation(cfg, rand.New(rand.NewSource(1)), virtualEpoch)
+		var out []float64
+		for i := range n {
+			v.advance(virtualEpoch.Add(time.Duration(i) * every))
+			out = append(out, v.scale)
+		}
+		return out
+	}
+	if got := scales(&RateVariation{Pattern: RateSquare, Low: 0.25, High: 1, Period: 2 * time.Second}, time.Second, 4); !slices.Equal(got, []float64{1, 0.25, 1, 0.25}) {
+		t.Errorf("square: %v", got)
+	}
+	if got := scales(&RateVariation{Pattern: RateSine, Low: 0.5, High: 1.5, Period: 4 * time.Second}, time.Second, 5); !slices.EqualFunc(got, []float64{1, 1.5, 1, 0.5, 1}, func(a, b float64) bool {
+		return a-b < 1e-9 && b-a < 1e-9
+	}) {
+		t.Errorf("sine: %v", got)
+	}
+	steps := &RateVariation{Pattern: RateSteps, Steps: []RateStep{{2 * time.Second, 0.1}, {0, 0.5}}}
+	if got := scales(steps, time.Second, 3); !slices.Equal(got, []float64{0.5, 0.5, 0.1}) {
+		t.Errorf("steps: %v", got)
+	}
+
+	walk := scales(&RateVariation{Pattern: RateWalk, Low: 0.2, High: 0.6}, time.Second, 1000)
+	if walk[0] != 0.6 {
+		t.Errorf("walk starts at %v, want the bound nearest 1", walk[0])
+	}
+	lo, hi := slices.Min(walk), slices.Max(walk)
+	if lo < 0.2 || hi > 0.6 || hi-lo < 0.3 {
+		t.Errorf("walk ranges over [%v, %v], want most of [0.2, 0.6] and no more", lo, hi)
+	}
+	for i := 1; i < len(walk); i++ {
+		if d := walk[i] - walk[i-1]; d > 0.04+1e-9 || d < -0.04-1e-9 {
+			t.Fatalf("walk step %d of %v, more than a tenth of the range", i, d)
+		}
+	}
+}
+
+// TestRateStageVariation checks that data waiting for the token bucket is
+// re-timed when the rate drops: 1000 bytes go at 1000 B/s in the first
+// second and the next 1000 at 100 B/s.
+func TestRateStageVariation(t *testing.T) {
+	steps := &RateVariation{Pattern: RateSteps, Steps: []RateStep{{time.Second, 0.1}}}
+	r := newRateStage(ShaperConfig{Rate: 1000, Burst: 100, RateVariation: steps, Clock: NewFakeClock(virtualEpoch)}, nil, nil)
+	written := 0
+	emit := func(p []byte) error {
+		written += len(p)
+		return nil
+	}
+	if err := r.Push(virtualEpoch, make([]byte, 2100), emit); err != nil {
+		t.Fatal(err)
+	}
+	last := drainRate(t, r, emit, &written)
+	if got := last.Sub(virtualEpoch); written != 2100 || got < 10900*time.Millisecond || got > 11100*time.Millisecond {
+		t.Errorf("wrote %d bytes, the last at %v; want 2100 by about 11s", written, got)
+	}
+	var st Stats
+	r.addStats(last, &st)
+	if st.Rate != 100 {
+		t.Errorf("Stats.Rate = %d, want 100", st.Rate)
+	}
+}
+
+// TestRateStageSerialVariation checks the same on the wire: 1000 bytes in
+// the first second at full speed, then 500 in the next at half speed. The
+// byte on the wire at the change starts again, so it may cost a byte time.
+func TestRateStageSerialVariation(t *testing.T) {
+	square := &RateVariation{Pattern: RateSquare, Low: 0.5, High: 1, Period: 2 * time.Second}
+	r := newRateStage(ShaperConfig{Rate: 1000, SerialMode: true, RateVariation: square, Clock: NewFakeClock(virtualEpoch)}, nil, nil)
+	written := 0
+	emit := func(p []byte) error {
+		written += len(p)
+		return nil
+	}
+	if err := r.Push(virtualEpoch, make([]byte, 1500), emit); err != nil {
+		t.Fatal(err)
+	}
+	last := drainRate(t, r, emit, &written)
+	want := 2 * time.Second
+	if got := last.Sub(virtualEpoch); written != 1500 || got < want-serialQuantum || got > want+2*time.Millisecond+serialQuantum {
+		t.Errorf("wrote %d bytes, the last at %v; want 1500 by %v", written, got, want)
+	}
+}
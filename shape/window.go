@@ -0,0 +1,333 @@
+package shape
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Window model parameters
+const (
+	defaultInitialWindow = 10      // Segments (RFC 6928, and Linux's default)
+	maxWindow            = 1 << 30 // Cap on an unbounded congestion window, in bytes
+)
+
+// roundTrip returns the round-trip time the TCP models in cfg work from:
+// RTT, or twice the direction's base delay.
+func roundTrip(cfg ShaperConfig) time.Duration {
+	if cfg.RTT > 0 {
+		return cfg.RTT
+	}
+	return 2 * baseDelay(cfg)
+}
+
+// windowStage models when a TCP sender lets data go: it limits the data in
+// flight, as TCP's congestion and flow control windows do, and holds small
+// writes back as Nagle's algorithm does. Data is in flight from the moment
+// it is sent until its ACK comes back one RTT later; while a window's worth
+// is in flight, the rest waits here.
+//
+// With SlowStart, the congestion window starts at InitialWindow segments
+// and grows by the bytes each ACK covers, doubling every RTT, for as long
+// as the window is what holds the sender back (RFC 7661). After the stream
+// has been idle for a retransmission timeout the window drops back to its
+// initial size (RFC 5681 §4.1; Linux's tcp_slow_start_after_idle).
+// ReceiveWindow caps the window, as the receiver's advertised window or an
+// SSH channel window does.
+//
+// Segments carry the link's MTU less its packet overhead, as the packet
+// layer's packets do, or less TCP/IP headers without a packet layer.
+//
+// With Nagle, while any data is unacknowledged only full segments are sent;
+// a partial one waits for the next ACK (RFC 896). With DelayedACK, the peer
+// acknowledges every second full segment at once but anything less only
+// when its delayed-ACK timer, started by the first unacknowledged byte,
+// runs out (RFC 1122 §4.2.3.2). Together they produce the familiar stall: a
+// keystroke goes out, the next waits for an ACK the peer is sitting on, and
+// keystrokes arrive in pairs. With none of these set, data passes straight
+// through.
+//
+// ACKs are timed from when data is sent, not from when it crosses the rate
+// limit, so a window larger than the bandwidth-delay product fills the rate
+// stage's queue, as it fills a bottleneck's buffer.
+type windowStage struct {
+	slowStart  bool
+	initial    int // InitialWindow, in bytes
+	rwnd       int // ReceiveWindow (0 = unlimited)
+	nagle      bool
+	delayedACK time.Duration
+	rtt        time.Duration
+	segment    int // Payload per segment, in bytes
+	cwnd       int // Congestion window, in bytes
+
+	flights  ring[flight] // Data sent and not yet acknowledged, oldest first
+	inFlight int          // Bytes in flights
+	lastSend time.Time
+
+	// The newest flight is awaiting the peer's delayed-ACK timer, and will
+	// be acknowledged at once if it grows to two full segments
+	delaying bool
+
+	queue  ring[queuedPiece] // Data waiting for the window or an ACK
+	queued int               // Bytes in queue
+	pool   bufferPool
+	obs    Observer
+
+	// For Stats
+	window atomic.Int64
+	wait   waitTimer
+}
+
+// flight is data sent at one time and when its ACK arrives.
+type flight struct {
+	ackAt time.Time
+	n     int
+}
+
+func newWindowStage(cfg ShaperConfig, obs Observer) *windowStage {
+	w := &windowStage{obs: obs}
+	w.configure(cfg)
+	w.cwnd = w.initial
+	w.publish()
+	return w
+}
+
+// configure adopts the window parameters in cfg.
+func (w *windowStage) configure(cfg ShaperConfig) {
+	segments := cfg.InitialWindow
+	if segments <= 0 {
+		segments = defaultInitialWindow
+	}
+	w.slowStart = cfg.SlowStart
+	w.segment = tcpSegment(cfg)
+	w.initial = segments * w.segment
+	w.rwnd = cfg.ReceiveWindow
+	w.nagle = cfg.Nagle
+	w.delayedACK = max(cfg.DelayedACK, 0)
+	w.rtt = roundTrip(cfg)
+}
+
+// tcpSegment returns the TCP payload per segment on cfg's link: the
+// payload of the packet layer's packets, the MTU less the headers
+// segmentSize allows for, or segmentSize.
+func tcpSegment(cfg ShaperConfig) int {
+	if pk := newPacketizer(cfg); pk.enabled() {
+		return pk.payload
+	}
+	if cfg.MTU > 0 {
+		return max(cfg.MTU-(defaultMTU-segmentSize), 1)
+	}
+	return segmentSize
+}
+
+// enabled reports whether the stage does anything.
+func (w *windowStage) enabled() bool {
+	return w.limited() || w.nagle || w.delayedACK > 0
+}
+
+// limited reports whether a window limits the data in flight.
+func (w *windowStage) limited() bool {
+	return w.slowStart || w.rwnd > 0
+}
+
+// limit returns the bytes that may be in flight.
+func (w *windowStage) limit() int {
+	win := math.MaxInt
+	if w.slowStart {
+		win = w.cwnd
+	}
+	if w.rwnd > 0 {
+		win = min(win, w.rwnd)
+	}
+	return win
+}
+
+// publish updates the window reported by Stats.
+func (w *windowStage) publish() {
+	win := 0
+	if w.limited() {
+		win = w.limit()
+	}
+	w.window.Store(int64(win))
+}
+
+// ack retires the data whose ACKs have arrived by now, growing the
+// congestion window if the window is what holds data back.
+func (w *windowStage) ack(now time.Time) {
+	blocked := w.queued > 0 && w.inFlight+w.queued > w.limit()
+	for w.flights.len() > 0 && !w.flights.front().ackAt.After(now) {
+		f := w.flights.pop()
+		w.inFlight -= f.n
+		if w.slowStart && blocked {
+			w.cwnd = min(w.cwnd+f.n, maxWindow)
+			if w.rwnd > 0 {
+				w.cwnd = min(w.cwnd, w.rwnd)
+			}
+		}
+	}
+	if w.flights.len() == 0 {
+		w.delaying = false
+	}
+}
+
+// restart drops the congestion window back to its initial size if the
+// stream has been idle for a retransmission timeout.
+func (w *windowStage) restart(now time.Time) {
+	if w.slowStart && w.inFlight == 0 && w.queued == 0 && !w.lastSend.IsZero() &&
+		now.Sub(w.lastSend) > w.rtt+minRTO {
+		w.cwnd = min(w.cwnd, w.initial)
+	}
+}
+
+// allowance returns how many of n bytes waiting to be sent may go now.
+func (w *windowStage) allowance(n int) int {
+	n = min(n, w.limit()-w.inFlight)
+	if w.nagle && w.inFlight > 0 {
+		n -= n % w.segment
+	}
+	return max(n, 0)
+}
+
+// sent records n bytes sent at now, and when their ACK will arrive.
+func (w *windowStage) sent(now time.Time, n int) {
+	w.inFlight += n
+	w.lastSend = now
+	if w.delayedACK <= 0 {
+		w.flights.push(flight{ackAt: now.Add(w.rtt), n: n})
+		return
+	}
+
+	// The peer's timer started with the newest flight; if it has not run
+	// out, the peer has not acknowledged that flight yet and this data
+	// joins it
+	if w.delaying {
+		if last := w.flights.at(w.flights.len() - 1); now.Add(w.rtt).Before(last.ackAt) {
+			last.n += n
+			if last.n >= 2*w.segment {
+				last.ackAt = now.Add(w.rtt)
+				w.delaying = false
+			}
+			return
+		}
+	}
+	f := flight{ackAt: now.Add(w.rtt), n: n}
+	w.delaying = n < 2*w.segment
+	if w.delaying {
+		f.ackAt = f.ackAt.Add(w.delayedACK)
+	}
+	w.flights.push(f)
+}
+
+func (w *windowStage) Push(now time.Time, p []byte, emit Emit) error {
+	if !w.enabled() {
+		return emit(p)
+	}
+	defer w.account(now)
+	w.ack(now)
+	w.restart(now)
+	if err := w.drain(now, emit); err != nil {
+		return err
+	}
+	if w.queue.len() == 0 {
+		if n := w.allowance(len(p)); n > 0 {
+			w.sent(now, n)
+			if err := emit(p[:n]); err != nil {
+				return err
+			}
+			p = p[n:]
+		}
+	}
+	if len(p) > 0 {
+		w.queue.push(queuedPiece{buf: w.pool.clone(p), at: now})
+		w.queued += len(p)
+	}
+	return nil
+}
+
+func (w *windowStage) Next() (time.Time, bool) {
+	switch {
+	case w.queue.len() == 0:
+		return time.Time{}, false
+	case w.flights.len() == 0:
+		// Nothing is in flight (the stage was reconfigured); send at once
+		return w.lastSend, true
+	}
+	return w.flights.front().ackAt, true
+}
+
+func (w *windowStage) Release(now time.Time, emit Emit) error {
+	defer w.account(now)
+	w.ack(now)
+	return w.drain(now, emit)
+}
+
+// drain sends as much queued data as the window and Nagle allow.
+func (w *windowStage) drain(now time.Time, emit Emit) error {
+	n := w.allowance(w.queued)
+	if n == 0 {
+		return nil
+	}
+	w.sent(now, n)
+	w.queued -= n
+	for n > 0 {
+		head := w.queue.front()
+		p := head.data()
+		k := min(n, len(p))
+		if err := emit(p[:k]); err != nil {
+			return err
+		}
+		n -= k
+		if k < len(p) {
+			head.off += k
+			return nil
+		}
+		w.pool.put(w.queue.pop().buf)
+	}
+	return nil
+}
+
+// Reconfigure adopts the new window settings. Turning slow start on starts
+// from the initial window; turning the model off sends everything waiting.
+func (w *windowStage) Reconfigure(now time.Time, cfg ShaperConfig, emit Emit) error {
+	defer w.account(now)
+	wasSlowStart := w.slowStart
+	w.configure(cfg)
+	if w.slowStart && !wasSlowStart {
+		w.cwnd = w.initial
+	}
+	if w.delayedACK <= 0 {
+		w.delaying = false
+	}
+	if !w.enabled() {
+		for w.queue.len() > 0 {
+			head := w.queue.pop()
+			err := emit(head.data())
+			w.pool.put(head.buf)
+			if err != nil {
+				return err
+			}
+		}
+		w.queued = 0
+		return nil
+	}
+	w.ack(now)
+	return w.drain(now, emit)
+}
+
+// account publishes the window and starts or ends a wait for it.
+func (w *windowStage) account(now time.Time) {
+	w.publish()
+	started, waited, changed := w.wait.update(now, w.queue.len() > 0)
+	switch {
+	case !changed || w.obs == nil:
+	case started:
+		w.obs.WindowWaitStarted(now, int(w.window.Load()))
+	default:
+		w.obs.WindowWaitFinished(now, waited)
+	}
+}
+
+func (w *windowStage) addStats(now time.Time, out *Stats) {
+	out.Window = int(w.window.Load())
+	out.WindowBlocked = w.wait.total(now)
+}
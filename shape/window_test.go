@@ -0,0 +1,215 @@
+package shape
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// windowTrace drives a window stage directly and records how many bytes it
+// emits at each time, relative to virtualEpoch.
+type windowTrace struct {
+	w    *windowStage
+	sent []string
+	now  time.Time
+}
+
+func newWindowTrace(cfg ShaperConfig) *windowTrace {
+	return &windowTrace{w: newWindowStage(cfg, nil), now: virtualEpoch}
+}
+
+func (tr *windowTrace) emit(p []byte) error {
+	tr.sent = append(tr.sent, fmt.Sprintf("%v:%d", tr.now.Sub(virtualEpoch), len(p)))
+	return nil
+}
+
+// push releases whatever is due by at, as a Shaper would, then pushes n
+// bytes.
+func (tr *windowTrace) push(at time.Duration, n int) {
+	tr.runUntil(virtualEpoch.Add(at))
+	tr.now = virtualEpoch.Add(at)
+	if err := tr.w.Push(tr.now, make([]byte, n), tr.emit); err != nil {
+		panic(err)
+	}
+}
+
+// run releases the stage until it holds nothing.
+func (tr *windowTrace) run() {
+	tr.runUntil(time.Time{})
+}
+
+// runUntil releases the stage until it holds nothing due by end, or
+// nothing at all if end is zero.
+func (tr *windowTrace) runUntil(end time.Time) {
+	for {
+		t, ok := tr.w.Next()
+		if !ok || !end.IsZero() && t.After(end) {
+			return
+		}
+		tr.now = t
+		if err := tr.w.Release(t, tr.emit); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (tr *windowTrace) take() string {
+	s := strings.Join(tr.sent, " ")
+	tr.sent = nil
+	return s
+}
+
+func TestWindowSlowStart(t *testing.T) {
+	tr := newWindowTrace(ShaperConfig{Delay: 50 * time.Millisecond, SlowStart: true})
+	tr.push(0, 100000)
+	tr.run()
+	// 10 segments, then 20, then the rest of what would be 40
+	if got, want := tr.take(), "0s:14480 100ms:28960 200ms:56560"; got != want {
+		t.Errorf("sent %s, want %s", got, want)
+	}
+	// The last round did not fill the window, so its ACKs add nothing
+	if tr.w.cwnd != 4*14480 {
+		t.Errorf("cwnd %d, want %d", tr.w.cwnd, 4*14480)
+	}
+
+	// Idle for longer than the RTO: back to the initial window
+	tr.push(time.Second, 20000)
+	tr.run()
+	if got, want := tr.take(), "1s:14480 1.1s:5520"; got != want {
+		t.Errorf("after idle sent %s, want %s", got, want)
+	}
+}
+
+func TestWindowReceiveWindow(t *testing.T) {
+	tr := newWindowTrace(ShaperConfig{RTT: 100 * time.Millisecond, SlowStart: true, ReceiveWindow: 20000})
+	tr.push(0, 100000)
+	tr.run()
+	if got, want := tr.take(), "0s:14480 100ms:20000 200ms:20000 300ms:20000 400ms:20000 500ms:5520"; got != want {
+		t.Errorf("sent %s, want %s", got, want)
+	}
+	if tr.w.cwnd != 20000 {
+		t.Errorf("cwnd %d, want capped at the receive window", tr.w.cwnd)
+	}
+}
+
+// TestWindowAppLimited checks that a stream that never fills its window,
+// like typing, does not grow it.
+func TestWindowAppLimited(t *testing.T) {
+	tr := newWindowTrace(ShaperConfig{RTT: 100 * time.Millisecond, SlowStart: true, InitialWindow: 2})
+	for i := 0; i < 100; i++ {
+		tr.push(time.Duration(i)*10*time.Millisecond, 100)
+	}
+	tr.run()
+	if tr.w.cwnd != 2*segmentSize {
+		t.Errorf("cwnd %d after typing, want the initial %d", tr.w.cwnd, 2*segmentSize)
+	}
+	if got := strings.Count(tr.take(), ":100"); got != 100 {
+		t.Errorf("%d keystrokes sent at once, want all 100", got)
+	}
+}
+
+// TestShaperWindow runs a Shaper with a one-segment initial window: the
+// first segment goes out at once, and the rest when its ACK returns a
+// round trip later.
+func TestShaperWindow(t *testing.T) {
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+	obs := &traceObserver{}
+	cfg := ShaperConfig{
+		Delay: 50 * time.Millisecond, SlowStart: true, InitialWindow: 1,
+		Clock: fc, Observer: obs,
+	}
+	s := NewShaper(cfg)
+	done := startVirtual(s, dst, strings.NewReader(strings.Repeat("x", 4096)))
+	stepUntil(t, fc, func() bool { return dst.count() == 2 })
+	if err := <-done; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	for i, want := range []struct {
+		at time.Duration
+		n  int
+	}{{50 * time.Millisecond, segmentSize}, {150 * time.Millisecond, 4096 - segmentSize}} {
+		if got := dst.writes[i]; got.t.Sub(virtualEpoch) != want.at || len(got.data) != want.n {
+			t.Errorf("write %d: %d bytes at %v, want %d at %v", i, len(got.data), got.t.Sub(virtualEpoch), want.n, want.at)
+		}
+	}
+	st := s.Stats()
+	if st.Window != 2*segmentSize || st.WindowBlocked != 100*time.Millisecond {
+		t.Errorf("window %d, blocked %v; want %d and 100ms", st.Window, st.WindowBlocked, 2*segmentSize)
+	}
+	trace := strings.Join(obs.trace(), "\n")
+	if !strings.Contains(trace, "0s window wait at 1448") || !strings.Contains(trace, "100ms window wait done after 100ms") {
+		t.Errorf("trace lacks the window wait:\n%s", trace)
+	}
+}
+
+// TestWindowNagle checks that Nagle's algorithm holds keystrokes while one
+// is unacknowledged, and that the peer's delayed ACK stretches the hold
+// past the RTT, so keystrokes arrive in bunches.
+func TestWindowNagle(t *testing.T) {
+	tr := newWindowTrace(ShaperConfig{RTT: 100 * time.Millisecond, Nagle: true, DelayedACK: 40 * time.Millisecond})
+	for i := 0; i < 7; i++ {
+		tr.push(time.Duration(i)*30*time.Millisecond, 1)
+	}
+	tr.run()
+	if got, want := tr.take(), "0s:1 140ms:1 140ms:1 140ms:1 140ms:1 280ms:1 280ms:1"; got != want {
+		t.Errorf("sent %s, want %s", got, want)
+	}
+
+	// Full segments go out regardless; only the partial one waits
+	tr = newWindowTrace(ShaperConfig{RTT: 100 * time.Millisecond, Nagle: true})
+	tr.push(0, 100)
+	tr.push(10*time.Millisecond, 3000)
+	tr.run()
+	if got, want := tr.take(), "0s:100 10ms:2896 110ms:104"; got != want {
+		t.Errorf("sent %s, want %s", got, want)
+	}
+}
+
+// TestWindowDelayedACK checks that the peer acknowledges two full segments
+// at once but sits on one, which stalls slow start from a one-segment
+// window for the delayed-ACK timer.
+func TestWindowDelayedACK(t *testing.T) {
+	for _, tt := range []struct {
+		initial int
+		want    string
+	}{
+		{1, "0s:1448 300ms:1552"},
+		{2, "0s:2896 100ms:2104"},
+	} {
+		tr := newWindowTrace(ShaperConfig{
+			RTT: 100 * time.Millisecond, SlowStart: true, InitialWindow: tt.initial,
+			DelayedACK: 200 * time.Millisecond,
+		})
+		tr.push(0, 5000-2000*(2-tt.initial))
+		tr.run()
+		if got := tr.take(); got != tt.want {
+			t.Errorf("initial window %d: sent %s, want %s", tt.initial, got, tt.want)
+		}
+	}
+}
+
+// TestWindowMTU checks that segments follow the link's MTU and packet
+// overhead, for Nagle's full segments and the peer's two-segment ACKs.
+func TestWindowMTU(t *testing.T) {
+	tr := newWindowTrace(ShaperConfig{RTT: 100 * time.Millisecond, Nagle: true, MTU: 576, PacketOverhead: 40})
+	tr.push(0, 100)
+	tr.push(10*time.Millisecond, 3000)
+	tr.run()
+	if got, want := tr.take(), "0s:100 10ms:2680 110ms:320"; got != want {
+		t.Errorf("536-byte segments: sent %s, want %s", got, want)
+	}
+
+	// Two jumbo segments are acknowledged at once
+	tr = newWindowTrace(ShaperConfig{
+		RTT: 100 * time.Millisecond, SlowStart: true, InitialWindow: 2,
+		DelayedACK: 200 * time.Millisecond, MTU: 9000,
+	})
+	tr.push(0, 20000)
+	tr.run()
+	if got, want := tr.take(), "0s:17896 100ms:2104"; got != want {
+		t.Errorf("8948-byte segments: sent %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,80 @@
+package shape
+
+import (
+	"math/bits"
+	"time"
+)
+
+// serialQuantum is the shortest interval between wake-ups in serial mode.
+// Below it timers are unreliable, so at high baud rates every byte whose
+// time has come within a quantum goes out in one write.
+const serialQuantum = time.Millisecond
+
+// wire models a serial line that sends Rate bytes per second. Byte k of a
+// continuous transmission finishes exactly k/Rate seconds after it began,
+// no matter when the shaper gets round to writing it: a late wake-up is
+// timing debt, paid back by writing every byte that has finished since,
+// so long-run throughput is exactly Rate.
+type wire struct {
+	rate  int64
+	start time.Time // When the current transmission began
+	sent  int64     // Bytes of it written out so far
+	last  time.Time // Time of the last write
+}
+
+// begin starts a new transmission at now, on an idle line.
+func (w *wire) begin(now time.Time) {
+	w.start, w.sent = now, 0
+}
+
+// finish returns when byte k of the current transmission is fully sent:
+// k/Rate seconds after it began, rounded up to the nanosecond.
+func (w *wire) finish(k int64) time.Time {
+	hi, lo := bits.Mul64(uint64(k), uint64(time.Second))
+	q, rem := bits.Div64(hi, lo, uint64(w.rate))
+	if rem > 0 {
+		q++
+	}
+	return w.start.Add(time.Duration(q))
+}
+
+// next returns when the next write is due: when the next byte has
+// finished, after skip bytes of framing ahead of it, but no sooner than a
+// quantum after the last write.
+func (w *wire) next(skip int64) time.Time {
+	t := w.finish(w.sent + skip + 1)
+	if q := w.last.Add(serialQuantum); t.Before(q) {
+		return q
+	}
+	return t
+}
+
+// duration returns how long n bytes take to cross the wire.
+func (w *wire) duration(n int64) time.Duration {
+	return time.Duration(mulDiv(uint64(n), uint64(time.Second), uint64(w.rate)))
+}
+
+// busy reports whether bytes already sent are still crossing the wire at
+// now.
+func (w *wire) busy(now time.Time) bool {
+	return w.finish(w.sent).After(now)
+}
+
+// due returns how many bytes beyond those already written have finished
+// by now.
+func (w *wire) due(now time.Time) int64 {
+	elapsed := now.Sub(w.start)
+	if elapsed < 0 {
+		return 0
+	}
+	// Byte k has finished once k/Rate <= elapsed
+	k := int64(mulDiv(uint64(elapsed), uint64(w.rate), uint64(time.Second)))
+	return k - w.sent
+}
+
+// mulDiv returns a*b/c without overflowing in the intermediate product.
+func mulDiv(a, b, c uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	q, _ := bits.Div64(hi, lo, c)
+	return q
+}
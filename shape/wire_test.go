@@ -0,0 +1,85 @@
+package shape
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestShaperSerialHighBaud runs one read's worth of data through serial
+// mode at 115200 baud in virtual time. Bytes must go out in batches no more
+// often than the quantum, every write must hold exactly the bytes that have
+// finished by then, and the last batch must follow the last byte's finish
+// time within a quantum.
+func TestShaperSerialHighBaud(t *testing.T) {
+	cfg := ShaperConfig{Rate: 115200 / 10, SerialMode: true}
+	// A single read, so the whole transfer is queued at the epoch
+	input := bytes.Repeat([]byte("x"), readBufferSize)
+
+	fc := NewFakeClock(virtualEpoch)
+	dst := &clockWriter{clock: fc}
+	if err := copyVirtual(t, fc, dst, bytes.NewReader(input), cfg); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	if got := len(dst.String()); got != len(input) {
+		t.Fatalf("wrote %d bytes, want %d", got, len(input))
+	}
+	total := (int64(len(input))*int64(time.Second) + cfg.Rate - 1) / cfg.Rate
+	if last := dst.writes[len(dst.writes)-1].t.Sub(virtualEpoch); last < time.Duration(total) || last >= time.Duration(total)+serialQuantum {
+		t.Errorf("last byte at %v, want within %v of %v", last, serialQuantum, time.Duration(total))
+	}
+	if n, limit := len(dst.writes), int(time.Duration(total)/serialQuantum)+2; n > limit {
+		t.Errorf("%d writes for %v of data, want at most one per %v", n, time.Duration(total), serialQuantum)
+	}
+
+	sent := int64(0)
+	for i, w := range dst.writes {
+		if i > 0 && w.t.Sub(dst.writes[i-1].t) < serialQuantum {
+			t.Fatalf("write %d only %v after the previous one", i, w.t.Sub(dst.writes[i-1].t))
+		}
+		sent += int64(len(w.data))
+		elapsed := w.t.Sub(virtualEpoch)
+		want := min(int64(elapsed)*cfg.Rate/int64(time.Second), int64(len(input)))
+		if sent != want {
+			t.Fatalf("%d bytes written by %v, want %d", sent, elapsed, want)
+		}
+	}
+}
+
+// TestRateStageSerialTimingDebt wakes a 9600 baud wire 50ms late: the
+// bytes that finished in the meantime go out at once, and the rest keep
+// to the original schedule instead of slipping by 50ms.
+func TestRateStageSerialTimingDebt(t *testing.T) {
+	r := newRateStage(ShaperConfig{Rate: 960, SerialMode: true}, nil, nil)
+
+	var writes [][]byte
+	emit := func(p []byte) error {
+		writes = append(writes, append([]byte(nil), p...))
+		return nil
+	}
+	if err := r.Push(virtualEpoch, make([]byte, 100), emit); err != nil {
+		t.Fatal(err)
+	}
+
+	late := virtualEpoch.Add(50 * time.Millisecond)
+	if err := r.Release(late, emit); err != nil {
+		t.Fatal(err)
+	}
+	if len(writes) != 1 || len(writes[0]) != 48 {
+		t.Fatalf("late release wrote %d pieces (first %d bytes), want one of 48", len(writes), len(writes[0]))
+	}
+
+	next, ok := r.Next()
+	want := virtualEpoch.Add(time.Duration((49*int64(time.Second) + 959) / 960))
+	if !ok || !next.Equal(want) {
+		t.Errorf("next byte due at %v, want %v on the original schedule", next.Sub(virtualEpoch), want.Sub(virtualEpoch))
+	}
+}
+
+func TestMulDiv(t *testing.T) {
+	// 2^40 * 10^9 overflows int64 but the quotient does not
+	if got := mulDiv(1<<40, 1e9, 1e6); got != (1<<40)*1000 {
+		t.Errorf("mulDiv = %d, want %d", got, uint64(1<<40)*1000)
+	}
+}
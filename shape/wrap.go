@@ -0,0 +1,265 @@
+package shape
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// closeLinger is how long shapedConn.Close waits for queued data to reach
+// a peer that is not reading it, without a write deadline.
+const closeLinger = 30 * time.Second
+
+// shapedWriter feeds writes through a Shaper running in its own goroutine.
+type shapedWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+// NewWriter returns a writer whose data reaches w shaped according to cfg.
+// Write returns once the shaper has accepted the data, not when it reaches
+// w. Close flushes everything still in flight, waits for it to be written
+// and returns the first error the shaper hit. Close does not close w.
+func NewWriter(w io.Writer, cfg ShaperConfig) io.WriteCloser {
+	pr, pw := io.Pipe()
+	sw := &shapedWriter{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(sw.done)
+		sw.err = Copy(context.Background(), w, pr, cfg)
+		// Unblock pending writers if the shaper gave up early
+		pr.CloseWithError(sw.err)
+	}()
+	return sw
+}
+
+func (w *shapedWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *shapedWriter) Close() error {
+	w.pw.Close()
+	<-w.done
+	return w.err
+}
+
+// shapedReader yields data copied from a source through a Shaper.
+type shapedReader struct {
+	pr     *io.PipeReader
+	cancel context.CancelFunc
+}
+
+// NewReader returns a reader that yields r's data shaped according to cfg.
+// Close stops the shaper but does not close r.
+func NewReader(r io.Reader, cfg ShaperConfig) io.ReadCloser {
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	go func() {
+		// A clean EOF from r (nil error) surfaces as io.EOF to the reader
+		pw.CloseWithError(Copy(ctx, pw, r, cfg))
+	}()
+	return &shapedReader{pr: pr, cancel: cancel}
+}
+
+func (r *shapedReader) Read(p []byte) (int, error) {
+	return r.pr.Read(p)
+}
+
+func (r *shapedReader) Close() error {
+	r.cancel()
+	return r.pr.Close()
+}
+
+// shapedConn is a net.Conn whose reads and writes pass through their own
+// Shapers. The application talks to one end of a synchronous net.Pipe per
+// direction, which gives deadlines for free; the shapers sit between the
+// other ends and the real connection.
+type shapedConn struct {
+	conn net.Conn // Underlying connection
+	r    net.Conn // Application end of the read-side pipe
+	w    net.Conn // Application end of the write-side pipe
+
+	clock     Clock // The write side's, for the linger on Close
+	cancel    context.CancelFunc
+	writeDone chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+
+	mu            sync.Mutex
+	readErr       error     // Error that ended the read-side shaper, if any
+	writeDeadline time.Time // As last set, bounding Close's linger
+}
+
+// NewConn wraps c so that both directions are shaped: read shapes data
+// arriving from the peer, write shapes data sent to it.
+//
+// Close sends everything still queued in the write direction before
+// closing c, the way a TCP stack delivers pending data ahead of its FIN.
+// It waits for that until the write deadline, or for 30s if none is set;
+// if the peer has not taken the data by then, Close discards it, closes c
+// anyway and returns os.ErrDeadlineExceeded.
+func NewConn(c net.Conn, read, write ShaperConfig) net.Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	appR, shaperW := net.Pipe()
+	appW, shaperR := net.Pipe()
+
+	sc := &shapedConn{
+		conn:      c,
+		r:         appR,
+		w:         appW,
+		clock:     configClock(write),
+		cancel:    cancel,
+		writeDone: make(chan struct{}),
+	}
+
+	// Read side: peer → shaper → application
+	go func() {
+		err := Copy(ctx, shaperW, c, read)
+		sc.mu.Lock()
+		sc.readErr = err
+		sc.mu.Unlock()
+		shaperW.Close()
+	}()
+
+	// Write side: application → shaper → peer
+	go func() {
+		defer close(sc.writeDone)
+		Copy(ctx, c, shaperR, write)
+		shaperR.Close()
+	}()
+
+	return sc
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err == io.EOF {
+		c.mu.Lock()
+		if c.readErr != nil {
+			err = c.readErr
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *shapedConn) Close() error {
+	c.closeOnce.Do(func() {
+		// EOF to the write shaper, which drains what is queued to the peer
+		c.w.Close()
+		timer := c.clock.NewTimer(c.linger())
+		defer timer.Stop()
+		var lingered bool
+		select {
+		case <-c.writeDone:
+		case <-timer.C():
+			// The peer is not taking the data; closing c stops the shaper
+			lingered = true
+		}
+		c.cancel()
+		c.closeErr = c.conn.Close()
+		if lingered && c.closeErr == nil {
+			c.closeErr = os.ErrDeadlineExceeded
+		}
+		c.r.Close()
+	})
+	return c.closeErr
+}
+
+// linger returns how long Close waits for queued data to be sent.
+func (c *shapedConn) linger() time.Duration {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if deadline.IsZero() {
+		return closeLinger
+	}
+	return max(deadline.Sub(c.clock.Now()), 0)
+}
+
+func (c *shapedConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *shapedConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *shapedConn) SetDeadline(t time.Time) error {
+	if err := c.r.SetDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *shapedConn) SetReadDeadline(t time.Time) error { return c.r.SetReadDeadline(t) }
+
+func (c *shapedConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.w.SetWriteDeadline(t)
+}
+
+// shapedListener wraps every accepted connection with NewConn.
+type shapedListener struct {
+	net.Listener
+	read     ShaperConfig
+	write    ShaperConfig
+	accepted atomic.Int64
+}
+
+// NewListener wraps l so that every accepted connection is shaped with
+// NewConn: read shapes data arriving from the client, write shapes data
+// sent to it.
+//
+// Connections are shaped independently. The nth accepted, from 0, uses
+// Seed+n for each direction with a Seed set, so connections draw different
+// jitter and loss reproducibly. Each gets its own Medium, Hangup and
+// ACKPaths in place of those in read and write, shared between its two
+// directions where read and write share them.
+func NewListener(l net.Listener, read, write ShaperConfig) net.Listener {
+	return &shapedListener{Listener: l, read: read, write: write}
+}
+
+func (l *shapedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	read, write := connConfigs(l.read, l.write, l.accepted.Add(1)-1)
+	return NewConn(c, read, write), nil
+}
+
+// connConfigs returns the configs for the nth connection a listener
+// accepts, with its own seeds and connection state.
+func connConfigs(read, write ShaperConfig, n int64) (ShaperConfig, ShaperConfig) {
+	copies := make(map[any]any)
+	for _, cfg := range []*ShaperConfig{&read, &write} {
+		if cfg.Seed != 0 {
+			cfg.Seed += n
+		}
+		cfg.Medium = connCopy(copies, cfg.Medium, func(m *Medium) *Medium { return NewMedium(m.turnaround) })
+		cfg.Hangup = connCopy(copies, cfg.Hangup, func(h *Hangup) *Hangup { return NewHangup(h.stall, h.idle) })
+		cfg.SendACKs = connCopy(copies, cfg.SendACKs, func(*ACKPath) *ACKPath { return NewACKPath() })
+		cfg.CarryACKs = connCopy(copies, cfg.CarryACKs, func(*ACKPath) *ACKPath { return NewACKPath() })
+	}
+	return read, write
+}
+
+// connCopy returns a connection's own copy of p, made with fresh the first
+// time p is seen and recorded in copies (nil for nil).
+func connCopy[T any](copies map[any]any, p *T, fresh func(*T) *T) *T {
+	if p == nil {
+		return nil
+	}
+	if c, ok := copies[p]; ok {
+		return c.(*T)
+	}
+	c := fresh(p)
+	copies[p] = c
+	return c
+}
@@ -0,0 +1,207 @@
+package shape
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewWriter(t *testing.T) {
+	var dst bytes.Buffer
+	w := NewWriter(&dst, ShaperConfig{Delay: 20 * time.Millisecond})
+
+	start := time.Now()
+	if _, err := io.WriteString(w, "hello"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if dst.String() != "hello" {
+		t.Errorf("output = %q, want %q", dst.String(), "hello")
+	}
+	if elapsed < 20*time.Millisecond {
+		t.Errorf("Close returned after %v, before the delay elapsed", elapsed)
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	r := NewReader(strings.NewReader("hello"), ShaperConfig{Delay: 20 * time.Millisecond})
+	defer r.Close()
+
+	start := time.Now()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("output = %q, want %q", got, "hello")
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("data arrived after %v, before the delay elapsed", elapsed)
+	}
+}
+
+// TestListenerAndConn runs an echo server behind a shaped listener and a
+// shaped client, so a round trip crosses four 10ms delays.
+func TestListenerAndConn(t *testing.T) {
+	hop := ShaperConfig{Delay: 10 * time.Millisecond}
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen on loopback: %v", err)
+	}
+	ln := NewListener(raw, hop, hop)
+	defer ln.Close()
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	rawClient, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	client := NewConn(rawClient, hop, hop)
+	defer client.Close()
+
+	if client.RemoteAddr().String() != ln.Addr().String() {
+		t.Errorf("RemoteAddr() = %v, want %v", client.RemoteAddr(), ln.Addr())
+	}
+
+	start := time.Now()
+	if _, err := io.WriteString(client, "ping\n"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatalf("ReadString: %v", err)
+	}
+	rtt := time.Since(start)
+
+	if line != "ping\n" {
+		t.Errorf("echo = %q, want %q", line, "ping\n")
+	}
+	if rtt < 40*time.Millisecond {
+		t.Errorf("round trip took %v, want at least 40ms", rtt)
+	}
+}
+
+// jitterObserver passes on the jitter drawn for each chunk.
+type jitterObserver struct {
+	NopObserver
+	jitter chan time.Duration
+}
+
+func (o *jitterObserver) ChunkDelayed(now time.Time, size int, jitter time.Duration, due time.Time) {
+	o.jitter <- jitter
+}
+
+// TestListenerConnsIndependent checks that connections accepted with one
+// seed draw different jitter, and get their own connection state.
+func TestListenerConnsIndependent(t *testing.T) {
+	obs := &jitterObserver{jitter: make(chan time.Duration, 1)}
+	read := ShaperConfig{Delay: time.Millisecond, Jitter: time.Millisecond, Seed: 42, Observer: obs}
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen on loopback: %v", err)
+	}
+	ln := NewListener(raw, read, ShaperConfig{})
+	defer ln.Close()
+
+	var jitter []time.Duration
+	for range 2 {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer client.Close()
+		c, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		defer c.Close()
+		io.WriteString(client, "x")
+		jitter = append(jitter, <-obs.jitter)
+	}
+	if jitter[0] == jitter[1] {
+		t.Errorf("both connections drew jitter %v, want their own", jitter[0])
+	}
+
+	// Both directions of a connection share its own Medium
+	medium := NewMedium(0)
+	r, w := connConfigs(ShaperConfig{Medium: medium}, ShaperConfig{Medium: medium}, 1)
+	if r.Medium == medium || r.Medium != w.Medium {
+		t.Error("connection does not have a Medium of its own for both directions")
+	}
+}
+
+func TestConnReadDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := NewConn(a, ShaperConfig{}, ShaperConfig{})
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Read() error = %v, want a timeout", err)
+	}
+}
+
+// TestConnCloseStuckPeer checks that Close gives up on queued data a peer
+// never reads: at the write deadline, or after the default linger.
+func TestConnCloseStuckPeer(t *testing.T) {
+	closeStuck := func(c net.Conn) <-chan error {
+		if _, err := io.WriteString(c, "unread"); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		closed := make(chan error, 1)
+		go func() { closed <- c.Close() }()
+		return closed
+	}
+
+	a, b := net.Pipe()
+	defer b.Close()
+	c := NewConn(a, ShaperConfig{}, ShaperConfig{})
+	c.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	select {
+	case err := <-closeStuck(c):
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Close() = %v, want os.ErrDeadlineExceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return at the write deadline")
+	}
+
+	fc := NewFakeClock(virtualEpoch)
+	a, b = net.Pipe()
+	defer b.Close()
+	closed := closeStuck(NewConn(a, ShaperConfig{}, ShaperConfig{Clock: fc}))
+	var err error
+	stepUntil(t, fc, func() bool {
+		select {
+		case err = <-closed:
+			return true
+		default:
+			return false
+		}
+	})
+	if got := fc.Now().Sub(virtualEpoch); got != closeLinger || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Close() = %v after %v, want os.ErrDeadlineExceeded after %v", err, got, closeLinger)
+	}
+}
@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/cbrunnkvist/ttylag/shape"
+)
+
+// formatLatency formats a latency from h for display to the millisecond,
+// or "-" if h is empty.
+func formatLatency(h *shape.LatencyHistogram, d time.Duration) string {
+	switch {
+	case h.Count() == 0:
+		return "-"
+	case d > 0 && d < time.Millisecond:
+		return "<1ms"
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+// printStats prints a table of what each direction's shapers did, for
+// --stats, a row per link: up1, up2, ... in the order data crosses them
+// when there are --hop links. LOST counts TCP segments lost to --loss,
+// retransmissions included, STALLED the total time they held data back,
+// and WIN WAIT the time data waited for the TCP window. Latency
+// percentiles are upper bounds from the shaper's power-of-two histogram.
+func printStats(w io.Writer, up, down []shape.Stats) {
+	fmt.Fprintf(w, "%-5s  %10s  %10s  %8s  %6s  %8s  %10s  %10s  %6s  %8s  %8s  %8s  %8s\n",
+		"DIR", "READ", "WRITTEN", "DROPPED", "LOST", "STALLED", "WIN WAIT", "RATE WAIT", "FRAMES", "P50", "P90", "P99", "MAX")
+	for _, dir := range []struct {
+		name  string
+		stats []shape.Stats
+	}{{"up", up}, {"down", down}} {
+		for i, st := range dir.stats {
+			name := dir.name
+			if len(dir.stats) > 1 {
+				name += strconv.Itoa(i + 1)
+			}
+			h := st.Latency
+			fmt.Fprintf(w, "%-5s  %10d  %10d  %8d  %6d  %8s  %10s  %10s  %6d  %8s  %8s  %8s  %8s\n",
+				name, st.BytesRead, st.BytesWritten, st.BytesDropped,
+				st.SegmentsLost, formatDuration(st.LossStall.Round(time.Millisecond)),
+				formatDuration(st.WindowBlocked.Round(time.Millisecond)),
+				formatDuration(st.RateBlocked.Round(time.Millisecond)), st.FrameFlushes,
+				formatLatency(&h, h.Quantile(0.5)), formatLatency(&h, h.Quantile(0.9)),
+				formatLatency(&h, h.Quantile(0.99)), formatLatency(&h, h.Max))
+		}
+	}
+}